@@ -38,7 +38,7 @@ type AdminService struct {
 // TunnelDetail provides detailed tunnel information for auditing
 type TunnelDetail struct {
 	Token             string              `json:"token"`
-	RemoteAddr        string              `json:"remote_addr"`
+	RemoteAddr        string              `json:"remote_addr"` // of the websocket that connected last
 	RemoteName        string              `json:"remote_name"`
 	RemoteWhois       string              `json:"remote_whois"`
 	ClientVersion     string              `json:"client_version"`
@@ -49,17 +49,38 @@ type TunnelDetail struct {
 	LastSuccessTime   *time.Time          `json:"last_success_time,omitempty"`
 	LastSuccessAddr   string              `json:"last_success_addr,omitempty"`
 	PendingRequests   int                 `json:"pending_requests"`
+	Policy            string              `json:"policy"`  // connection policy of the token
+	Clients           int                 `json:"clients"` // clients connected with the token
+	Balance           string              `json:"balance"` // balancing policy of the token
+	StickySessions    int                 `json:"sticky_sessions"`
+	Websockets        []*WebsocketDetail  `json:"websockets"`
 }
 
 // ConnectionDetail provides information about active connections
 type ConnectionDetail struct {
-	RequestID  int16     `json:"request_id"`
+	RequestID  uint32    `json:"request_id"`
 	Method     string    `json:"method"`
 	URI        string    `json:"uri"`
 	RemoteAddr string    `json:"remote_addr"`
 	StartTime  time.Time `json:"start_time"`
 }
 
+// WebsocketDetail provides information about a websocket of a tunnel, see connections.go
+type WebsocketDetail struct {
+	ID            string    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ClientVersion string    `json:"client_version"`
+	Protocol      int       `json:"protocol"`
+	Pool          string    `json:"pool,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Requests      int64     `json:"requests"`
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	RTTMillis     float64   `json:"rtt_ms"`
+	Weight        int       `json:"weight"`
+	Priority      int       `json:"priority"`
+}
+
 // AuditingResponse represents the JSON response for /admin/auditing
 type AuditingResponse struct {
 	Timestamp time.Time                `json:"timestamp"`
@@ -87,6 +108,8 @@ type RequestEvent struct {
 	StartTime  time.Time  `json:"start_time"`
 	EndTime    *time.Time `json:"end_time,omitempty"`
 	Error      string     `json:"error,omitempty"`
+	Attempts   int        `json:"attempts"`              // times the request was sent through the tunnel
+	AttemptLog string     `json:"attempt_log,omitempty"` // outcome of each attempt, e.g. "1:retry 2:HTTP 200"
 }
 
 const (
@@ -94,6 +117,9 @@ const (
 	TunnelEventDisconnected = "disconnected"
 	TunnelEventReaped       = "reaped"
 	TunnelEventError        = "error"
+	TunnelEventClaimed      = "claimed"  // a client claimed the token, see claim.go
+	TunnelEventRejected     = "rejected" // a websocket was refused by the claim or policy of its token
+	TunnelEventTakeover     = "takeover" // a client took an exclusive token over, see policy.go
 )
 
 // TunnelEvent represents a tunnel lifecycle event
@@ -200,6 +226,19 @@ func (as *AdminService) initDB() error {
 		}
 	}
 
+	// columns added since the tables were first created, databases that have them already
+	// report a duplicate column
+	columns := []string{
+		`ALTER TABLE request_events ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE request_events ADD COLUMN attempt_log TEXT`,
+	}
+	for _, query := range columns {
+		if _, err := as.db.ExecContext(context.Background(), query); err != nil &&
+			!strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("failed to add column: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -262,6 +301,33 @@ func (as *AdminService) RecordRequestComplete(ctx context.Context, requestID int
 	return nil
 }
 
+// RecordRequestAttempt records an attempt at sending a request through the tunnel and how it
+// ended
+func (as *AdminService) RecordRequestAttempt(ctx context.Context, requestID int64, attempt int, outcome string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	entry := fmt.Sprintf("%d:%s", attempt, outcome)
+	result, err := as.db.ExecContext(ctx, `
+		UPDATE request_events
+		SET attempts = ?, attempt_log = COALESCE(attempt_log || ' ', '') || ?
+		WHERE id = ?
+	`, attempt, entry, requestID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("request ID %d not found", requestID)
+	}
+
+	return nil
+}
+
 // RecordTunnelEvent records a tunnel lifecycle event
 func (as *AdminService) RecordTunnelEvent(ctx context.Context, token, event, remoteAddr, remoteName, remoteWhois, clientVersion, details string) error {
 	// Validate inputs
@@ -299,7 +365,7 @@ func (as *AdminService) GetMonitoringStats(ctx context.Context) (*MonitoringResp
 	// Count active tunnel connections
 	tunnelConnections := 0
 	for _, rs := range as.server.serverRegistry {
-		if time.Since(rs.lastActivity) < tunnelInactiveKillTimeout {
+		if time.Since(rs.getLastActivity()) < tunnelInactiveKillTimeout {
 			tunnelConnections++
 		}
 	}
@@ -397,17 +463,22 @@ func (as *AdminService) GetAuditingData(ctx context.Context) (*AuditingResponse,
 
 		tunnels[string(tokenStr)] = &TunnelDetail{
 			Token:             string(tokenStr),
-			RemoteAddr:        rs.remoteAddr,
+			RemoteAddr:        rs.getRemoteAddr(),
 			RemoteName:        remoteName,
 			RemoteWhois:       remoteWhois,
 			ClientVersion:     clientVersion,
-			LastActivity:      rs.lastActivity,
+			LastActivity:      rs.getLastActivity(),
 			ActiveConnections: activeConnections,
 			LastErrorTime:     lastErrorTime,
 			LastErrorAddr:     lastErrorAddr,
 			LastSuccessTime:   lastSuccessTime,
 			LastSuccessAddr:   lastSuccessAddr,
-			PendingRequests:   len(rs.requestSet),
+			PendingRequests:   rs.getPendingRequests(),
+			Policy:            as.server.tokenPolicy(tokenStr),
+			Clients:           rs.clientCount(),
+			Balance:           rs.balance,
+			StickySessions:    rs.stickySessions(),
+			Websockets:        rs.websockets(),
 		}
 	}
 	as.server.serverRegistryMutex.Unlock()
@@ -628,11 +699,96 @@ func (as *AdminService) GetAPIDocumentation() *APIDocsResponse {
 									"type":        "integer",
 									"description": "Number of requests currently pending for this tunnel",
 								},
+								"policy": map[string]string{
+									"type":        "string",
+									"description": "Connection policy of the token: shared, exclusive-reject or exclusive-takeover",
+								},
+								"clients": map[string]string{
+									"type":        "integer",
+									"description": "Number of clients connected with the token",
+								},
+								"balance": map[string]string{
+									"type":        "string",
+									"description": "Balancing policy of the token: first-free, round-robin, least-pending, weighted or failover",
+								},
+								"sticky_sessions": map[string]string{
+									"type":        "integer",
+									"description": "Number of callers currently pinned to a client of the tunnel",
+								},
+								"websockets": map[string]interface{}{
+									"type":        "array",
+									"description": "WebSocket connections serving this tunnel, oldest first",
+									"items": map[string]interface{}{
+										"type": "object",
+										"properties": map[string]interface{}{
+											"id": map[string]string{
+												"type":        "string",
+												"description": "Identifier of the connection, used to close it",
+											},
+											"remote_addr": map[string]string{
+												"type":        "string",
+												"description": "IP address of the tunnel client",
+											},
+											"client_version": map[string]string{
+												"type":        "string",
+												"description": "Version of the tunnel client software",
+											},
+											"protocol": map[string]string{
+												"type":        "integer",
+												"description": "Tunnel protocol version spoken on the connection",
+											},
+											"pool": map[string]string{
+												"type":        "string",
+												"description": "Client pool the connection belongs to (if any)",
+											},
+											"connected_at": map[string]string{
+												"type":        "string",
+												"format":      "datetime",
+												"description": "When the connection was established",
+											},
+											"requests": map[string]string{
+												"type":        "integer",
+												"description": "Number of requests sent on the connection",
+											},
+											"bytes_in": map[string]string{
+												"type":        "integer",
+												"description": "Bytes received from the client",
+											},
+											"bytes_out": map[string]string{
+												"type":        "integer",
+												"description": "Bytes sent to the client",
+											},
+											"rtt_ms": map[string]string{
+												"type":        "number",
+												"description": "Last measured round-trip time to the client in milliseconds",
+											},
+											"weight": map[string]string{
+												"type":        "integer",
+												"description": "Weight the client connected with",
+											},
+											"priority": map[string]string{
+												"type":        "integer",
+												"description": "Priority the client connected with, the lowest ones get traffic on failover",
+											},
+										},
+									},
+								},
 							},
 						},
 					},
 				},
 			},
+			{
+				Path:        "/admin/connections/{id}",
+				Method:      "DELETE",
+				Description: "Close a tunnel WebSocket connection, its client reconnects it",
+				Response: map[string]interface{}{
+					"status": map[string]string{
+						"type":        "integer",
+						"description": "204 once the connection is closed, 404 if no connection has that id",
+					},
+				},
+			},
 			{
 				Path:        "/admin/api-docs",
 				Method:      "GET",
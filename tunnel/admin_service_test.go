@@ -127,6 +127,38 @@ func TestRecordRequestLifecycle(t *testing.T) {
 	}
 }
 
+func TestRecordRequestAttempt(t *testing.T) {
+	adminService, cleanup := setupTestAdminService(t)
+	defer cleanup()
+
+	requestID, err := adminService.RecordRequestStart(context.Background(), "test-token", "GET", "/retry", "192.168.1.1")
+	if err != nil {
+		t.Fatalf("Failed to record request start: %v", err)
+	}
+	for i, outcome := range []string{"retry", "HTTP 200"} {
+		if err := adminService.RecordRequestAttempt(context.Background(), requestID, i+1, outcome); err != nil {
+			t.Fatalf("Failed to record attempt %d: %v", i+1, err)
+		}
+	}
+	var attempts int
+	var log string
+	err = adminService.db.QueryRow("SELECT attempts, attempt_log FROM request_events WHERE id = ?", requestID).Scan(&attempts, &log)
+	if err != nil {
+		t.Fatalf("Failed to query attempts: %v", err)
+	}
+	if attempts != 2 || log != "1:retry 2:HTTP 200" {
+		t.Errorf("Expected 2 attempts, got %d %q", attempts, log)
+	}
+	if err := adminService.RecordRequestAttempt(context.Background(), requestID+100, 1, "retry"); err == nil {
+		t.Error("Expected an error for an unknown request")
+	}
+
+	// opening the database again keeps the columns
+	if err := adminService.initDB(); err != nil {
+		t.Errorf("Schema cannot be initialized twice: %v", err)
+	}
+}
+
 func TestRecordTunnelEvent(t *testing.T) {
 	adminService, cleanup := setupTestAdminService(t)
 	defer cleanup()
@@ -269,7 +301,7 @@ func TestGetAuditingData(t *testing.T) {
 		remoteName:    "client.example.com",
 		remoteWhois:   "Example Corp",
 		clientVersion: "wstunnel-1.0",
-		requestSet:    make(map[int16]*remoteRequest),
+		requestSet:    make(map[uint32]*remoteRequest),
 	}
 
 	// Add mock active request
@@ -807,7 +839,8 @@ func TestGetAPIDocumentation(t *testing.T) {
 		if endpoint.Path == "" {
 			t.Error("Endpoint path should not be empty")
 		}
-		if endpoint.Method != "GET" {
+		// closing a connection is the only admin action, all else is read-only
+		if endpoint.Method != "GET" && !(endpoint.Method == "DELETE" && endpoint.Path == "/admin/connections/{id}") {
 			t.Errorf("Expected all endpoints to be GET, got %s", endpoint.Method)
 		}
 		if endpoint.Description == "" {
@@ -0,0 +1,122 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Local server connections.
+//
+// The client sends the requests it gets through the tunnel to local servers over a shared
+// transport, so connections get reused across requests. -backend-protocol picks how it talks
+// to them: HTTP/1.1 only (http1, the default), HTTP/2 negotiated with TLS for https:// servers
+// (h2, falling back to HTTP/1.1 when the server doesn't offer it), or HTTP/2 only (h2c), with
+// prior knowledge for http:// servers and over TLS for https:// ones. HTTP/2 multiplexes the
+// requests on a single connection per server. gRPC calls always go over HTTP/2 (see grpc.go).
+// Responses from HTTP/2 servers go through the tunnel as HTTP/1.1.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Protocols the client can speak to local servers
+const (
+	backendHTTP1 = "http1"
+	backendH2    = "h2"
+	backendH2C   = "h2c"
+)
+
+const (
+	defaultBackendDialTimeout  = 30 // seconds
+	defaultBackendKeepAlive    = 30 // seconds
+	defaultBackendIdleTimeout  = 90 // seconds
+	defaultBackendIdleConns    = 100
+	defaultBackendIdleConnsPer = 16
+)
+
+// backendProtocols returns the protocols of a -backend-protocol value
+func backendProtocols(name string) (*http.Protocols, error) {
+	var protocols http.Protocols
+	switch name {
+	case backendHTTP1, "":
+		protocols.SetHTTP1(true)
+	case backendH2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case backendH2C:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unknown backend protocol %q, use %s, %s or %s", name,
+			backendHTTP1, backendH2, backendH2C)
+	}
+	return &protocols, nil
+}
+
+// backendTransport returns a transport to local servers speaking protocols, tuned with the
+// -backend-* options
+func (t *WSTunnelClient) backendTransport(tlsConfig *tls.Config, protocols *http.Protocols) *http.Transport {
+	dialer := &net.Dialer{Timeout: t.BackendDialTimeout, KeepAlive: t.BackendKeepAlive}
+	if t.BackendKeepAlive <= 0 {
+		dialer.KeepAlive = -1 // a zero value would mean the default
+	}
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   t.BackendDialTimeout,
+		Protocols:             protocols,
+		ResponseHeaderTimeout: t.BackendHeaderTimeout,
+		MaxIdleConns:          t.BackendIdleConns,
+		MaxIdleConnsPerHost:   t.BackendIdleConnsPerHost,
+		IdleConnTimeout:       t.BackendIdleTimeout,
+		// let the local server reject "Expect: 100-continue" uploads before they're sent
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// setupBackendClients creates the clients requests are sent to local servers with
+func (t *WSTunnelClient) setupBackendClients(tlsConfig *tls.Config) error {
+	protocols, err := backendProtocols(t.BackendProtocol)
+	if err != nil {
+		return err
+	}
+	t.httpClient = http.Client{Transport: t.backendTransport(tlsConfig, protocols)}
+	h2, _ := backendProtocols(backendH2C)
+	h1, _ := backendProtocols(backendHTTP1)
+	t.h2Client, t.upgradeClient = t.httpClient, t.httpClient
+	if t.BackendProtocol != backendH2C {
+		t.h2Client = http.Client{Transport: t.backendTransport(tlsConfig, h2)}
+	} else {
+		t.upgradeClient = http.Client{Transport: t.backendTransport(tlsConfig, h1)}
+	}
+	t.Log.Info().Str("protocol", t.BackendProtocol).Msg("Local server protocol")
+	return nil
+}
+
+// backendClient returns the client to send a request to a local server with, websocket
+// handshakes need HTTP/1.1
+func (t *WSTunnelClient) backendClient(req *http.Request, upgrade bool) *http.Client {
+	switch {
+	case upgrade:
+		return &t.upgradeClient
+	case isGRPC(req):
+		return &t.h2Client
+	}
+	return &t.httpClient
+}
+
+// asHTTP11 makes a response from an HTTP/2 server go through the tunnel as HTTP/1.1. It's
+// chunked when it has no length or announces trailers, HTTP/2 sends trailers after a body of
+// known length but HTTP/1.1 only after a chunked one.
+func asHTTP11(resp *http.Response) {
+	if resp.ProtoMajor < 2 {
+		return
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.ContentLength < 0 || len(resp.Trailer) > 0 {
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		resp.TransferEncoding = []string{"chunked"}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBackendProtocols(t *testing.T) {
+	for name, expected := range map[string][]bool{ // HTTP1, HTTP2, UnencryptedHTTP2
+		"":    {true, false, false},
+		"h2":  {true, true, false},
+		"h2c": {false, true, true},
+	} {
+		p, err := backendProtocols(name)
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		if got := []bool{p.HTTP1(), p.HTTP2(), p.UnencryptedHTTP2()}; got[0] != expected[0] ||
+			got[1] != expected[1] || got[2] != expected[2] {
+			t.Errorf("%q: expected %v, got %v", name, expected, got)
+		}
+	}
+	if _, err := backendProtocols("spdy"); err == nil {
+		t.Error("Unknown protocol accepted")
+	}
+}
+
+func TestBackendFlags(t *testing.T) {
+	setupLogCapture(t)
+	cli := NewWSTunnelClient(clientBaseArgs("-backend-protocol", "h2c", "-backend-dial-timeout", "5",
+		"-backend-header-timeout", "7", "-backend-keepalive", "0", "-backend-idle-timeout", "60",
+		"-backend-idle-conns", "10", "-backend-idle-conns-per-host", "4"))
+	if cli.BackendProtocol != "h2c" || cli.BackendDialTimeout != 5*time.Second ||
+		cli.BackendHeaderTimeout != 7*time.Second || cli.BackendKeepAlive != 0 ||
+		cli.BackendIdleTimeout != time.Minute || cli.BackendIdleConns != 10 || cli.BackendIdleConnsPerHost != 4 {
+		t.Errorf("Unexpected backend settings: %+v", cli)
+	}
+	tr := cli.backendTransport(nil, nil)
+	if tr.ResponseHeaderTimeout != 7*time.Second || tr.MaxIdleConnsPerHost != 4 || tr.IdleConnTimeout != time.Minute {
+		t.Errorf("Transport not tuned: %+v", tr)
+	}
+
+	bad := NewWSTunnelClient(clientBaseArgs("-backend-protocol", "spdy"))
+	if err := bad.Start(); err == nil {
+		bad.Stop()
+		t.Error("Client started with an unknown backend protocol")
+	}
+}
+
+// TestBackendClientsPerTunnel checks that clients in one process keep their own local server
+// settings
+func TestBackendClientsPerTunnel(t *testing.T) {
+	setupLogCapture(t)
+	h1 := NewWSTunnelClient(clientBaseArgs("-backend-header-timeout", "3"))
+	h2c := NewWSTunnelClient(clientBaseArgs("-backend-protocol", "h2c", "-backend-header-timeout", "9"))
+	for _, cli := range []*WSTunnelClient{h1, h2c} {
+		if err := cli.setupBackendClients(nil); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	tr1 := h1.backendClient(req, false).Transport.(*http.Transport)
+	tr2 := h2c.backendClient(req, false).Transport.(*http.Transport)
+	if !tr1.Protocols.HTTP1() || tr1.ResponseHeaderTimeout != 3*time.Second {
+		t.Errorf("Settings of the first client lost: %+v", tr1)
+	}
+	if !tr2.Protocols.UnencryptedHTTP2() || tr2.ResponseHeaderTimeout != 9*time.Second {
+		t.Errorf("Settings of the second client lost: %+v", tr2)
+	}
+}
+
+// protoBackend answers with the protocol of the request and remembers the connections
+// requests came in on
+func protoBackend(conns *sync.Map) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns.Store(r.RemoteAddr, true)
+		_, _ = io.WriteString(w, r.Proto)
+	})
+}
+
+// testBackendProtocol checks the protocol requests reach the local server with, and that they
+// all share a connection
+func testBackendProtocol(t *testing.T, backend *httptest.Server, conns *sync.Map, expected string, cliArgs ...string) {
+	t.Cleanup(backend.Close)
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	env.server = backend
+	startTunnelClient(t, env, nil, false, cliArgs...)
+
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/proto")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != expected {
+			t.Fatalf("Expected the local server to get %s, got %q", expected, body)
+		}
+	}
+	n := 0
+	conns.Range(func(_, _ any) bool { n++; return true })
+	if n != 1 {
+		t.Errorf("Expected the requests to share a connection, they used %d", n)
+	}
+}
+
+func TestBackendHTTP1(t *testing.T) {
+	var conns sync.Map
+	testBackendProtocol(t, httptest.NewServer(protoBackend(&conns)), &conns, "HTTP/1.1")
+}
+
+func TestBackendH2C(t *testing.T) {
+	var conns sync.Map
+	backend := httptest.NewUnstartedServer(protoBackend(&conns))
+	setH2C(backend.Config)
+	backend.Start()
+	testBackendProtocol(t, backend, &conns, "HTTP/2.0", "-backend-protocol", "h2c")
+}
+
+func TestBackendH2(t *testing.T) {
+	var conns sync.Map
+	backend := httptest.NewUnstartedServer(protoBackend(&conns))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	testBackendProtocol(t, backend, &conns, "HTTP/2.0", "-backend-protocol", "h2", "-insecure")
+}
+
+// TestBackendHeaderTimeout checks that a local server that doesn't respond in time fails the
+// request instead of holding it until the server gives up
+func TestBackendHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	env := setupTunnelServer(t, backend)
+	startTunnelClient(t, env, backend, false, "-backend-header-timeout", "1")
+
+	start := time.Now()
+	resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/slow")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Request took %s to fail", elapsed)
+	}
+}
+
+// TestBackendH2CWebsocket checks that websocket handshakes still go over HTTP/1.1 when the
+// client speaks HTTP/2 to the local server
+func TestBackendH2CWebsocket(t *testing.T) {
+	backend := httptest.NewUnstartedServer(echoWebsocket())
+	setH2C(backend.Config)
+	backend.Start()
+	t.Cleanup(backend.Close)
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	env.server = backend
+	startTunnelClient(t, env, nil, false, "-backend-protocol", "h2c")
+
+	wsBase := "ws" + strings.TrimPrefix(env.wstunURL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(wsBase+"/_token/"+env.token+"/chat", nil)
+	if err != nil {
+		t.Fatalf("Dial through the tunnel failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	wsEcho(t, ws, "hello", "/chat:hello")
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Load balancing across the clients of a token.
+//
+// By default every websocket of a tunnel pulls requests off the tunnel's queue, so a request
+// goes to whichever websocket is free first (first-free). -balance picks another policy, which
+// assigns each request to a client when it's queued:
+//
+//   - round-robin hands requests to the connected clients in turn
+//   - least-pending picks the client with the fewest requests in flight
+//   - weighted hands requests out in proportion to the -weight the clients connected with
+//   - failover only uses the clients with the lowest -priority that are connected, the others
+//     stand by until all of these are gone, and spreads requests across them as least-pending
+//
+// -balance-policies sets the policy of given tokens. The websockets of a client's pool count as
+// one client, the request goes to its websocket with the fewest requests in flight. Requests
+// queued on a websocket that goes away are assigned again. Requests of a sticky session go to
+// the client the session is pinned to, see sticky.go. A request whose client has a full queue
+// fails with a 503 rather than going to another client, requests that come in while no client
+// can take any wait in the tunnel's queue and get assigned once one connects.
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Balancing policies of a token
+const (
+	balanceFirstFree    = "first-free"
+	balanceRoundRobin   = "round-robin"
+	balanceLeastPending = "least-pending"
+	balanceWeighted     = "weighted"
+	balanceFailover     = "failover"
+)
+
+// Handshake headers carrying how a client wants to be balanced
+const (
+	weightHeader   = "X-Tunnel-Weight"
+	priorityHeader = "X-Tunnel-Priority"
+)
+
+// errClientBusy fails a request assigned to a client that has too many requests queued
+var errClientBusy = errors.New("too many requests queued for the tunnel client")
+
+// validBalance returns whether a balancing policy exists
+func validBalance(policy string) bool {
+	switch policy {
+	case balanceFirstFree, balanceRoundRobin, balanceLeastPending, balanceWeighted, balanceFailover:
+		return true
+	}
+	return false
+}
+
+// balancePolicy returns the balancing policy of a token
+func (t *WSTunnelServer) balancePolicy(tok token) string {
+	if policy, ok := t.BalancePolicies[tok]; ok {
+		return policy
+	}
+	if t.BalancePolicy == "" {
+		return balanceFirstFree
+	}
+	return t.BalancePolicy
+}
+
+// parseBalanceHeaders reads the weight and priority a client connected with, a weight of 1 and
+// a priority of 0 if it didn't give valid ones
+func parseBalanceHeaders(h http.Header) (weight, priority int) {
+	weight, err := strconv.Atoi(h.Get(weightHeader))
+	if err != nil || weight < 1 {
+		weight = 1
+	}
+	priority, err = strconv.Atoi(h.Get(priorityHeader))
+	if err != nil {
+		priority = 0
+	}
+	return weight, priority
+}
+
+// balanceState is what a tunnel remembers between two balancing decisions, it's protected by
+// wsMutex
+type balanceState struct {
+	next    int            // round-robin position
+	current map[string]int // smooth weighted round-robin credit of each client
+}
+
+// balanceClient is a client of the tunnel that may get a request
+type balanceClient struct {
+	key      string
+	conns    []*remoteConn
+	weight   int
+	priority int
+	pending  int
+}
+
+// pendingOn returns how many requests are in flight on each websocket, the caller holds
+// requestSetMutex
+func (rs *remoteServer) pendingOn() map[*remoteConn]int {
+	pending := make(map[*remoteConn]int)
+	for _, req := range rs.requestSet {
+		if req.conn != nil {
+			pending[req.conn]++
+		}
+	}
+	return pending
+}
+
+// balanceClients groups the websockets that can take requests by client, in a stable order.
+// The caller holds wsMutex.
+func (rs *remoteServer) balanceClients(pending map[*remoteConn]int) []*balanceClient {
+	byKey := make(map[string]*balanceClient)
+	var clients []*balanceClient
+	for rc := range rs.conns {
+		if rc.queue == nil || rc.draining || !rc.isActive() {
+			continue
+		}
+		c := byKey[rc.client]
+		if c == nil {
+			c = &balanceClient{key: rc.client, weight: rc.weight, priority: rc.priority}
+			byKey[rc.client] = c
+			clients = append(clients, c)
+		}
+		c.conns = append(c.conns, rc)
+		c.pending += pending[rc] + len(rc.queue)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].key < clients[j].key })
+	return clients
+}
+
+// pickClient chooses the client that gets the next request
+func (rs *remoteServer) pickClient(clients []*balanceClient) *balanceClient {
+	switch rs.balance {
+	case balanceRoundRobin:
+		c := clients[rs.balanceState.next%len(clients)]
+		rs.balanceState.next++
+		return c
+	case balanceWeighted:
+		return rs.pickWeighted(clients)
+	case balanceFailover:
+		best := math.MaxInt
+		for _, c := range clients {
+			best = min(best, c.priority)
+		}
+		var primaries []*balanceClient
+		for _, c := range clients {
+			if c.priority == best {
+				primaries = append(primaries, c)
+			}
+		}
+		return rs.leastPending(primaries)
+	}
+	return rs.leastPending(clients)
+}
+
+// pickWeighted does a smooth weighted round-robin: each client earns its weight in credit at
+// every pick, the richest one is picked and pays back the total weight
+func (rs *remoteServer) pickWeighted(clients []*balanceClient) *balanceClient {
+	current := make(map[string]int, len(clients))
+	total := 0
+	var best *balanceClient
+	for _, c := range clients {
+		current[c.key] = rs.balanceState.current[c.key] + c.weight
+		total += c.weight
+		if best == nil || current[c.key] > current[best.key] {
+			best = c
+		}
+	}
+	current[best.key] -= total
+	// clients that went away lose their credit
+	rs.balanceState.current = current
+	return best
+}
+
+// leastPending returns the client with the fewest requests in flight, ties are taken in turn
+func (rs *remoteServer) leastPending(clients []*balanceClient) *balanceClient {
+	start := rs.balanceState.next
+	rs.balanceState.next++
+	var best *balanceClient
+	for i := range clients {
+		c := clients[(start+i)%len(clients)]
+		if best == nil || c.pending < best.pending {
+			best = c
+		}
+	}
+	return best
+}
+
+// balanced returns whether a request goes to the websocket its sticky session or the tunnel's
+// balancing policy picks rather than the first one that is free
+func (rs *remoteServer) balanced(req *remoteRequest) bool {
+	return (rs.balance != "" && rs.balance != balanceFirstFree) || req.affinity != ""
+}
+
+// dispatch assigns a request to a websocket according to its sticky session or the tunnel's
+// balancing policy. It returns false if the request should go to the tunnel's queue instead,
+// because it isn't balanced or no websocket can take it yet, and errClientBusy if the websocket
+// picked has a full queue. The caller holds requestSetMutex.
+func (rs *remoteServer) dispatch(req *remoteRequest) (bool, error) {
+	if !rs.balanced(req) {
+		return false, nil
+	}
+	pending := rs.pendingOn()
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	clients := rs.balanceClients(pending)
+	if len(clients) == 0 {
+		return false, nil
+	}
+	c := rs.stickyClient(req.affinity, clients)
+	if c == nil {
+		c = rs.pickClient(clients)
+		rs.pin(req.affinity, c.key)
+	}
+	rc := c.conns[0]
+	for _, other := range c.conns[1:] {
+		if pending[other]+len(other.queue) < pending[rc]+len(rc.queue) {
+			rc = other
+		}
+	}
+	select {
+	case rc.queue <- req:
+		return true, nil
+	default:
+		return true, errClientBusy
+	}
+}
+
+// undispatch stops a websocket that is going away from getting requests and assigns the ones
+// queued on it again
+func (rs *remoteServer) undispatch(rc *remoteConn) {
+	if rc.queue == nil {
+		return
+	}
+	rs.wsMutex.Lock()
+	rc.draining = true
+	rs.wsMutex.Unlock()
+	for {
+		select {
+		case req := <-rc.queue:
+			rs.requeue(req)
+		default:
+			return
+		}
+	}
+}
+
+// requeue assigns a request again, it fails if that's not possible
+func (rs *remoteServer) requeue(req *remoteRequest) {
+	if err := rs.AddRequest(req); err != nil {
+		select {
+		case req.replyChan <- responseBuffer{err: err}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// balancedServer returns a tunnel balancing requests with a policy
+func balancedServer(policy string) *remoteServer {
+	rs := newTestRemoteServer(zerolog.Nop(), 1000)
+	rs.balance = policy
+	return rs
+}
+
+// addBalancedConn connects an active websocket of a client to a tunnel
+func addBalancedConn(rs *remoteServer, client string, weight, priority int) *remoteConn {
+	rc := &remoteConn{
+		client:   client,
+		weight:   weight,
+		priority: priority,
+		active:   make(chan struct{}),
+		queue:    make(chan *remoteRequest, 1000),
+	}
+	rc.activate()
+	rs.wsUp(rc)
+	return rc
+}
+
+// queueRequests adds n requests to a tunnel
+func queueRequests(t *testing.T, rs *remoteServer, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		req := &remoteRequest{replyChan: make(chan responseBuffer, 1), log: zerolog.Nop()}
+		if err := rs.AddRequest(req); err != nil {
+			t.Fatalf("AddRequest: %v", err)
+		}
+	}
+}
+
+// assertQueued checks how many requests were assigned to each websocket
+func assertQueued(t *testing.T, conns []*remoteConn, expected ...int) {
+	t.Helper()
+	for i, rc := range conns {
+		if len(rc.queue) != expected[i] {
+			t.Errorf("Websocket of %s: expected %d requests, got %d", rc.client, expected[i], len(rc.queue))
+		}
+	}
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	rs := balancedServer(balanceRoundRobin)
+	conns := []*remoteConn{
+		addBalancedConn(rs, "a", 1, 0),
+		addBalancedConn(rs, "b", 1, 0),
+		addBalancedConn(rs, "c", 1, 0),
+	}
+	queueRequests(t, rs, 300)
+	assertQueued(t, conns, 100, 100, 100)
+	if len(rs.requestQueue) != 0 {
+		t.Errorf("%d requests left in the tunnel's queue", len(rs.requestQueue))
+	}
+}
+
+func TestBalanceWeighted(t *testing.T) {
+	rs := balancedServer(balanceWeighted)
+	a := addBalancedConn(rs, "a", 3, 0)
+	b := addBalancedConn(rs, "b", 1, 0)
+	// smooth: b gets one request out of every 4, not 3 in a row after a's
+	queueRequests(t, rs, 4)
+	assertQueued(t, []*remoteConn{a, b}, 3, 1)
+	queueRequests(t, rs, 396)
+	assertQueued(t, []*remoteConn{a, b}, 300, 100)
+}
+
+func TestBalanceLeastPending(t *testing.T) {
+	rs := balancedServer(balanceLeastPending)
+	a := addBalancedConn(rs, "a", 1, 0)
+	b := addBalancedConn(rs, "b", 1, 0)
+	// a is busy with 4 requests
+	for id := uint32(1); id <= 4; id++ {
+		rs.requestSet[id] = &remoteRequest{id: id, conn: a}
+	}
+	rs.lastID = 4
+	queueRequests(t, rs, 6)
+	assertQueued(t, []*remoteConn{a, b}, 1, 5)
+}
+
+func TestBalanceFailover(t *testing.T) {
+	rs := balancedServer(balanceFailover)
+	p1 := addBalancedConn(rs, "primary-1", 1, 0)
+	p2 := addBalancedConn(rs, "primary-2", 1, 0)
+	standby := addBalancedConn(rs, "standby", 1, 1)
+	queueRequests(t, rs, 10)
+	assertQueued(t, []*remoteConn{p1, p2, standby}, 5, 5, 0)
+
+	// the requests of a primary that goes away move to the other one
+	rs.undispatch(p1)
+	rs.wsDown(p1)
+	assertQueued(t, []*remoteConn{p1, p2, standby}, 0, 10, 0)
+
+	// the standby takes over once all primaries are gone
+	rs.undispatch(p2)
+	rs.wsDown(p2)
+	queueRequests(t, rs, 2)
+	assertQueued(t, []*remoteConn{p1, p2, standby}, 0, 0, 12)
+}
+
+// TestBalanceFailoverSaturated checks that standbys get nothing while a primary is connected,
+// even when its queue is full
+func TestBalanceFailoverSaturated(t *testing.T) {
+	rs := balancedServer(balanceFailover)
+	primary := addBalancedConn(rs, "primary", 1, 0)
+	primary.queue = make(chan *remoteRequest, 2)
+	standby := addBalancedConn(rs, "standby", 1, 1)
+	queueRequests(t, rs, 2)
+	req := &remoteRequest{replyChan: make(chan responseBuffer, 1), log: zerolog.Nop()}
+	if err := rs.AddRequest(req); err != errClientBusy {
+		t.Errorf("Expected the request to fail with the primary saturated, got %v", err)
+	}
+	assertQueued(t, []*remoteConn{primary, standby}, 2, 0)
+	if len(rs.requestQueue) != 0 {
+		t.Errorf("%d requests went to the tunnel's queue", len(rs.requestQueue))
+	}
+}
+
+// TestBalanceQueuedWithoutClients checks that requests that came in while no client was
+// connected are balanced once clients connect, whichever websocket picks them up
+func TestBalanceQueuedWithoutClients(t *testing.T) {
+	rs := balancedServer(balanceFailover)
+	queueRequests(t, rs, 3)
+	if len(rs.requestQueue) != 3 {
+		t.Fatalf("Expected the requests to wait in the tunnel's queue, got %d", len(rs.requestQueue))
+	}
+	primary := addBalancedConn(rs, "primary", 1, 0)
+	standby := addBalancedConn(rs, "standby", 1, 1)
+	// what the standby's writer does with the requests it takes off the tunnel's queue
+	for len(rs.requestQueue) > 0 {
+		req := <-rs.requestQueue
+		if !rs.balanced(req) {
+			t.Fatal("Expected the request to be balanced")
+		}
+		rs.requeue(req)
+	}
+	assertQueued(t, []*remoteConn{primary, standby}, 3, 0)
+}
+
+func TestBalancePool(t *testing.T) {
+	rs := balancedServer(balanceRoundRobin)
+	a1 := addBalancedConn(rs, "a", 1, 0)
+	a2 := addBalancedConn(rs, "a", 1, 0)
+	b := addBalancedConn(rs, "b", 1, 0)
+	spare := &remoteConn{client: "b", active: make(chan struct{}), queue: make(chan *remoteRequest, 10)}
+	rs.wsUp(spare)
+	// the pool counts as one client, its websockets share its requests and spares get none
+	queueRequests(t, rs, 8)
+	assertQueued(t, []*remoteConn{a1, a2, b, spare}, 2, 2, 4, 0)
+}
+
+func TestBalanceFirstFree(t *testing.T) {
+	rs := balancedServer(balanceFirstFree)
+	a := addBalancedConn(rs, "a", 1, 0)
+	queueRequests(t, rs, 3)
+	assertQueued(t, []*remoteConn{a}, 0)
+	if len(rs.requestQueue) != 3 {
+		t.Errorf("Expected the requests in the tunnel's queue, got %d", len(rs.requestQueue))
+	}
+}
+
+func TestBalanceWithoutClients(t *testing.T) {
+	rs := balancedServer(balanceRoundRobin)
+	queueRequests(t, rs, 2)
+	if len(rs.requestQueue) != 2 {
+		t.Errorf("Expected the requests to wait in the tunnel's queue, got %d", len(rs.requestQueue))
+	}
+}
+
+// TestBalanceWeightedClients checks the distribution across two real clients of a token
+func TestBalanceWeightedClients(t *testing.T) {
+	var heavy, light atomic.Int32
+	counter := func(n *atomic.Int32) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n.Add(1)
+			_, _ = w.Write([]byte("ok"))
+		})
+	}
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-balance", balanceWeighted)
+	startTunnelClient(t, env, counter(&heavy), true, "-weight", "3", "-spare-websockets", "0")
+	startTunnelClient(t, env, counter(&light), true, "-weight", "1", "-spare-websockets", "0")
+
+	for i := 0; i < 40; i++ {
+		getOK(t, env)
+	}
+	if heavy.Load() != 30 || light.Load() != 10 {
+		t.Errorf("Expected 30 and 10 requests, got %d and %d", heavy.Load(), light.Load())
+	}
+	for _, ws := range tunnelWebsockets(t, env) {
+		if (ws.Weight == 3 && ws.Requests != 30) || (ws.Weight == 1 && ws.Requests != 10) {
+			t.Errorf("Unexpected websocket record: %+v", ws)
+		}
+	}
+}
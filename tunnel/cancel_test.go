@@ -0,0 +1,115 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// blockingBackend signals started when a request comes in and cancelled once the request's
+// context is done
+func blockingBackend(started, cancelled chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(20 * time.Second):
+			_, _ = io.WriteString(w, "finished")
+		}
+	})
+}
+
+func testCallerCancellation(t *testing.T, internal bool) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	env := setupTunnelTest(t, blockingBackend(started, cancelled), internal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", env.wstunURL+"/_token/"+env.token+"/slow", nil)
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		errc <- err
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request did not reach the backend")
+	}
+	cancel()
+	if err := <-errc; err == nil {
+		t.Error("Expected the cancelled request to fail")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend request was not cancelled after the caller went away")
+	}
+}
+
+func TestCallerCancellation(t *testing.T) {
+	testCallerCancellation(t, false)
+}
+
+func TestCallerCancellationInternal(t *testing.T) {
+	testCallerCancellation(t, true)
+}
+
+// TestCancelledStreamingResponse checks that the backend stops when the caller hangs up
+// half way through a streamed response
+func TestCancelledStreamingResponse(t *testing.T) {
+	cancelled := make(chan struct{})
+	env := setupTunnelTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := io.WriteString(w, "tick\n"); err != nil {
+				break
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}), false)
+
+	resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/ticks")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "tick\n" {
+		t.Fatalf("Expected a first tick, got %q %v", buf, err)
+	}
+	_ = resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend kept streaming after the caller went away")
+	}
+}
+
+// TestCancelUnknownRequest checks that the client ignores cancels for requests it's done with
+func TestCancelUnknownRequest(t *testing.T) {
+	wsc := &WSConnection{tun: &WSTunnelClient{}}
+	wsc.releaseRequest(42)
+	ctx := wsc.startRequest(7)
+	wsc.releaseRequest(7)
+	if ctx.Err() == nil {
+		t.Error("Expected the request context to be cancelled on release")
+	}
+	wsc.releaseRequest(7)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Token claims.
+//
+// Any client presenting a token joins its tunnel and takes a share of its requests, so a
+// guessed or leaked token silently steals traffic. With -token-claim the first client whose
+// websocket comes up claims the token: the server binds the token to a secret it generates and
+// returns in the X-Tunnel-Claim header of the handshake response, and the client presents that
+// secret on the handshakes of its other and later websockets. While the claim lasts, websockets
+// for the token that don't present the secret are rejected with a 403. The claim expires once
+// the claiming client has been disconnected for the -token-claim number of seconds, the next
+// client to connect then claims the token anew. A client keeps its secret in -claim-file to get
+// its token back after a restart. A claim is only made once the websocket is up, and claims
+// that expired are forgotten. Claims and rejections are recorded as tunnel events.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// claimHeader carries the secret the server binds a claimed token to
+const claimHeader = "X-Tunnel-Claim"
+
+// errTokenClaimed rejects a websocket for a token another client claimed
+var errTokenClaimed = errors.New("token claimed by another client")
+
+// tokenClaim binds a token to the client that claimed it
+type tokenClaim struct {
+	secret  string
+	client  string    // the pool of the client that claimed it, see clientKey
+	at      time.Time // when the token was claimed
+	gone    time.Time // when the client that claimed it lost its last websocket
+	renewed bool      // whether it replaced a claim that expired
+}
+
+// tokenClaims are the claims of the tokens of a server
+type tokenClaims struct {
+	sync.Mutex
+	claims map[token]*tokenClaim
+	swept  time.Time // when expired claims were last forgotten
+}
+
+// claimExpired returns whether the client holding a claim has been gone long enough for
+// another one to take the token, other clients of the token don't keep the claim alive. The
+// caller holds the tokenClaims lock.
+func (t *WSTunnelServer) claimExpired(tok token, c *tokenClaim) bool {
+	t.serverRegistryMutex.Lock()
+	rs := t.serverRegistry[tok]
+	t.serverRegistryMutex.Unlock()
+	if rs != nil && rs.clientConnected(c.client, nil) {
+		return false
+	}
+	since := c.at
+	if !c.gone.IsZero() {
+		since = c.gone
+	}
+	return time.Since(since) > t.ClaimTimeout
+}
+
+// claimantGone starts the expiry of the claim on a token when the websocket rc going away is
+// the last one of the client that claimed it
+func (t *WSTunnelServer) claimantGone(tok token, rs *remoteServer, rc *remoteConn) {
+	t.tokenClaims.Lock()
+	defer t.tokenClaims.Unlock()
+	c := t.tokenClaims.claims[tok]
+	if c != nil && c.client == rc.client && !rs.clientConnected(rc.client, rc) {
+		c.gone = time.Now()
+	}
+}
+
+// clientConnected returns whether the tunnel has a websocket of client other than except
+func (rs *remoteServer) clientConnected(client string, except *remoteConn) bool {
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	for c := range rs.conns {
+		if c != except && c.client == client {
+			return true
+		}
+	}
+	return false
+}
+
+// claimToken checks a tunnel websocket handshake of client against the claim on its token. It
+// returns the claim the websocket makes, with a new secret, if nobody holds the token, nil if
+// it presents the secret of the claim, and errTokenClaimed if it doesn't. The claim is held for
+// the websocket until it's confirmed with confirmClaim once the websocket is up, or dropped with
+// releaseClaim.
+func (t *WSTunnelServer) claimToken(tok token, secret, client, addr string) (*tokenClaim, error) {
+	if t.ClaimTimeout <= 0 {
+		return nil, nil
+	}
+	t.tokenClaims.Lock()
+	c := t.tokenClaims.claims[tok]
+	t.sweepClaims()
+	switch {
+	case c != nil && secret != "" && constantTimeEquals(secret, c.secret):
+		t.tokenClaims.Unlock()
+		return nil, nil
+	case c != nil && !t.claimExpired(tok, c):
+		t.tokenClaims.Unlock()
+		t.recordTokenEvent(tok, TunnelEventRejected, addr, errTokenClaimed.Error())
+		return nil, errTokenClaimed
+	}
+	if t.tokenClaims.claims == nil {
+		t.tokenClaims.claims = make(map[token]*tokenClaim)
+	}
+	claim := &tokenClaim{secret: claimSecret(), client: client, at: time.Now(), renewed: c != nil}
+	t.tokenClaims.claims[tok] = claim
+	t.tokenClaims.Unlock()
+	return claim, nil
+}
+
+// claimSecret generates the secret a claimed token gets bound to
+func claimSecret() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// confirmClaim records a claim made by a websocket that is now up
+func (t *WSTunnelServer) confirmClaim(tok token, claim *tokenClaim, addr string) {
+	details := "first claim"
+	if claim.renewed {
+		details = "previous claim expired"
+	}
+	t.Log.Info().Str("token", cutToken(tok)).Str("addr", addr).Str("details", details).Msg("WS token claimed")
+	t.recordTokenEvent(tok, TunnelEventClaimed, addr, details)
+}
+
+// releaseClaim drops the claim of a websocket that didn't make it, the client never learnt the
+// handshake went through
+func (t *WSTunnelServer) releaseClaim(tok token, claim *tokenClaim) {
+	t.tokenClaims.Lock()
+	defer t.tokenClaims.Unlock()
+	if t.tokenClaims.claims[tok] == claim {
+		delete(t.tokenClaims.claims, tok)
+	}
+}
+
+// sweepClaims forgets the claims that expired, at most once per ClaimTimeout. The caller holds
+// the tokenClaims lock.
+func (t *WSTunnelServer) sweepClaims() {
+	if time.Since(t.tokenClaims.swept) < t.ClaimTimeout {
+		return
+	}
+	for tok, c := range t.tokenClaims.claims {
+		if t.claimExpired(tok, c) {
+			delete(t.tokenClaims.claims, tok)
+		}
+	}
+	t.tokenClaims.swept = time.Now()
+}
+
+// recordTokenEvent records how a client fared with the claim or policy of a token in the
+// admin database
+func (t *WSTunnelServer) recordTokenEvent(tok token, event, addr, details string) {
+	if as := t.getAdminService(); as != nil {
+		if err := as.RecordTunnelEvent(context.Background(), string(tok), event, addr, "", "", "", details); err != nil {
+			t.Log.Warn().Str("event", event).Err(err).Msg("Failed to record tunnel event")
+		}
+	}
+}
+
+//===== Client =====
+
+// clientClaim is the secret the server bound the client's token to, kept in a file if the
+// client has one
+type clientClaim struct {
+	turn   sync.Mutex // handshakes take turns until one went through
+	mu     sync.Mutex // protects secret and known
+	secret string
+	known  bool // whether a handshake went through
+	file   string
+	log    zerolog.Logger
+}
+
+// newClientClaim returns the claim of a client, with the secret kept in file if there is one
+func newClientClaim(file string, log zerolog.Logger) *clientClaim {
+	c := &clientClaim{file: file, log: log}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error().Err(err).Str("file", file).Msg("Failed to read claim secret")
+		}
+		c.secret = strings.TrimSpace(string(b))
+	}
+	return c
+}
+
+// handshake returns the secret to present on a websocket handshake and a function to call
+// with the handshake's response, nil if it failed. Until a handshake went through they take
+// turns, so that the websockets of the pool present the secret the server hands the first one.
+func (c *clientClaim) handshake() (string, func(*http.Response)) {
+	c.turn.Lock()
+	c.mu.Lock()
+	secret, known := c.secret, c.known
+	c.mu.Unlock()
+	if known {
+		c.turn.Unlock()
+	}
+	return secret, func(resp *http.Response) {
+		if resp != nil {
+			c.learn(resp.Header.Get(claimHeader))
+		}
+		if !known {
+			c.turn.Unlock()
+		}
+	}
+}
+
+// learn takes the secret a handshake that went through got from the server, none if the
+// websocket presented the current one or the server doesn't bind tokens
+func (c *clientClaim) learn(secret string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.known = true
+	if secret == "" || secret == c.secret {
+		return
+	}
+	c.secret = secret
+	c.log.Info().Msg("WS   token claimed")
+	if c.file != "" {
+		if err := os.WriteFile(c.file, []byte(secret+"\n"), 0o600); err != nil {
+			c.log.Error().Err(err).Str("file", c.file).Msg("Failed to save claim secret")
+		}
+	}
+}
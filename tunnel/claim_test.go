@@ -0,0 +1,212 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// dialClaim opens a raw tunnel websocket presenting a claim secret, it returns the status of
+// the handshake and the claim secret the server returned
+func dialClaim(t *testing.T, env *tunnelTestEnv, secret string) (int, string) {
+	t.Helper()
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	if secret != "" {
+		h.Set(claimHeader, secret)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if resp == nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if ws != nil {
+		t.Cleanup(func() { _ = ws.Close() })
+	}
+	return resp.StatusCode, resp.Header.Get(claimHeader)
+}
+
+// claimEvents returns the details of the claim events of a token, oldest first
+func claimEvents(t *testing.T, env *tunnelTestEnv, event string) []string {
+	t.Helper()
+	rows, err := env.wstunsrv.getAdminService().db.Query(
+		"SELECT details FROM tunnel_events WHERE token = ? AND event = ? ORDER BY id", hashToken(env.token), event)
+	if err != nil {
+		t.Fatalf("Cannot read tunnel events: %v", err)
+	}
+	defer func() { _ = rows.Close() }()
+	var details []string
+	for rows.Next() {
+		var d string
+		_ = rows.Scan(&d)
+		details = append(details, d)
+	}
+	return details
+}
+
+// clientSecret returns the claim secret the tunnel client got from the server
+func clientSecret(env *tunnelTestEnv) string {
+	c := env.wstuncli.claim
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secret
+}
+
+func TestTokenClaim(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-token-claim", "1")
+	startTunnelClient(t, env, http.NotFoundHandler(), false, "-websockets", "3")
+	secret := clientSecret(env)
+	if len(secret) != 64 {
+		t.Fatalf("Expected the client to get a generated secret, got %q", secret)
+	}
+	// the other websockets of the pool present the secret
+	for start := time.Now(); len(tunnelWebsockets(t, env)) != 3; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Expected the pool's 3 websockets to connect, got %d", len(tunnelWebsockets(t, env)))
+		}
+	}
+
+	if code, _ := dialClaim(t, env, ""); code != http.StatusForbidden {
+		t.Errorf("Websocket without the secret: expected 403, got %d", code)
+	}
+	if code, _ := dialClaim(t, env, "guessed"); code != http.StatusForbidden {
+		t.Errorf("Websocket with the wrong secret: expected 403, got %d", code)
+	}
+	if code, s := dialClaim(t, env, secret); code != http.StatusSwitchingProtocols || s != "" {
+		t.Errorf("Websocket with the secret: expected 101 without a new secret, got %d %q", code, s)
+	}
+	if d := claimEvents(t, env, TunnelEventClaimed); len(d) != 1 || d[0] != "first claim" {
+		t.Errorf("Unexpected claim events: %q", d)
+	}
+	if d := claimEvents(t, env, TunnelEventRejected); len(d) != 2 {
+		t.Errorf("Expected 2 rejections, got %q", d)
+	}
+}
+
+func TestTokenClaimExpires(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-token-claim", "1")
+	startTunnelClient(t, env, http.NotFoundHandler(), false)
+	secret := clientSecret(env)
+	stopClient(t, env)
+
+	if code, _ := dialClaim(t, env, ""); code != http.StatusForbidden {
+		t.Errorf("Claim taken over right away: %d", code)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	code, s := dialClaim(t, env, "")
+	if code != http.StatusSwitchingProtocols || s == "" || s == secret {
+		t.Errorf("Expired claim not taken over with a new secret: %d %q", code, s)
+	}
+	if d := claimEvents(t, env, TunnelEventClaimed); len(d) != 2 || d[1] != "previous claim expired" {
+		t.Errorf("Unexpected claim events: %q", d)
+	}
+}
+
+// TestTokenClaimExpiresWithOtherClient checks that a claim expires when the client that made it
+// is gone even though another client keeps the tunnel up
+func TestTokenClaimExpiresWithOtherClient(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-token-claim", "1")
+	startTunnelClient(t, env, http.NotFoundHandler(), false)
+	if code, _ := dialClaim(t, env, clientSecret(env)); code != http.StatusSwitchingProtocols {
+		t.Fatalf("Websocket with the secret: expected 101, got %d", code)
+	}
+	env.wstuncli.Stop()
+	for start := time.Now(); len(tunnelWebsockets(t, env)) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The server didn't notice the client went away")
+		}
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+	if code, s := dialClaim(t, env, ""); code != http.StatusSwitchingProtocols || s == "" {
+		t.Errorf("Claim of the gone client not taken over: %d %q", code, s)
+	}
+}
+
+// TestTokenClaimMadeUpSecret checks that the server doesn't take the secret of a claim from
+// the client
+func TestTokenClaimMadeUpSecret(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-token-claim", "60")
+	code, secret := dialClaim(t, env, "made-up")
+	if code != http.StatusSwitchingProtocols || secret == "" || secret == "made-up" {
+		t.Fatalf("Expected the token to be claimed with a generated secret, got %d %q", code, secret)
+	}
+	for _, s := range []string{"", "made-up"} {
+		if code, _ := dialClaim(t, env, s); code != http.StatusForbidden {
+			t.Errorf("Websocket with secret %q: expected 403, got %d", s, code)
+		}
+	}
+	if code, _ := dialClaim(t, env, secret); code != http.StatusSwitchingProtocols {
+		t.Errorf("Websocket with the generated secret: expected 101, got %d", code)
+	}
+}
+
+// TestTokenClaimRestart checks that clients keeping their secret in a file get their token
+// back right away after a restart
+func TestTokenClaimRestart(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-token-claim", "60")
+	file := filepath.Join(t.TempDir(), "claim")
+	startTunnelClient(t, env, http.NotFoundHandler(), false, "-claim-file", file)
+	secret := clientSecret(env)
+	stopClient(t, env)
+	if b, err := os.ReadFile(file); err != nil || strings.TrimSpace(string(b)) != secret {
+		t.Fatalf("Expected the secret to be kept in the file, got %q %v", b, err)
+	}
+	// fails the test if the client can't connect
+	startTunnelClient(t, env, http.NotFoundHandler(), false, "-claim-file", file)
+	if clientSecret(env) != secret {
+		t.Errorf("Expected the restarted client to keep its secret")
+	}
+	if d := claimEvents(t, env, TunnelEventRejected); len(d) != 0 {
+		t.Errorf("Expected no rejections, got %q", d)
+	}
+}
+
+func TestTokenClaimFailedHandshake(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-token-claim", "60")
+	req, _ := http.NewRequest(http.MethodGet, env.wstunURL+"/_tunnel", nil)
+	req.Header.Set("Origin", env.token)
+	req.Header.Set(claimHeader, "lost")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected the handshake to fail, got %d", resp.StatusCode)
+	}
+	if code, _ := dialClaim(t, env, ""); code != http.StatusSwitchingProtocols {
+		t.Errorf("Token kept claimed by a failed handshake: %d", code)
+	}
+	if d := claimEvents(t, env, TunnelEventClaimed); len(d) != 1 {
+		t.Errorf("Expected 1 claim, got %q", d)
+	}
+}
+
+func TestTokenClaimsForgotten(t *testing.T) {
+	srv := &WSTunnelServer{ClaimTimeout: 20 * time.Millisecond, Log: zerolog.Nop()}
+	if _, err := srv.claimToken("token-a", "", "client-a", ""); err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := srv.claimToken("token-b", "", "client-b", ""); err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if _, ok := srv.tokenClaims.claims["token-a"]; ok || len(srv.tokenClaims.claims) != 1 {
+		t.Errorf("Expected the expired claim to be forgotten, got %d claims", len(srv.tokenClaims.claims))
+	}
+}
+
+func TestTokenClaimOff(t *testing.T) {
+	env := setupTunnelTest(t, http.NotFoundHandler(), false)
+	if code, secret := dialClaim(t, env, ""); code != http.StatusSwitchingProtocols || secret != "" {
+		t.Errorf("Expected any client to get in without claims, got %d %q", code, secret)
+	}
+}
@@ -14,21 +14,23 @@ import (
 
 // ClientConfig holds the configuration for the WSTunnelClient
 type ClientConfig struct {
-	Token          string
-	Password       string
-	Tunnel         string
-	Server         string
-	Insecure       bool
-	Regexp         string
-	Timeout        int
-	PidFile        string
-	LogFile        string
-	StatusFile     string
-	Proxy          string
-	ClientPorts    string
-	CertFile       string
-	ReconnectDelay int
-	MaxRetries     int
+	Token                string
+	Password             string
+	Tunnel               string
+	Server               string
+	Insecure             bool
+	Regexp               string
+	Timeout              int
+	PidFile              string
+	LogFile              string
+	StatusFile           string
+	Proxy                string
+	ClientPorts          string
+	CertFile             string
+	ReconnectDelay       int
+	MaxRetries           int
+	Compression          bool
+	CompressionThreshold int
 }
 
 // ParseClientConfig parses command line arguments into a ClientConfig
@@ -58,6 +60,10 @@ func ParseClientConfig(args []string) (*ClientConfig, error) {
 	cliFlag.StringVar(&config.CertFile, "certfile", "", "path for trusted certificate in PEM-encoded format")
 	cliFlag.IntVar(&config.ReconnectDelay, "reconnect-delay", 5, "delay between reconnection attempts in seconds")
 	cliFlag.IntVar(&config.MaxRetries, "max-retries", 0, "maximum number of reconnection attempts (0 for unlimited)")
+	cliFlag.BoolVar(&config.Compression, "compression", false,
+		"compress the tunnel websocket (permessage-deflate) if the server agrees to it")
+	cliFlag.IntVar(&config.CompressionThreshold, "compression-threshold", defaultCompressionThreshold,
+		"size in bytes below which tunnel messages aren't compressed")
 
 	if err := cliFlag.Parse(args); err != nil {
 		return nil, err
@@ -69,15 +75,16 @@ func ParseClientConfig(args []string) (*ClientConfig, error) {
 // NewWSTunnelClientFromConfig creates a new WSTunnelClient from a ClientConfig
 func NewWSTunnelClientFromConfig(config *ClientConfig) (*WSTunnelClient, error) {
 	client := &WSTunnelClient{
-		Token:       config.Token,
-		Password:    config.Password,
-		Server:      config.Server,
-		Insecure:    config.Insecure,
-		Cert:        config.CertFile,
-		Timeout:     time.Duration(config.Timeout) * time.Second,
-		Log:         makeLogger("WStuncli", config.LogFile, ""),
-		connManager: NewConnectionManager(time.Duration(config.ReconnectDelay)*time.Second, config.MaxRetries),
-		exitChan:    make(chan struct{}, 1),
+		Token:                config.Token,
+		Password:             config.Password,
+		Server:               config.Server,
+		Insecure:             config.Insecure,
+		Cert:                 config.CertFile,
+		Timeout:              time.Duration(config.Timeout) * time.Second,
+		Compression:          config.Compression,
+		CompressionThreshold: config.CompressionThreshold,
+		Log:                  makeLogger("WStuncli", config.LogFile, ""),
+		connManager:          NewConnectionManager(time.Duration(config.ReconnectDelay)*time.Second, config.MaxRetries),
 	}
 	pkgLog = newPkgLogger()
 
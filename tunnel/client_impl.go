@@ -10,13 +10,15 @@ import (
 // ClientImpl provides the implementation of the WSTunnelClient
 type ClientImpl struct {
 	client         *WSTunnelClient
+	exitChan       chan struct{} // closed to tell the client goroutines to end
 	statusWriterWg sync.WaitGroup
 }
 
 // NewClientImpl creates a new ClientImpl
 func NewClientImpl(client *WSTunnelClient) *ClientImpl {
 	return &ClientImpl{
-		client: client,
+		client:   client,
+		exitChan: make(chan struct{}),
 	}
 }
 
@@ -36,6 +38,7 @@ func (ci *ClientImpl) Start() error {
 
 	// Create connection handler
 	handler := NewConnectionHandler(ci.client)
+	handler.exitChan = ci.exitChan
 
 	// Start connection with retry logic
 	err := handler.Reconnect()
@@ -54,7 +57,7 @@ func (ci *ClientImpl) Start() error {
 
 // Stop stops the client
 func (ci *ClientImpl) Stop() {
-	close(ci.client.exitChan)
+	close(ci.exitChan)
 
 	// Wait for status writer to exit before closing StatusFd
 	ci.statusWriterWg.Wait()
@@ -77,7 +80,7 @@ func (ci *ClientImpl) startStatusWriter(handler *ConnectionHandler) {
 
 	for {
 		select {
-		case <-ci.client.exitChan:
+		case <-ci.exitChan:
 			return
 		case <-time.After(time.Second):
 			stats := handler.GetStats()
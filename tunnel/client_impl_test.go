@@ -42,7 +42,6 @@ func TestClientImpl_Start_ValidationErrors(t *testing.T) {
 					Server:      "localhost:8080", // missing http:// or https://
 					Tunnel:      tunnelURL,
 					Log:         zerolog.Nop(),
-					exitChan:    make(chan struct{}),
 					connManager: NewConnectionManager(time.Second, 3),
 				}
 			},
@@ -105,7 +104,6 @@ func TestClientImpl_Start_ServerValidation(t *testing.T) {
 				InternalServer: tt.internalServer,
 				Tunnel:         tunnelURL,
 				Log:            zerolog.Nop(),
-				exitChan:       make(chan struct{}),
 				connManager:    NewConnectionManager(time.Second, 3),
 			}
 
@@ -332,7 +330,6 @@ func TestClientImpl_Stop(t *testing.T) {
 
 	client := &WSTunnelClient{
 		Log:      zerolog.Nop(),
-		exitChan: make(chan struct{}),
 		StatusFd: tmpFile,
 		conn:     nil, // Set to nil to avoid websocket close errors
 	}
@@ -344,7 +341,7 @@ func TestClientImpl_Stop(t *testing.T) {
 
 	// Verify that exitChan is closed
 	select {
-	case <-client.exitChan:
+	case <-impl.exitChan:
 		// Expected - channel should be closed
 	default:
 		t.Error("Expected exitChan to be closed")
@@ -99,7 +99,6 @@ func TestClientVersionHeader(t *testing.T) {
 		Token:       "test-token",
 		Tunnel:      tunnelURL,
 		Log:         zerolog.New(os.Stderr),
-		exitChan:    make(chan struct{}),
 		connManager: NewConnectionManager(5*time.Second, 0),
 		Timeout:     30 * time.Second,
 	}
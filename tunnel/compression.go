@@ -0,0 +1,197 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Compression.
+//
+// Tunnel websockets can compress their messages with permessage-deflate (RFC 7692). It's off
+// by default and only used when both ends ask for it, the extension being negotiated on the
+// websocket handshake. Messages smaller than the compression threshold are sent as is, they
+// don't shrink enough to be worth deflating. Each end counts the bytes of the messages it
+// sends and receives as well as the bytes that actually go over the wire, their ratio shows
+// how much compression saves.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultCompressionThreshold is the size below which messages aren't compressed
+const defaultCompressionThreshold = 1024
+
+// compressionExtension is the websocket extension used for compression
+const compressionExtension = "permessage-deflate"
+
+// Traffic counters
+const (
+	msgIn   = iota // bytes of the messages received
+	msgOut         // bytes of the messages sent
+	wireIn         // bytes read from the network
+	wireOut        // bytes written to the network
+)
+
+// tunnelTraffic counts the bytes exchanged over a tunnel websocket
+type tunnelTraffic struct {
+	bytes [4]atomic.Int64
+	total *tunnelTraffic // also counts everything, if set
+}
+
+func (tt *tunnelTraffic) count(counter, n int) {
+	for ; tt != nil; tt = tt.total {
+		tt.bytes[counter].Add(int64(n))
+	}
+}
+
+// ratio returns how many message bytes were carried per byte on the wire, 0 before anything
+// was carried
+func ratio(msg, wire int64) float64 {
+	if wire == 0 {
+		return 0
+	}
+	return float64(msg) / float64(wire)
+}
+
+// ratios returns the compression ratios of what was received and sent
+func (tt *tunnelTraffic) ratios() (in, out float64) {
+	return ratio(tt.bytes[msgIn].Load(), tt.bytes[wireIn].Load()),
+		ratio(tt.bytes[msgOut].Load(), tt.bytes[wireOut].Load())
+}
+
+// String formats the counters for status output
+func (tt *tunnelTraffic) String() string {
+	in, out := tt.ratios()
+	return fmt.Sprintf("in %d/%d bytes (ratio %.2f), out %d/%d bytes (ratio %.2f)",
+		tt.bytes[msgIn].Load(), tt.bytes[wireIn].Load(), in,
+		tt.bytes[msgOut].Load(), tt.bytes[wireOut].Load(), out)
+}
+
+// add accounts the traffic counted by o into tt
+func (tt *tunnelTraffic) add(o *tunnelTraffic) {
+	for i := range tt.bytes {
+		tt.bytes[i].Add(o.bytes[i].Load())
+	}
+}
+
+// writeTraffic writes the counters and compression ratios as stats lines whose names start
+// with prefix
+func writeTraffic(w io.Writer, prefix string, tt *tunnelTraffic) (int, error) {
+	in, out := tt.ratios()
+	return fmt.Fprintf(w, "%sbytes_in=%d\n%swire_bytes_in=%d\n%scompression_ratio_in=%.2f\n"+
+		"%sbytes_out=%d\n%swire_bytes_out=%d\n%scompression_ratio_out=%.2f\n",
+		prefix, tt.bytes[msgIn].Load(), prefix, tt.bytes[wireIn].Load(), prefix, in,
+		prefix, tt.bytes[msgOut].Load(), prefix, tt.bytes[wireOut].Load(), prefix, out)
+}
+
+// reader counts the bytes of a received message
+func (tt *tunnelTraffic) reader(r io.Reader) io.Reader {
+	return &trafficReader{r: r, tt: tt}
+}
+
+// writer counts the bytes of a message being sent
+func (tt *tunnelTraffic) writer(w io.WriteCloser) io.WriteCloser {
+	return &trafficWriter{w: w, tt: tt}
+}
+
+// conn counts the bytes going over a network connection
+func (tt *tunnelTraffic) conn(c net.Conn) net.Conn {
+	return &trafficConn{Conn: c, tt: tt}
+}
+
+// dialer wraps a websocket NetDial function so the connections it makes are counted, a nil
+// dial uses net.Dial
+func (tt *tunnelTraffic) dialer(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = net.Dial
+	}
+	return func(network, addr string) (net.Conn, error) {
+		c, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return tt.conn(c), nil
+	}
+}
+
+type trafficReader struct {
+	r  io.Reader
+	tt *tunnelTraffic
+}
+
+func (c *trafficReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.tt.count(msgIn, n)
+	return n, err
+}
+
+type trafficWriter struct {
+	w  io.WriteCloser
+	tt *tunnelTraffic
+}
+
+func (c *trafficWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.tt.count(msgOut, n)
+	return n, err
+}
+
+func (c *trafficWriter) Close() error { return c.w.Close() }
+
+type trafficConn struct {
+	net.Conn
+	tt *tunnelTraffic
+}
+
+func (c *trafficConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.tt.count(wireIn, n)
+	return n, err
+}
+
+func (c *trafficConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.tt.count(wireOut, n)
+	return n, err
+}
+
+// trafficHijacker hands the websocket upgrader a connection whose traffic is counted
+type trafficHijacker struct {
+	http.ResponseWriter
+	tt *tunnelTraffic
+}
+
+func (h *trafficHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, brw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.tt.conn(c), brw, nil
+}
+
+// Unwrap gives http.ResponseController access to the underlying ResponseWriter
+func (h *trafficHijacker) Unwrap() http.ResponseWriter { return h.ResponseWriter }
+
+// compressionNegotiated returns whether handshake headers agree on compression
+func compressionNegotiated(h http.Header) bool {
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), compressionExtension) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setWriteCompression turns compression on for the next message written to ws if it's worth
+// it. It's a no-op when compression wasn't negotiated.
+func setWriteCompression(ws *websocket.Conn, threshold, size int) {
+	ws.EnableWriteCompression(size >= threshold)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompressionNegotiated(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"permessage-deflate"}, true},
+		{[]string{"permessage-deflate; server_no_context_takeover; client_no_context_takeover"}, true},
+		{[]string{"x-webkit-deflate-frame", "Permessage-Deflate"}, true},
+		{[]string{"foo, permessage-deflate;client_max_window_bits"}, true},
+		{[]string{"permessage-deflate-ish"}, false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for _, v := range tt.values {
+			h.Add("Sec-WebSocket-Extensions", v)
+		}
+		if got := compressionNegotiated(h); got != tt.expected {
+			t.Errorf("compressionNegotiated(%q) = %v, expected %v", tt.values, got, tt.expected)
+		}
+	}
+}
+
+// jsonBackend serves a verbose JSON document of about size bytes
+func jsonBackend(size int) http.Handler {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := 0; sb.Len() < size; i++ {
+		fmt.Fprintf(&sb, `{"id":%d,"name":"device-%d","status":"online","temperature":21.5},`, i, i)
+	}
+	doc := strings.TrimSuffix(sb.String(), ",") + "]"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, doc)
+	})
+}
+
+func jsonSize(backend http.Handler) int {
+	rec := httptest.NewRecorder()
+	backend.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Body.Len()
+}
+
+// tunnelStats fetches the server's stats as a map
+func tunnelStats(t *testing.T, env *tunnelTestEnv) map[string]string {
+	t.Helper()
+	resp, err := http.Get(env.wstunURL + "/_stats")
+	if err != nil {
+		t.Fatalf("Stats request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	stats := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			stats[k] = v
+		}
+	}
+	return stats
+}
+
+func statsRatio(t *testing.T, stats map[string]string, key string) float64 {
+	t.Helper()
+	r, err := strconv.ParseFloat(stats[key], 64)
+	if err != nil {
+		t.Fatalf("Bad %s in stats %v: %v", key, stats, err)
+	}
+	return r
+}
+
+func fetchJSON(t *testing.T, env *tunnelTestEnv, expected int) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/devices")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil || len(body) != expected || !strings.HasSuffix(string(body), "}]") {
+			t.Fatalf("Expected the %d byte document, got %d bytes %v", expected, len(body), err)
+		}
+	}
+}
+
+func testCompression(t *testing.T, internal bool) {
+	backend := jsonBackend(200 * 1024)
+	env := setupTunnelServer(t, backend, "-compression")
+	startTunnelClient(t, env, backend, internal, "-compression")
+
+	fetchJSON(t, env, jsonSize(backend))
+
+	stats := tunnelStats(t, env)
+	if stats["compression"] != "true" || stats["tunnel00_compression"] != "true" {
+		t.Errorf("Expected compression to be reported on, got %v", stats)
+	}
+	if r := statsRatio(t, stats, "tunnel00_compression_ratio_in"); r < 3 {
+		t.Errorf("Expected responses to be compressed, got a ratio of %.2f", r)
+	}
+	if r := statsRatio(t, stats, "compression_ratio_in"); r < 3 {
+		t.Errorf("Expected the total to show compression, got a ratio of %.2f", r)
+	}
+	if _, out := env.wstuncli.traffic.ratios(); out < 3 {
+		t.Errorf("Expected the client to report compression, got a ratio of %.2f", out)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	testCompression(t, false)
+}
+
+func TestCompressionInternal(t *testing.T) {
+	testCompression(t, true)
+}
+
+// TestCompressionNeedsBothEnds checks that compression is only used when both ends ask for it
+func TestCompressionNeedsBothEnds(t *testing.T) {
+	backend := jsonBackend(200 * 1024)
+	for _, tc := range []struct {
+		name             string
+		srvArgs, cliArgs []string
+	}{
+		{"server only", []string{"-compression"}, nil},
+		{"client only", nil, []string{"-compression"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := setupTunnelServer(t, backend, tc.srvArgs...)
+			startTunnelClient(t, env, backend, false, tc.cliArgs...)
+			fetchJSON(t, env, jsonSize(backend))
+
+			stats := tunnelStats(t, env)
+			if stats["tunnel00_compression"] != "false" {
+				t.Errorf("Expected compression to be off, got %v", stats)
+			}
+			if r := statsRatio(t, stats, "tunnel00_compression_ratio_in"); r > 1.01 || r < 0.9 {
+				t.Errorf("Expected no compression, got a ratio of %.2f", r)
+			}
+		})
+	}
+}
+
+// TestCompressionThreshold checks that small messages are sent as is
+func TestCompressionThreshold(t *testing.T) {
+	backend := jsonBackend(200 * 1024)
+	env := setupTunnelServer(t, backend, "-compression")
+	startTunnelClient(t, env, backend, false, "-compression", "-compression-threshold", "1048576")
+	fetchJSON(t, env, jsonSize(backend))
+
+	if r := statsRatio(t, tunnelStats(t, env), "tunnel00_compression_ratio_in"); r > 1.01 {
+		t.Errorf("Expected messages below the threshold not to be compressed, got a ratio of %.2f", r)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,9 +17,10 @@ import (
 
 // ConnectionHandler handles the websocket connection lifecycle
 type ConnectionHandler struct {
-	client *WSTunnelClient
-	conn   *WSConnection
-	log    zerolog.Logger
+	client   *WSTunnelClient
+	conn     *WSConnection
+	log      zerolog.Logger
+	exitChan <-chan struct{} // closed to cancel reconnection attempts
 }
 
 // NewConnectionHandler creates a new ConnectionHandler
@@ -87,10 +89,18 @@ func (ch *ConnectionHandler) Connect() error {
 
 	// Add client version header
 	header.Set("X-Client-Version", VV)
+	// Advertise the highest protocol version we speak and the windows we grant
+	header.Set(protocolHeader, strconv.Itoa(protocolMax))
+	setWindowHeader(header, ch.client.StreamWindow, ch.client.ConnWindow)
+
+	// Compress if the server agrees to it, and count what goes over the wire
+	dialer.EnableCompression = ch.client.Compression
+	traffic := &tunnelTraffic{total: &ch.client.traffic}
+	dialer.NetDial = traffic.dialer(dialer.NetDial)
 
 	// Connect to the websocket server
 	tunnelURL := fmt.Sprintf("%s://%s/_tunnel", ch.client.Tunnel.Scheme, ch.client.Tunnel.Host)
-	ws, _, err := dialer.Dial(tunnelURL, header)
+	ws, resp, err := dialer.Dial(tunnelURL, header)
 	if err != nil {
 		ch.client.connManager.RecordError(err)
 		return fmt.Errorf("failed to connect to websocket server: %v", err)
@@ -98,10 +108,14 @@ func (ch *ConnectionHandler) Connect() error {
 
 	// Create new connection
 	ch.conn = &WSConnection{
-		Log: ch.log.With().Str("ws", fmt.Sprintf("%p", ws)).Logger(),
-		ws:  ws,
-		tun: ch.client,
+		Log:     ch.log.With().Str("ws", fmt.Sprintf("%p", ws)).Logger(),
+		ws:      ws,
+		tun:     ch.client,
+		version: negotiateProtocol(resp.Header),
+		queue:   newWriteQueue(),
+		traffic: traffic,
 	}
+	ch.conn.setupFlowControl(resp.Header)
 
 	ch.client.conn = ch.conn
 	ch.client.connManager.RecordSuccess()
@@ -155,7 +169,7 @@ func (ch *ConnectionHandler) Reconnect() error {
 		select {
 		case <-time.After(delay):
 			continue
-		case <-ch.client.exitChan:
+		case <-ch.exitChan:
 			return fmt.Errorf("connection attempt cancelled")
 		}
 	}
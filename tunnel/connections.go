@@ -0,0 +1,111 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Per-connection registry.
+//
+// A tunnel can be served by several websockets, the pool of one client or the websockets of
+// several clients sharing the token. Each websocket is registered under its tunnel with the
+// address and version of its client, when it connected, how many requests it was given, the
+// bytes it carried and its round-trip time. The server measures the round-trip time by pinging
+// the client back each time the client pings it. /admin/auditing lists the websockets of each
+// tunnel and DELETE /admin/connections/<id> closes one of them; its client reopens it like any
+// websocket that dies.
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// probeRTT pings the client with the time the ping was sent, the pong carries it back
+func (rc *remoteConn) probeRTT() {
+	msg := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	_ = rc.ws.WriteControl(websocket.PingMessage, msg, time.Now().Add(time.Second))
+}
+
+// pong records the round-trip time of a probe
+func (rc *remoteConn) pong(message string) error {
+	sent, err := strconv.ParseInt(message, 10, 64)
+	if err != nil {
+		return nil // not one of our probes
+	}
+	rc.rtt.Store(time.Now().UnixNano() - sent)
+	return nil
+}
+
+// detail describes the websocket for the admin views
+func (rc *remoteConn) detail() *WebsocketDetail {
+	return &WebsocketDetail{
+		ID:            rc.id,
+		RemoteAddr:    rc.addr,
+		ClientVersion: rc.clientVersion,
+		Protocol:      rc.version,
+		Pool:          rc.pool,
+		ConnectedAt:   rc.connectedAt,
+		Requests:      rc.served.Load(),
+		BytesIn:       rc.traffic.bytes[wireIn].Load(),
+		BytesOut:      rc.traffic.bytes[wireOut].Load(),
+		RTTMillis:     float64(rc.rtt.Load()) / float64(time.Millisecond),
+		Weight:        rc.weight,
+		Priority:      rc.priority,
+	}
+}
+
+// websockets describes the websockets of the tunnel, oldest first
+func (rs *remoteServer) websockets() []*WebsocketDetail {
+	rs.wsMutex.Lock()
+	details := make([]*WebsocketDetail, 0, len(rs.conns))
+	for rc := range rs.conns {
+		details = append(details, rc.detail())
+	}
+	rs.wsMutex.Unlock()
+	sort.Slice(details, func(i, j int) bool { return details[i].ConnectedAt.Before(details[j].ConnectedAt) })
+	return details
+}
+
+// findConn returns the websocket with the given id, nil if it isn't connected
+func (t *WSTunnelServer) findConn(id string) *remoteConn {
+	t.serverRegistryMutex.Lock()
+	defer t.serverRegistryMutex.Unlock()
+	for _, rs := range t.serverRegistry {
+		rs.wsMutex.Lock()
+		for rc := range rs.conns {
+			if rc.id == id {
+				rs.wsMutex.Unlock()
+				return rc
+			}
+		}
+		rs.wsMutex.Unlock()
+	}
+	return nil
+}
+
+// HandleConnections handles DELETE /admin/connections/<id> requests, which close a websocket
+func (as *AdminService) HandleConnections(w http.ResponseWriter, r *http.Request) {
+	safeW := &safeResponseWriter{ResponseWriter: w}
+
+	if r.Method != "DELETE" {
+		safeError(safeW, "Only DELETE requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, buildPath(as.server.BasePath, "/admin/connections/"))
+	rc := as.server.findConn(id)
+	if id == "" || rc == nil {
+		safeError(safeW, "Connection not found", http.StatusNotFound)
+		return
+	}
+
+	as.log.Info().Str("id", id).Str("ws", wsp(rc.ws)).Str("addr", rc.addr).Msg("WS   closing on admin request")
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "closed by administrator")
+	_ = rc.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if err := rc.ws.Close(); err != nil {
+		as.log.Error().Err(err).Msg("Failed to close websocket")
+	}
+	safeW.WriteHeader(http.StatusNoContent)
+}
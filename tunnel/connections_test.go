@@ -0,0 +1,110 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tunnelWebsockets returns the websockets the auditing data lists for the test token
+func tunnelWebsockets(t *testing.T, env *tunnelTestEnv) []*WebsocketDetail {
+	t.Helper()
+	data, err := env.wstunsrv.getAdminService().GetAuditingData(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get auditing data: %v", err)
+	}
+	tun := data.Tunnels[env.token]
+	if tun == nil {
+		t.Fatal("Tunnel missing from the auditing data")
+	}
+	return tun.Websockets
+}
+
+func TestConnectionRegistry(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	env := setupTunnelServer(t, backend)
+	startTunnelClient(t, env, backend, false, "-websockets", "2", "-spare-websockets", "0")
+	waitPool(t, env.wstuncli, 2)
+	for i := 0; i < 4; i++ {
+		getOK(t, env)
+	}
+
+	conns := tunnelWebsockets(t, env)
+	if len(conns) != 2 {
+		t.Fatalf("Expected 2 websockets, got %d", len(conns))
+	}
+	var requests int64
+	for _, c := range conns {
+		if c.ID == "" || c.RemoteAddr == "" || c.ConnectedAt.IsZero() {
+			t.Errorf("Incomplete websocket record: %+v", c)
+		}
+		if c.Pool != env.wstuncli.pool.id || c.Protocol != protocolV2 {
+			t.Errorf("Unexpected pool or protocol: %+v", c)
+		}
+		if c.BytesIn == 0 || c.BytesOut == 0 {
+			t.Errorf("Expected traffic on each websocket: %+v", c)
+		}
+		if c.RTTMillis <= 0 {
+			t.Errorf("Expected a round-trip time: %+v", c)
+		}
+		requests += c.Requests
+	}
+	if conns[0].ID == conns[1].ID {
+		t.Errorf("Websockets share the id %s", conns[0].ID)
+	}
+	if requests != 4 {
+		t.Errorf("Expected the websockets to have served 4 requests, got %d", requests)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	startTunnelClient(t, env, http.NotFoundHandler(), false, "-spare-websockets", "0")
+	as := env.wstunsrv.getAdminService()
+	conns := tunnelWebsockets(t, env)
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 websocket, got %d", len(conns))
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/admin/connections/" + conns[0].ID, http.StatusMethodNotAllowed},
+		{"DELETE", "/admin/connections/", http.StatusNotFound},
+		{"DELETE", "/admin/connections/nope", http.StatusNotFound},
+		{"DELETE", "/admin/connections/" + conns[0].ID, http.StatusNoContent},
+	} {
+		rec := httptest.NewRecorder()
+		as.HandleConnections(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.code, rec.Code)
+		}
+	}
+
+	// the client reconnects, but not with the same websocket
+	closed := conns[0].ID
+	deadline := time.Now().Add(5 * time.Second)
+	for registered(tunnelWebsockets(t, env), closed) {
+		if time.Now().After(deadline) {
+			t.Fatal("Closed websocket still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// registered returns whether a websocket is in a list
+func registered(conns []*WebsocketDetail, id string) bool {
+	for _, c := range conns {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
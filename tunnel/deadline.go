@@ -0,0 +1,137 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Request deadlines.
+//
+// The server gives up on a request once -httptimeout has passed, a caller can ask for less with
+// an X-Request-Timeout header (in seconds, or a duration like "1500ms"), more is capped at
+// -httptimeout. Every request it sends through the tunnel carries the time left in an
+// X-Tunnel-Timeout header, in milliseconds, and the client puts that deadline on the context
+// of the call to the local server or of the internal handler, so neither keeps working on a
+// request nobody waits for anymore. Streaming responses (server-sent events, chunked bodies)
+// are held to the -stream-idle-timeout rather than the deadline once their head arrived, the
+// header then says "; streaming=idle" and the client lifts the deadline when such a response
+// starts. Websockets are never subject to the deadline and don't get the header.
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// requestTimeoutHeader lets a caller ask for a shorter timeout than -httptimeout
+	requestTimeoutHeader = "X-Request-Timeout"
+	// tunnelTimeoutHeader tells the client how long the server waits for a response
+	tunnelTimeoutHeader = "X-Tunnel-Timeout"
+	// idleStreamsParam says that streaming responses are held to an idle timeout instead
+	idleStreamsParam = "streaming=idle"
+)
+
+//===== Server =====
+
+// requestTimeout returns how long to wait for the response to a request, the caller's
+// X-Request-Timeout if it's valid and below max, max otherwise
+func requestTimeout(r *http.Request, max time.Duration) time.Duration {
+	v := strings.TrimSpace(r.Header.Get(requestTimeoutHeader))
+	if v == "" {
+		return max
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return max
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 || d > max {
+		return max
+	}
+	return d
+}
+
+// tunnelHeader returns the headers to send a request through the tunnel with: those of the
+// caller with the time left to respond
+func (req *remoteRequest) tunnelHeader() http.Header {
+	h := req.httpReq.Header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Del(tunnelTimeoutHeader)
+	if req.upgrade {
+		return h
+	}
+	v := strconv.FormatInt(max(time.Until(req.deadline).Milliseconds(), 1), 10)
+	if req.idleStreams {
+		v += "; " + idleStreamsParam
+	}
+	h.Set(tunnelTimeoutHeader, v)
+	return h
+}
+
+//===== Client =====
+
+// deadlineContext is the context of a request the server gave a deadline. The deadline can be
+// lifted, as long as it isn't the context is cancelled when it passes.
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+	timer    *time.Timer
+	lifted   atomic.Bool
+	idle     bool // the deadline is lifted for streaming responses
+}
+
+func (c *deadlineContext) Deadline() (time.Time, bool) {
+	if c.lifted.Load() {
+		return c.Context.Deadline()
+	}
+	return c.deadline, true
+}
+
+func (c *deadlineContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && context.Cause(c.Context) == context.DeadlineExceeded {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// withTunnelTimeout puts the deadline from a request's X-Tunnel-Timeout header on ctx and
+// removes the header. The deadline is dropped once ctx is done, which must happen when the
+// request is over.
+func withTunnelTimeout(ctx context.Context, h http.Header) context.Context {
+	v := h.Get(tunnelTimeoutHeader)
+	h.Del(tunnelTimeoutHeader)
+	ms, params, _ := strings.Cut(v, ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(ms), 10, 64)
+	if err != nil || n <= 0 {
+		return ctx
+	}
+	d := time.Duration(n) * time.Millisecond
+	inner, cancel := context.WithCancelCause(ctx)
+	c := &deadlineContext{
+		Context:  inner,
+		deadline: time.Now().Add(d),
+		timer:    time.AfterFunc(d, func() { cancel(context.DeadlineExceeded) }),
+		idle:     strings.TrimSpace(params) == idleStreamsParam,
+	}
+	context.AfterFunc(inner, func() { c.timer.Stop() })
+	return c
+}
+
+// liftDeadline lifts the deadline of a request whose streaming response is starting if the
+// server doesn't hold it to the deadline
+func liftDeadline(ctx context.Context, resp *http.Response) {
+	c, ok := ctx.(*deadlineContext)
+	if !ok || !c.idle || !isStreamingResponse(resp) {
+		return
+	}
+	if c.timer.Stop() {
+		c.lifted.Store(true)
+	}
+}
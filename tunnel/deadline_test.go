@@ -0,0 +1,192 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	for v, expected := range map[string]time.Duration{
+		"":       time.Minute,
+		"5":      5 * time.Second,
+		"0.5":    500 * time.Millisecond,
+		"1500ms": 1500 * time.Millisecond,
+		"2m":     time.Minute, // capped
+		"0":      time.Minute,
+		"-3":     time.Minute,
+		"soon":   time.Minute,
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/x", nil)
+		r.Header.Set(requestTimeoutHeader, v)
+		if d := requestTimeout(r, time.Minute); d != expected {
+			t.Errorf("%q: expected %s, got %s", v, expected, d)
+		}
+	}
+}
+
+func TestTunnelTimeoutHeader(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/x", nil)
+	r.Header.Set(tunnelTimeoutHeader, "999999") // callers can't set it
+	req := makeRequest(r, 10*time.Second)
+	req.idleStreams = true
+
+	h := req.tunnelHeader()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, ok := withTunnelTimeout(ctx, h).(*deadlineContext)
+	if !ok {
+		t.Fatalf("No deadline from %q", req.tunnelHeader().Get(tunnelTimeoutHeader))
+	}
+	if left := time.Until(c.deadline); left <= 9*time.Second || left > 10*time.Second {
+		t.Errorf("Expected about 10s left, got %s", left)
+	}
+	if !c.idle || h.Get(tunnelTimeoutHeader) != "" {
+		t.Errorf("Header not parsed or not removed: %+v %v", c, h)
+	}
+	if r.Header.Get(tunnelTimeoutHeader) != "999999" {
+		t.Error("The caller's headers were modified")
+	}
+
+	stream := &http.Response{Header: http.Header{"Content-Type": {"text/event-stream"}}}
+	liftDeadline(c, stream)
+	if _, ok := c.Deadline(); ok {
+		t.Error("Deadline not lifted for a streaming response")
+	}
+
+	req.upgrade = true
+	if v := req.tunnelHeader().Get(tunnelTimeoutHeader); v != "" {
+		t.Errorf("Websocket request got a timeout: %q", v)
+	}
+}
+
+// deadlineBackend reports the deadline of the requests it gets and whether they were cut off,
+// it waits for that unless the request asks for a quick response. Only internal handlers see
+// the deadline, a local server sees its connection go away.
+func deadlineBackend(deadlines chan<- time.Time, cutOff chan<- bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := r.Context().Deadline()
+		deadlines <- d
+		if r.Header.Get(tunnelTimeoutHeader) != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/quick" {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			cutOff <- true
+			http.Error(w, "gave up", http.StatusServiceUnavailable)
+		case <-time.After(10 * time.Second):
+			cutOff <- false
+		}
+	})
+}
+
+func testDeadline(t *testing.T, internal bool) {
+	deadlines := make(chan time.Time, 1)
+	cutOff := make(chan bool, 1)
+	env := setupTunnelTest(t, deadlineBackend(deadlines, cutOff), internal, "-httptimeout", "3")
+	url := env.wstunURL + "/_token/" + env.token
+
+	// the deadline follows the request, shortened by the caller but not extended
+	for timeout, expected := range map[string]time.Duration{"": 3 * time.Second, "1.5": 1500 * time.Millisecond, "60": 3 * time.Second} {
+		req, _ := http.NewRequest(http.MethodGet, url+"/quick", nil)
+		req.Header.Set(requestTimeoutHeader, timeout)
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%q: expected 200, got %d", timeout, resp.StatusCode)
+		}
+		deadline := <-deadlines
+		if !internal {
+			continue
+		}
+		if d := deadline.Sub(start); d > expected+100*time.Millisecond || d < expected-time.Second {
+			t.Errorf("%q: expected a deadline in %s, got %s", timeout, expected, d)
+		}
+	}
+
+	// the local server is told to stop once the server gave up
+	req, _ := http.NewRequest(http.MethodGet, url+"/slow", nil)
+	req.Header.Set(requestTimeoutHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	// an internal handler may get its response in before the server gives up
+	if resp.StatusCode != http.StatusGatewayTimeout && resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 504, got %d", resp.StatusCode)
+	}
+	<-deadlines
+	select {
+	case <-cutOff:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The local server kept working past the deadline")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	testDeadline(t, false)
+}
+
+func TestDeadlineInternal(t *testing.T) {
+	testDeadline(t, true)
+}
+
+// TestDeadlineV1 checks that version 1 clients get the deadline too
+func TestDeadlineV1(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-httptimeout", "3")
+
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	ws, _, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	timeout := make(chan string, 1)
+	go func() {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		_, _ = io.CopyN(io.Discard, r, 4) // request id
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err != nil {
+			return
+		}
+		timeout <- req.Header.Get(tunnelTimeoutHeader)
+	}()
+
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, env.wstunURL+"/_token/"+env.token+"/v1", nil)
+		req.Header.Set(requestTimeoutHeader, "2")
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	select {
+	case v := <-timeout:
+		c, ok := withTunnelTimeout(context.Background(), http.Header{tunnelTimeoutHeader: {v}}).(*deadlineContext)
+		if !ok || time.Until(c.deadline) > 2*time.Second || time.Until(c.deadline) < time.Second {
+			t.Errorf("Unexpected timeout %q", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request didn't come in")
+	}
+}
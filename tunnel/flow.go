@@ -0,0 +1,263 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Flow control.
+//
+// Version 2 peers limit how much the other end may send them the way HTTP/2 does, per stream
+// and per websocket. Each end announces the windows it grants in the X-Tunnel-Window
+// handshake header as "<stream> <connection>" byte counts. A sender may only have that many
+// bytes of headers and data frames outstanding on a stream and over the whole websocket; the
+// receiver hands credit back with "window <n>" control frames, on the stream's id or on id 0
+// for the websocket, as the data it buffered is consumed or dropped. The memory a tunnel
+// websocket can tie up on the receiving end is thus bounded by its connection window. A peer
+// that doesn't announce windows isn't limited.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// windowHeader is used on the websocket handshake to announce flow control windows
+	windowHeader = "X-Tunnel-Window"
+	// controlWindow hands credit back to the sender: "window <bytes>"
+	controlWindow = "window"
+
+	defaultStreamWindow = 256 * 1024       // bytes in flight per stream
+	defaultConnWindow   = 16 * 1024 * 1024 // bytes in flight per websocket
+	minStreamWindow     = 2 * streamChunkSize
+)
+
+// errStreamAborted is returned to a sender waiting for credit on a stream that went away
+var errStreamAborted = errors.New("stream aborted while waiting for flow control credit")
+
+// validateWindows adjusts configured windows so they can work, a stream window of 0 turns
+// flow control off
+func validateWindows(stream, conn int) (int, int) {
+	if stream <= 0 {
+		return 0, 0
+	}
+	if stream < minStreamWindow {
+		stream = minStreamWindow
+	}
+	if conn < stream {
+		conn = stream
+	}
+	return stream, conn
+}
+
+// setWindowHeader announces the windows granted to the peer, if any
+func setWindowHeader(h http.Header, stream, conn int) {
+	if stream > 0 {
+		h.Set(windowHeader, fmt.Sprintf("%d %d", stream, conn))
+	}
+}
+
+// parseWindowHeader returns the windows the peer granted, 0s if it doesn't do flow control
+func parseWindowHeader(h http.Header) (stream, conn int) {
+	fields := strings.Fields(h.Get(windowHeader))
+	if len(fields) != 2 {
+		return 0, 0
+	}
+	stream, err1 := strconv.Atoi(fields[0])
+	conn, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || stream <= 0 || conn <= 0 {
+		return 0, 0
+	}
+	return stream, conn
+}
+
+// sendWindows tracks the credit the peer granted us for sending
+type sendWindows struct {
+	mu      sync.Mutex
+	stream  int              // initial window of a stream, 0 when we're not limited
+	conn    int64            // credit left on the websocket
+	credit  map[uint32]int64 // credit left on streams in progress
+	changed chan struct{}    // closed and replaced whenever credit is granted
+	closed  bool
+}
+
+func newSendWindows(stream, conn int) *sendWindows {
+	return &sendWindows{
+		stream:  stream,
+		conn:    int64(conn),
+		credit:  make(map[uint32]int64),
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire waits until n bytes may be sent on stream id and takes them from its windows. It
+// gives up when abort is closed or the websocket is gone.
+func (sw *sendWindows) acquire(id uint32, n int, abort <-chan struct{}) error {
+	if sw == nil || sw.stream == 0 || n == 0 {
+		return nil
+	}
+	for {
+		sw.mu.Lock()
+		if sw.closed {
+			sw.mu.Unlock()
+			return errWriteQueueClosed
+		}
+		c, ok := sw.credit[id]
+		if !ok {
+			c = int64(sw.stream)
+		}
+		if c >= int64(n) && sw.conn >= int64(n) {
+			sw.credit[id] = c - int64(n)
+			sw.conn -= int64(n)
+			sw.mu.Unlock()
+			return nil
+		}
+		sw.credit[id] = c
+		changed := sw.changed
+		sw.mu.Unlock()
+		select {
+		case <-changed:
+		case <-abort:
+			return errStreamAborted
+		}
+	}
+}
+
+// grant adds credit to a stream, or to the websocket for id 0. Credit for streams we're not
+// sending on is ignored.
+func (sw *sendWindows) grant(id uint32, n int) {
+	if sw == nil || sw.stream == 0 || n <= 0 {
+		return
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if id == 0 {
+		sw.conn += int64(n)
+	} else if c, ok := sw.credit[id]; ok {
+		sw.credit[id] = c + int64(n)
+	} else {
+		return
+	}
+	close(sw.changed)
+	sw.changed = make(chan struct{})
+}
+
+// done forgets about a stream we're done sending on
+func (sw *sendWindows) done(id uint32) {
+	if sw == nil || sw.stream == 0 {
+		return
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	delete(sw.credit, id)
+}
+
+// close wakes up everyone waiting for credit, the websocket is gone
+func (sw *sendWindows) close() {
+	if sw == nil {
+		return
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if !sw.closed {
+		sw.closed = true
+		close(sw.changed)
+	}
+}
+
+// sendStream wraps a frame sender so that headers and data frames wait for credit and the
+// stream is forgotten once it ends
+func (sw *sendWindows) sendStream(id uint32, abort <-chan struct{},
+	send func(typ byte, payload []byte) error) func(typ byte, payload []byte) error {
+	return func(typ byte, payload []byte) error {
+		switch typ {
+		case frameHeaders, frameData:
+			if err := sw.acquire(id, len(payload), abort); err != nil {
+				return err
+			}
+		case frameEnd, frameError:
+			defer sw.done(id)
+		}
+		return send(typ, payload)
+	}
+}
+
+// recvWindows hands credit back to the peer as the data it sent us is consumed
+type recvWindows struct {
+	stream  int                          // window granted per stream, 0 without flow control
+	conn    int                          // window granted for the websocket
+	send    func(id uint32, n int) error // sends a window update
+	mu      sync.Mutex
+	pending map[uint32]int // consumed bytes not yet handed back per stream, 0 is the websocket
+}
+
+func newRecvWindows(stream, conn int, send func(id uint32, n int) error) *recvWindows {
+	return &recvWindows{stream: stream, conn: conn, send: send, pending: make(map[uint32]int)}
+}
+
+// enabled returns whether the peer is held to our windows
+func (rw *recvWindows) enabled() bool { return rw != nil && rw.stream > 0 }
+
+// bufferLimit returns how much a stream's pipe needs to hold: the stream window when the
+// peer is held to it, fallback otherwise
+func (rw *recvWindows) bufferLimit(fallback int) int {
+	if rw.enabled() {
+		return rw.stream
+	}
+	return fallback
+}
+
+// release accounts for n bytes of stream id that were consumed, or dropped if the stream is
+// no longer open, and sends window updates once enough of a window has been freed
+func (rw *recvWindows) release(id uint32, n int, open bool) {
+	if !rw.enabled() || n <= 0 {
+		return
+	}
+	var streamCredit, connCredit int
+	rw.mu.Lock()
+	rw.pending[0] += n
+	if rw.pending[0] >= rw.conn/4 {
+		connCredit = rw.pending[0]
+		rw.pending[0] = 0
+	}
+	if open {
+		rw.pending[id] += n
+		if rw.pending[id] >= rw.stream/4 {
+			streamCredit = rw.pending[id]
+			delete(rw.pending, id)
+		}
+	}
+	rw.mu.Unlock()
+	if connCredit > 0 {
+		_ = rw.send(0, connCredit)
+	}
+	if streamCredit > 0 {
+		_ = rw.send(id, streamCredit)
+	}
+}
+
+// forget drops the bookkeeping of a stream that ended
+func (rw *recvWindows) forget(id uint32) {
+	if !rw.enabled() {
+		return
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	delete(rw.pending, id)
+}
+
+// newPipe creates the pipe buffering stream id for its consumer, handing credit back as
+// the consumer reads it
+func (rw *recvWindows) newPipe(id uint32, fallback int) (*streamReader, *streamWriter) {
+	pr, pw := newStreamPipe(rw.bufferLimit(fallback))
+	if rw.enabled() {
+		pr.p.release = func(n int, consumed bool) {
+			rw.release(id, n, consumed)
+			if !consumed {
+				rw.forget(id)
+			}
+		}
+	}
+	return pr, pw
+}
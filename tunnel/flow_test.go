@@ -0,0 +1,198 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValidateWindows(t *testing.T) {
+	tests := []struct {
+		stream, conn         int
+		wantStream, wantConn int
+	}{
+		{0, 1000, 0, 0},
+		{-1, 0, 0, 0},
+		{1, 1, minStreamWindow, minStreamWindow},
+		{1 << 20, 1 << 19, 1 << 20, 1 << 20},
+		{1 << 18, 1 << 24, 1 << 18, 1 << 24},
+	}
+	for _, tt := range tests {
+		s, c := validateWindows(tt.stream, tt.conn)
+		if s != tt.wantStream || c != tt.wantConn {
+			t.Errorf("validateWindows(%d, %d) = %d, %d, expected %d, %d",
+				tt.stream, tt.conn, s, c, tt.wantStream, tt.wantConn)
+		}
+	}
+}
+
+func TestWindowHeader(t *testing.T) {
+	h := http.Header{}
+	setWindowHeader(h, 0, 0)
+	if s, c := parseWindowHeader(h); s != 0 || c != 0 {
+		t.Errorf("Expected no windows, got %d %d", s, c)
+	}
+	setWindowHeader(h, 65536, 1048576)
+	if s, c := parseWindowHeader(h); s != 65536 || c != 1048576 {
+		t.Errorf("Expected 65536 1048576, got %d %d", s, c)
+	}
+	for _, bad := range []string{"65536", "a b", "-1 100", "1 2 3"} {
+		h.Set(windowHeader, bad)
+		if s, c := parseWindowHeader(h); s != 0 || c != 0 {
+			t.Errorf("Expected %q to be ignored, got %d %d", bad, s, c)
+		}
+	}
+}
+
+func TestSendWindows(t *testing.T) {
+	sw := newSendWindows(100, 150)
+	if err := sw.acquire(1, 100, nil); err != nil {
+		t.Fatalf("Acquiring the whole stream window failed: %v", err)
+	}
+	// stream 2 is limited by what's left on the connection
+	acquired := make(chan error, 1)
+	go func() { acquired <- sw.acquire(2, 60, nil) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquired beyond the connection window: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	sw.grant(0, 10)
+	if err := <-acquired; err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// stream 1 waits for its own window even though the connection has room again
+	sw.grant(0, 1000)
+	abort := make(chan struct{})
+	go func() { acquired <- sw.acquire(1, 10, abort) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquired beyond the stream window: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	sw.grant(1, 10)
+	if err := <-acquired; err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// waiting senders give up when their stream or the connection goes away
+	go func() { acquired <- sw.acquire(1, 10, abort) }()
+	close(abort)
+	if err := <-acquired; err != errStreamAborted {
+		t.Errorf("Expected errStreamAborted, got %v", err)
+	}
+	go func() { acquired <- sw.acquire(1, 10, nil) }()
+	time.Sleep(10 * time.Millisecond)
+	sw.close()
+	if err := <-acquired; err == nil {
+		t.Error("Expected acquire to fail once closed")
+	}
+
+	// credit for unknown streams is ignored
+	sw = newSendWindows(100, 1000)
+	sw.grant(9, 50)
+	if _, ok := sw.credit[9]; ok {
+		t.Error("Expected credit for an unknown stream to be ignored")
+	}
+}
+
+func TestRecvWindows(t *testing.T) {
+	type update struct {
+		id uint32
+		n  int
+	}
+	var updates []update
+	rw := newRecvWindows(400, 1000, func(id uint32, n int) error {
+		updates = append(updates, update{id, n})
+		return nil
+	})
+	rw.release(1, 50, true)
+	if len(updates) != 0 {
+		t.Fatalf("Expected small reads to be batched, got %v", updates)
+	}
+	rw.release(1, 60, true)   // a quarter of the stream window
+	rw.release(2, 200, false) // a quarter of the connection window
+	rw.release(3, 40, false)
+	expected := []update{{1, 110}, {0, 310}}
+	if len(updates) != len(expected) {
+		t.Fatalf("Expected updates %v, got %v", expected, updates)
+	}
+	for i := range expected {
+		if updates[i] != expected[i] {
+			t.Errorf("Expected updates %v, got %v", expected, updates)
+		}
+	}
+
+	if newRecvWindows(0, 0, nil).enabled() || (*recvWindows)(nil).enabled() {
+		t.Error("Expected flow control to be off without windows")
+	}
+}
+
+// TestFlowControlSlowCaller checks that a response the caller is slow to take is held back
+// at the tunnel client instead of piling up at the server
+func TestFlowControlSlowCaller(t *testing.T) {
+	const size = 32 * 1024 * 1024
+	// the server can't buffer much, the client must wait for the caller
+	env := setupTunnelTest(t, bigBackend(size), false, "-max-response-buffer", "1048576",
+		"-stream-window", "65536", "-conn-window", "1048576")
+
+	slow, err := http.Get(env.wstunURL + "/_token/" + env.token + "/big")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = slow.Body.Close() }()
+	getFast(t, env)
+
+	time.Sleep(500 * time.Millisecond)
+	n, err := io.Copy(io.Discard, slow.Body)
+	if err != nil || n != size {
+		t.Errorf("Expected all %d bytes, got %d %v", size, n, err)
+	}
+	getFast(t, env)
+}
+
+// TestFlowControlSlowBackend checks that an upload the local server is slow to read is held
+// back at the tunnel server instead of overflowing the client's buffer
+func TestFlowControlSlowBackend(t *testing.T) {
+	const size = 2 * defaultStreamBuffer
+	env := setupTunnelTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fast" {
+			_, _ = io.WriteString(w, "fast")
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+		n, err := io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, strconv.FormatInt(n, 10))
+		if err != nil {
+			_, _ = io.WriteString(w, " "+err.Error())
+		}
+	}), false)
+
+	done := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(env.wstunURL+"/_token/"+env.token+"/upload", "application/octet-stream",
+			bytes.NewReader(bytes.Repeat([]byte("u"), size)))
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		done <- string(body)
+	}()
+	getFast(t, env)
+	select {
+	case got := <-done:
+		if got != strconv.Itoa(size) {
+			t.Errorf("Expected the backend to read %d bytes, got %q", size, got)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Upload did not complete")
+	}
+}
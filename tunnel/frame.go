@@ -0,0 +1,248 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Tunnel wire protocol.
+//
+// Version 1 messages are the request id (4 hex chars of an int16) followed by a complete HTTP
+// request or response, one websocket message per request and response.
+//
+// Version 2 multiplexes typed frames over the websocket. Every binary websocket message is
+// one frame: a one byte type, a one byte set of flags and a 32-bit big-endian stream id,
+// followed by the payload. A request or response is a headers frame carrying the request or
+// status line and the header block, data frames carrying the rest of the message as HTTP/1.1
+// would put it on the wire, and an end frame. Bodies thus flow through the tunnel as they are
+// produced instead of being held in memory, with frames of concurrent streams interleaved.
+// An error frame aborts a message in flight, a cancel frame tells the client the caller is
+// gone, ping frames are answered with the ack flag set, and control frames carry
+// "name[ value]" messages such as the continue that lets the server forward the body of an
+// "Expect: 100-continue" request once the local server asks for it.
+//
+// The client advertises the highest version it speaks in the X-Tunnel-Protocol handshake
+// header, next to X-Client-Version, and the server echoes the version it picked in the
+// upgrade response. Peers that don't know about the header keep speaking version 1.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// protocolHeader is used on the websocket handshake to negotiate the protocol version
+	protocolHeader = "X-Tunnel-Protocol"
+	protocolV1     = 1 // whole messages prefixed by a 16-bit id
+	protocolV2     = 2 // multiplexed typed frames
+	// protocolMax is the highest version spoken by this implementation
+	protocolMax = protocolV2
+)
+
+// Version 2 frame types
+const (
+	frameHeaders byte = 1 // start of a message: request or status line and headers
+	frameData    byte = 2 // subsequent piece of a message
+	frameEnd     byte = 3 // end of message, carries no payload
+	frameCancel  byte = 4 // server to client: the caller went away, stop working on the request
+	frameError   byte = 5 // the message can't be completed, payload is the reason
+	framePing    byte = 6 // liveness check, answered with flagAck set and the same payload
+	frameControl byte = 7 // "name[ value]" control message
+)
+
+// Version 2 frame flags
+const (
+	flagAck byte = 1 << 0 // ping answer
+)
+
+// Control messages
+const (
+	// client to server: the local server wants the body of an "Expect: 100-continue" request
+	controlContinue = "continue"
+)
+
+// frameHeaderLen is the size of the type, flags and stream id preceding a frame's payload
+const frameHeaderLen = 6
+
+// streamChunkSize is the maximum payload carried by a single frame
+const streamChunkSize = 32 * 1024
+
+// frameNames are used for logging
+var frameNames = map[byte]string{
+	frameHeaders: "headers",
+	frameData:    "data",
+	frameEnd:     "end",
+	frameCancel:  "cancel",
+	frameError:   "error",
+	framePing:    "ping",
+	frameControl: "control",
+}
+
+func frameName(typ byte) string {
+	if n, ok := frameNames[typ]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", typ)
+}
+
+// negotiateProtocol returns the protocol version to use given the peer's handshake header
+func negotiateProtocol(h http.Header) int {
+	v, err := strconv.Atoi(strings.TrimSpace(h.Get(protocolHeader)))
+	if err != nil || v < protocolV1 {
+		return protocolV1
+	}
+	if v > protocolMax {
+		return protocolMax
+	}
+	return v
+}
+
+// writeFrameTo writes a single frame, the caller takes care of message boundaries
+func writeFrameTo(w io.Writer, typ, flags byte, id uint32, payload []byte) error {
+	var hdr [frameHeaderLen]byte
+	hdr[0] = typ
+	hdr[1] = flags
+	binary.BigEndian.PutUint32(hdr[2:], id)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrameHeader reads the header of a frame, the payload is the rest of r
+func readFrameHeader(r io.Reader) (typ, flags byte, id uint32, err error) {
+	var hdr [frameHeaderLen]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errors.New("short frame header")
+		}
+		return
+	}
+	return hdr[0], hdr[1], binary.BigEndian.Uint32(hdr[2:]), nil
+}
+
+// parseControl splits a control message into its name and value
+func parseControl(payload []byte) (name, value string) {
+	name, value, _ = strings.Cut(string(payload), " ")
+	return name, value
+}
+
+// frameWriter turns a byte stream into a sequence of frames for a single stream id. Data is
+// accumulated until either streamChunkSize bytes are pending or Flush is called.
+type frameWriter struct {
+	send func(typ byte, payload []byte) error // ships one frame through the tunnel
+	buf  []byte                               // pending data
+	sent bool                                 // whether the headers frame has been sent
+	err  error                                // sticky send error
+}
+
+func newFrameWriter(send func(typ byte, payload []byte) error) *frameWriter {
+	return &frameWriter{send: send, buf: make([]byte, 0, streamChunkSize)}
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if fw.err != nil {
+			return n, fw.err
+		}
+		c := copy(fw.buf[len(fw.buf):cap(fw.buf)], p)
+		fw.buf = fw.buf[:len(fw.buf)+c]
+		n += c
+		p = p[c:]
+		if len(fw.buf) == cap(fw.buf) {
+			_ = fw.Flush()
+		}
+	}
+	return n, fw.err
+}
+
+// WriteByte makes frameWriter an io.ByteWriter, which keeps http.Request.Write from wrapping
+// it into a bufio.Writer that would hold back data
+func (fw *frameWriter) WriteByte(c byte) error {
+	_, err := fw.Write([]byte{c})
+	return err
+}
+
+// Flush sends any pending data as a frame. Messages are written head first and the body is
+// only read once the head is flushed, so the first frame normally carries exactly the head.
+func (fw *frameWriter) Flush() error {
+	if fw.err != nil || len(fw.buf) == 0 {
+		return fw.err
+	}
+	typ := frameData
+	if !fw.sent {
+		typ = frameHeaders
+	}
+	fw.err = fw.send(typ, fw.buf)
+	fw.sent = true
+	fw.buf = fw.buf[:0]
+	return fw.err
+}
+
+// Close flushes pending data and sends the end frame
+func (fw *frameWriter) Close() error {
+	if err := fw.Flush(); err != nil {
+		return err
+	}
+	if !fw.sent {
+		// never send an end frame for a message that was not started
+		fw.err = fw.send(frameHeaders, nil)
+		fw.sent = true
+		if fw.err != nil {
+			return fw.err
+		}
+	}
+	return fw.send(frameEnd, nil)
+}
+
+// Abort discards pending data and tells the other end the message can't be completed
+func (fw *frameWriter) Abort(reason error) error {
+	fw.buf = fw.buf[:0]
+	if fw.err != nil {
+		return fw.err
+	}
+	fw.err = fw.send(frameError, []byte(reason.Error()))
+	return fw.err
+}
+
+// copyFrames sends everything read from r as data frames, each piece is flushed as soon as
+// it is read. It returns nil once r is exhausted.
+func copyFrames(fw *frameWriter, r io.Reader) error {
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := fw.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if werr := fw.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flushingBody wraps a message body so that everything written to the frameWriter so far is
+// flushed before blocking on the next read. This pushes headers and each piece of body out
+// through the tunnel as soon as the producer hands them over.
+type flushingBody struct {
+	io.ReadCloser
+	fw *frameWriter
+}
+
+func (b *flushingBody) Read(p []byte) (int, error) {
+	if err := b.fw.Flush(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
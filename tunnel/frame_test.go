@@ -0,0 +1,350 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFrameWriter(t *testing.T) {
+	type frame struct {
+		typ     byte
+		payload string
+	}
+	var frames []frame
+	fw := newFrameWriter(func(typ byte, payload []byte) error {
+		frames = append(frames, frame{typ, string(payload)})
+		return nil
+	})
+
+	_, _ = fw.Write([]byte("head"))
+	_ = fw.Flush()
+	_ = fw.Flush() // nothing pending, must not send an empty frame
+	big := strings.Repeat("x", streamChunkSize+10)
+	_, _ = fw.Write([]byte(big))
+	_ = fw.Close()
+
+	expected := []frame{
+		{frameHeaders, "head"},
+		{frameData, big[:streamChunkSize]},
+		{frameData, big[streamChunkSize:]},
+		{frameEnd, ""},
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("Expected %d frames, got %d", len(expected), len(frames))
+	}
+	for i := range expected {
+		if frames[i] != expected[i] {
+			t.Errorf("Frame %d: expected %s len %d, got %s len %d", i, frameName(expected[i].typ),
+				len(expected[i].payload), frameName(frames[i].typ), len(frames[i].payload))
+		}
+	}
+}
+
+func TestFrameWriterAbort(t *testing.T) {
+	var types []byte
+	var reason string
+	fw := newFrameWriter(func(typ byte, payload []byte) error {
+		types = append(types, typ)
+		if typ == frameError {
+			reason = string(payload)
+		}
+		return nil
+	})
+	_, _ = fw.Write([]byte("head"))
+	_ = fw.Flush()
+	_, _ = fw.Write([]byte("pending data"))
+	_ = fw.Abort(errors.New("backend went away"))
+
+	if !bytes.Equal(types, []byte{frameHeaders, frameError}) {
+		t.Errorf("Expected headers and error frames, got %v", types)
+	}
+	if reason != "backend went away" {
+		t.Errorf("Expected the abort reason in the error frame, got %q", reason)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrameTo(&buf, framePing, flagAck, 0xdeadbeef, []byte("payload")); err != nil {
+		t.Fatalf("writeFrameTo failed: %v", err)
+	}
+	if buf.Len() != frameHeaderLen+len("payload") {
+		t.Errorf("Expected %d bytes, got %d", frameHeaderLen+len("payload"), buf.Len())
+	}
+	typ, flags, id, err := readFrameHeader(&buf)
+	if err != nil {
+		t.Fatalf("readFrameHeader failed: %v", err)
+	}
+	if typ != framePing || flags != flagAck || id != 0xdeadbeef {
+		t.Errorf("Got type %s flags %d id %x", frameName(typ), flags, id)
+	}
+	if rest := buf.String(); rest != "payload" {
+		t.Errorf("Expected payload to follow the header, got %q", rest)
+	}
+
+	if _, _, _, err := readFrameHeader(strings.NewReader("abc")); err == nil {
+		t.Error("Expected an error for a truncated frame header")
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected int
+	}{
+		{"", protocolV1},
+		{"1", protocolV1},
+		{"2", protocolV2},
+		{" 2 ", protocolV2},
+		{"99", protocolMax},
+		{"0", protocolV1},
+		{"two", protocolV1},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set(protocolHeader, tt.header)
+		}
+		if v := negotiateProtocol(h); v != tt.expected {
+			t.Errorf("negotiateProtocol(%q) = %d, expected %d", tt.header, v, tt.expected)
+		}
+	}
+}
+
+func TestParseControl(t *testing.T) {
+	name, value := parseControl([]byte("continue"))
+	if name != "continue" || value != "" {
+		t.Errorf("Got %q %q", name, value)
+	}
+	name, value = parseControl([]byte("window 65536"))
+	if name != "window" || value != "65536" {
+		t.Errorf("Got %q %q", name, value)
+	}
+}
+
+// TestV1ClientAgainstV2Server checks that clients that don't ask for a protocol version get
+// whole requests and have their single-message responses delivered
+func TestV1ClientAgainstV2Server(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	ws, resp, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	if v := resp.Header.Get(protocolHeader); v != "" {
+		t.Errorf("Server should not pick a protocol for a version 1 client, got %q", v)
+	}
+
+	reqBody := make(chan string, 1)
+	go func() {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		var id int16
+		if _, err := fmt.Fscanf(io.LimitReader(r, 4), "%04x", &id); err != nil {
+			return
+		}
+		// the whole request arrives in a single message
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err != nil {
+			return
+		}
+		b, _ := io.ReadAll(req.Body)
+		reqBody <- string(b)
+		w, err := ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(w, "%04x", id)
+		_, _ = io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nlegacy")
+		_ = w.Close()
+	}()
+
+	res, err := http.Post(env.wstunURL+"/_token/"+env.token+"/x", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "legacy" {
+		t.Errorf("Expected 200 legacy, got %d %q", res.StatusCode, string(body))
+	}
+	select {
+	case b := <-reqBody:
+		if b != "payload" {
+			t.Errorf("Expected request body %q, got %q", "payload", b)
+		}
+	default:
+		t.Error("Version 1 client did not receive a complete request")
+	}
+}
+
+// TestV2ClientAgainstV1Server checks that a client falls back to version 1 when the server
+// doesn't pick a protocol on the handshake
+func TestV2ClientAgainstV1Server(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer backend.Close()
+
+	// a server that predates protocol negotiation
+	replies := make(chan string, 1)
+	oldServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(protocolHeader) != strconv.Itoa(protocolMax) {
+			t.Errorf("Client did not advertise protocol %d", protocolMax)
+		}
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = ws.Close() }()
+		wr, _ := ws.NextWriter(websocket.BinaryMessage)
+		_, _ = fmt.Fprintf(wr, "%04x", 7)
+		_, _ = io.WriteString(wr, "POST /old HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nbody")
+		_ = wr.Close()
+		_, rd, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		msg, _ := io.ReadAll(rd)
+		replies <- string(msg)
+	}))
+	defer oldServer.Close()
+
+	wstuncli := NewWSTunnelClient([]string{
+		"-token", "test-token-1234567890",
+		"-tunnel", "ws" + strings.TrimPrefix(oldServer.URL, "http"),
+		"-server", backend.URL,
+	})
+	if err := wstuncli.Start(); err != nil {
+		t.Fatalf("Error starting client: %v", err)
+	}
+	defer wstuncli.Stop()
+
+	select {
+	case msg := <-replies:
+		if !strings.HasPrefix(msg, "0007HTTP/1.1 200 OK\r\n") {
+			t.Errorf("Expected a version 1 response for id 7, got %q", msg)
+		}
+		if !strings.HasSuffix(msg, "POST /old body") {
+			t.Errorf("Expected the backend's reply, got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No response from the client")
+	}
+}
+
+// dialV2 opens a raw version 2 tunnel connection
+func dialV2(t *testing.T, env *tunnelTestEnv) *websocket.Conn {
+	t.Helper()
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	h.Set(protocolHeader, "2")
+	ws, resp, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+	if v := resp.Header.Get(protocolHeader); v != "2" {
+		t.Fatalf("Expected the server to pick version 2, got %q", v)
+	}
+	return ws
+}
+
+func sendFrame(ws *websocket.Conn, typ, flags byte, id uint32, payload []byte) error {
+	w, err := ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if err := writeFrameTo(w, typ, flags, id, payload); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func recvFrame(ws *websocket.Conn) (typ, flags byte, id uint32, payload []byte, err error) {
+	_, r, err := ws.NextReader()
+	if err != nil {
+		return
+	}
+	if typ, flags, id, err = readFrameHeader(r); err != nil {
+		return
+	}
+	payload, err = io.ReadAll(r)
+	return
+}
+
+func TestV2Ping(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	ws := dialV2(t, env)
+
+	if err := sendFrame(ws, framePing, 0, 0, []byte("12345678")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, flags, id, payload, err := recvFrame(ws)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if typ != framePing || flags&flagAck == 0 || id != 0 || string(payload) != "12345678" {
+		t.Errorf("Expected ping ack echoing the payload, got %s flags %d id %d %q",
+			frameName(typ), flags, id, payload)
+	}
+}
+
+// TestV2ErrorFrame checks that a request aborted by the client with an error frame fails
+// instead of waiting for the timeout
+func TestV2ErrorFrame(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	ws := dialV2(t, env)
+
+	go func() {
+		var id uint32
+		for {
+			typ, _, fid, _, err := recvFrame(ws)
+			if err != nil {
+				return
+			}
+			if typ == frameHeaders {
+				id = fid
+			}
+			if typ == frameEnd && fid == id {
+				break
+			}
+		}
+		_ = sendFrame(ws, frameError, 0, id, []byte("no route to backend"))
+	}()
+
+	start := time.Now()
+	res, err := http.Get(env.wstunURL + "/_token/" + env.token + "/x")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusGatewayTimeout || !strings.Contains(string(body), "no route to backend") {
+		t.Errorf("Expected 504 with the client's reason, got %d %q", res.StatusCode, string(body))
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Error frame did not end the request early")
+	}
+}
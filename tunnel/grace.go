@@ -0,0 +1,96 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Reconnect grace window.
+//
+// A tunnel stays registered when its client goes away, so that requests queue up until it
+// reconnects. With -reconnect-grace the server bounds that wait: requests for a tunnel that
+// lost its last websocket less than the grace window ago are held until the client comes back,
+// which hides routine client restarts from callers, and fail with a 503 and a Retry-After header
+// if it doesn't reconnect before the window closes. Requests for a tunnel that has been gone for
+// longer fail right away. Tokens the server hasn't seen (or has reaped) still get a 404.
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// wsUp records that a websocket of the tunnel connected, it releases the requests waiting for
+// the client to reconnect
+func (rs *remoteServer) wsUp(rc *remoteConn) {
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	if rs.conns == nil {
+		rs.conns = make(map[*remoteConn]bool)
+	}
+	rs.conns[rc] = true
+	if rs.reconnected != nil {
+		close(rs.reconnected)
+		rs.reconnected = nil
+	}
+}
+
+// wsDown records that a websocket of the tunnel went away
+func (rs *remoteServer) wsDown(rc *remoteConn) {
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	delete(rs.conns, rc)
+	if len(rs.conns) == 0 {
+		rs.downSince = time.Now()
+		rs.reconnected = make(chan struct{})
+	}
+}
+
+// tunnelDown returns when the tunnel lost its last websocket and a channel closed once one
+// connects again, a nil channel if the tunnel has a websocket
+func (rs *remoteServer) tunnelDown() (time.Time, <-chan struct{}) {
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	if len(rs.conns) > 0 || rs.reconnected == nil {
+		return time.Time{}, nil
+	}
+	return rs.downSince, rs.reconnected
+}
+
+// awaitReconnect holds a request for a tunnel without a websocket until its client reconnects,
+// within the grace window and the request's deadline. It returns false if the request can't
+// be sent or the caller went away, which its context tells.
+func (t *WSTunnelServer) awaitReconnect(ctx context.Context, rs *remoteServer, req *remoteRequest) bool {
+	if t.ReconnectGrace <= 0 {
+		return true
+	}
+	since, reconnected := rs.tunnelDown()
+	if reconnected == nil {
+		return true
+	}
+	until := since.Add(t.ReconnectGrace)
+	if req.deadline.Before(until) {
+		until = req.deadline
+	}
+	wait := time.Until(until)
+	if wait <= 0 {
+		return false
+	}
+	req.log.Info().Dur("wait", wait).Msg("HTTP RCV waiting for the client to reconnect")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-reconnected:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// tunnelUnavailable tells the caller the tunnel's client isn't connected and when to try again
+func (t *WSTunnelServer) tunnelUnavailable(w http.ResponseWriter) {
+	secs := int(math.Ceil(t.ReconnectGrace.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	safeError(w, "Tunnel client not connected", http.StatusServiceUnavailable)
+}
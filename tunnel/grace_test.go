@@ -0,0 +1,121 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// stopClient stops the tunnel client and waits for the server to notice
+func stopClient(t *testing.T, env *tunnelTestEnv) *remoteServer {
+	t.Helper()
+	env.wstuncli.Stop()
+	rs := env.wstunsrv.getRemoteServer(token(env.token), false)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, reconnected := rs.tunnelDown(); reconnected != nil {
+			return rs
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The server didn't notice the client went away")
+		}
+	}
+}
+
+// getStatus issues a request through the tunnel in the background and returns a channel
+// with its status and Retry-After header
+func getStatus(env *tunnelTestEnv) <-chan [2]string {
+	done := make(chan [2]string, 1)
+	go func() {
+		resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/hello")
+		if err != nil {
+			done <- [2]string{err.Error()}
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		done <- [2]string{resp.Status, resp.Header.Get("Retry-After")}
+	}()
+	return done
+}
+
+func TestReconnectGrace(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	})
+	env := setupTunnelTest(t, backend, false, "-reconnect-grace", "5")
+	stopClient(t, env)
+
+	// the request waits for the client to come back
+	done := getStatus(env)
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case res := <-done:
+		t.Fatalf("Request didn't wait for the client: %v", res)
+	default:
+	}
+	startTunnelClient(t, env, backend, false)
+	select {
+	case res := <-done:
+		if res[0] != "200 OK" {
+			t.Errorf("Expected 200 once the client reconnected, got %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request not released when the client reconnected")
+	}
+}
+
+func TestReconnectGraceExpires(t *testing.T) {
+	env := setupTunnelTest(t, http.NotFoundHandler(), false, "-reconnect-grace", "1")
+	stopClient(t, env)
+
+	start := time.Now()
+	res := <-getStatus(env)
+	if res[0] != "503 Service Unavailable" || res[1] != "1" {
+		t.Errorf("Expected a 503 with Retry-After: 1, got %v", res)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected the request to wait for the grace window, it took %s", elapsed)
+	}
+
+	// once the window is over requests fail right away
+	start = time.Now()
+	if res := <-getStatus(env); res[0] != "503 Service Unavailable" {
+		t.Errorf("Expected a 503, got %v", res)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Request waited %s for a client gone past the grace window", elapsed)
+	}
+}
+
+// TestReconnectGraceCallerGone checks that a caller that goes away while its request waits
+// for the client gets nothing written back
+func TestReconnectGraceCallerGone(t *testing.T) {
+	env := setupTunnelTest(t, http.NotFoundHandler(), false, "-reconnect-grace", "5")
+	stopClient(t, env)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/_token/"+env.token+"/hello", nil).WithContext(ctx)
+	req := &remoteRequest{deadline: time.Now().Add(10 * time.Second), log: zerolog.Nop()}
+	w := httptest.NewRecorder()
+	if retry, _ := getResponse(env.wstunsrv, req, w, r, token(env.token), 1); retry {
+		t.Error("Expected no retry for a caller that went away")
+	}
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected nothing written, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReconnectGraceUnknownToken(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-reconnect-grace", "5")
+	if res := <-getStatus(env); res[0] != "404 Not Found" {
+		t.Errorf("Expected a 404 for a token never seen, got %v", res)
+	}
+}
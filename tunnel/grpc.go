@@ -0,0 +1,50 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// gRPC passthrough.
+//
+// gRPC runs over HTTP/2 and relies on two things plain HTTP/1.1 proxying loses: both bodies
+// stream at the same time, and the call's status comes back in trailers. With -h2c the server
+// also accepts HTTP/2 without TLS (prior knowledge) on its listener, which is what gRPC clients
+// use in clear text, or what a TLS terminating proxy in front of the server speaks. The call
+// travels through the tunnel like any other request: protocol v2 streams the request body while
+// the response comes back, and the trailers follow the response body. The client recognizes
+// gRPC calls by their content type and issues them to the local server over HTTP/2 whatever
+// -backend-protocol says, in clear text (h2c) for an http:// server and over TLS for an
+// https:// one (see backend.go). Full duplex calls need protocol v2, v1 clients get the whole
+// request before answering.
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// setH2C lets an HTTP server speak HTTP/2 without TLS next to HTTP/1.1, which tunnel
+// websockets need
+func setH2C(srv *http.Server) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Protocols = &protocols
+}
+
+// isGRPC returns whether a request is a gRPC call, gRPC-Web goes over HTTP/1.1 and isn't one
+func isGRPC(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mt == "application/grpc" || strings.HasPrefix(mt, "application/grpc+"))
+}
+
+// keepTE puts back the "TE: trailers" header gRPC servers expect once hop-by-hop headers are
+// gone, it's the only value of the header that may be sent over HTTP/2
+func keepTE(h http.Header, te []string) {
+	for _, v := range te {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "trailers") {
+				h.Set("Te", "trailers")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// writeGRPCMessage writes a length-prefixed gRPC message
+func writeGRPCMessage(w io.Writer, msg string) error {
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, msg)
+	return err
+}
+
+// readGRPCMessage reads a length-prefixed gRPC message
+func readGRPCMessage(r io.Reader) (string, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	_, err := io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+// grpcBackend stands in for a gRPC server: Unary answers a single message, Chat echoes each
+// message as soon as it comes in. Like gRPC servers it only takes HTTP/2 and sends the
+// status in trailers.
+func grpcBackend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !isGRPC(r) || r.Header.Get("Te") != "trailers" {
+			http.Error(w, "expected a gRPC call over HTTP/2", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		switch r.URL.Path {
+		case "/echo.Echo/Unary":
+			msg, err := readGRPCMessage(r.Body)
+			if err != nil {
+				w.Header().Set("Grpc-Status", "3")
+				return
+			}
+			_ = writeGRPCMessage(w, "hello "+msg)
+		case "/echo.Echo/Chat":
+			for {
+				msg, err := readGRPCMessage(r.Body)
+				if err != nil {
+					break
+				}
+				_ = writeGRPCMessage(w, "echo "+msg)
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	})
+}
+
+// setupGRPCTest starts a tunnel server accepting h2c and a client in front of the gRPC stand-in,
+// served with TLS (h2) if asked to and in clear text (h2c) otherwise
+func setupGRPCTest(t *testing.T, useTLS bool) *tunnelTestEnv {
+	backend := httptest.NewUnstartedServer(grpcBackend())
+	if useTLS {
+		backend.EnableHTTP2 = true
+		backend.StartTLS()
+	} else {
+		setH2C(backend.Config)
+		backend.Start()
+	}
+	t.Cleanup(backend.Close)
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-h2c")
+	env.server = backend
+	startTunnelClient(t, env, nil, false, "-insecure")
+	return env
+}
+
+// grpcCall starts a call through the tunnel over h2c, body carries the request messages
+func grpcCall(t *testing.T, env *tunnelTestEnv, method string, body io.Reader) *http.Response {
+	t.Helper()
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, env.wstunURL+method, body)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	req.Header.Set("X-Token", env.token)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("Expected an HTTP/2 200, got %s %s", resp.Proto, resp.Status)
+	}
+	return resp
+}
+
+// checkGRPCStatus reads the rest of a call's response and checks its trailers
+func checkGRPCStatus(t *testing.T, resp *http.Response) {
+	t.Helper()
+	if _, err := readGRPCMessage(resp.Body); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the end of the response, got %v", err)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+		t.Errorf("Expected a successful status in the trailers, got %v", resp.Trailer)
+	}
+}
+
+func testGRPCUnary(t *testing.T, useTLS bool) {
+	env := setupGRPCTest(t, useTLS)
+	pr, pw := io.Pipe()
+	go func() {
+		_ = writeGRPCMessage(pw, "world")
+		_ = pw.Close()
+	}()
+	resp := grpcCall(t, env, "/echo.Echo/Unary", pr)
+	if msg, err := readGRPCMessage(resp.Body); err != nil || msg != "hello world" {
+		t.Fatalf("Expected hello world, got %q %v", msg, err)
+	}
+	checkGRPCStatus(t, resp)
+}
+
+func TestGRPCUnaryH2C(t *testing.T) { testGRPCUnary(t, false) }
+
+func TestGRPCUnaryH2(t *testing.T) { testGRPCUnary(t, true) }
+
+// TestGRPCBidiStreaming checks that the responses to a streaming call come back while the
+// request is still being sent
+func TestGRPCBidiStreaming(t *testing.T) {
+	env := setupGRPCTest(t, false)
+	pr, pw := io.Pipe()
+	defer func() { _ = pw.Close() }()
+	go func() {
+		_ = writeGRPCMessage(pw, "one")
+	}()
+	resp := grpcCall(t, env, "/echo.Echo/Chat", pr)
+	for i, next := range []string{"two", "three", ""} {
+		msg, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			t.Fatalf("Message %d didn't come back: %v", i+1, err)
+		}
+		if expected := "echo " + []string{"one", "two", "three"}[i]; msg != expected {
+			t.Fatalf("Expected %q, got %q", expected, msg)
+		}
+		// the next message only goes out once the previous one was answered
+		if next == "" {
+			_ = pw.Close()
+		} else if err := writeGRPCMessage(pw, next); err != nil {
+			t.Fatalf("Cannot send %q: %v", next, err)
+		}
+	}
+	checkGRPCStatus(t, resp)
+}
+
+// TestGRPCNeedsH2C checks that HTTP/2 without TLS is only accepted when asked for
+func TestGRPCNeedsH2C(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 5 * time.Second}
+	if resp, err := client.Get(env.wstunURL + "/_health_check"); err == nil {
+		_ = resp.Body.Close()
+		t.Fatalf("HTTP/2 accepted without -h2c: %s", resp.Proto)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Host routing.
+//
+// Besides the /_token/<token>/ prefix and the X-Token header, the server can pick the tunnel
+// of a request from its Host header, so apps that use absolute paths or whose callers can't
+// set headers work through the tunnel. The routes come from the file given with -host-map,
+// one per line:
+//
+//	# name             token
+//	myapp              9b2c6e0f-secret-token
+//	shop.example.com   4f8d11aa-other-token
+//
+// A name without a dot is a public alias served as <alias>.<-tunnel-domain>, one with dots is a
+// custom domain that points at the server. Aliases and domains are what the public sees, the
+// tokens themselves stay secret. Every path of a routed host goes through the tunnel, the base
+// path being stripped as for any other request. The file is reloaded when it changes, a file
+// that doesn't parse leaves the routes in place.
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// hostMapReload is how often the host map file is checked for changes
+const hostMapReload = 5 * time.Second
+
+// hostMap routes hosts to tunnels
+type hostMap struct {
+	aliases map[string]token // subdomains of the tunnel domain
+	domains map[string]token // custom domains
+	modTime time.Time        // of the file the routes were read from
+	size    int64
+}
+
+// parseHostMap reads the routes of a host map file
+func parseHostMap(path string) (*hostMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hm := &hostMap{
+		aliases: make(map[string]token),
+		domains: make(map[string]token),
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) != 2:
+			return nil, fmt.Errorf("%s:%d: expected a name and a token", path, n)
+		case len(fields[1]) < minTokenLen:
+			return nil, fmt.Errorf("%s:%d: token too short", path, n)
+		}
+		name, tok := strings.ToLower(strings.TrimSuffix(fields[0], ".")), token(fields[1])
+		routes := hm.aliases
+		if strings.Contains(name, ".") {
+			routes = hm.domains
+		}
+		if _, dup := routes[name]; dup {
+			return nil, fmt.Errorf("%s:%d: %s routed twice", path, n, name)
+		}
+		routes[name] = tok
+	}
+	return hm, sc.Err()
+}
+
+// loadHostMap reads the host map file if it changed since it was last read
+func (t *WSTunnelServer) loadHostMap() error {
+	fi, err := os.Stat(t.HostMapFile)
+	if err != nil {
+		return err
+	}
+	if old := t.hostRoutes.Load(); old != nil && fi.ModTime().Equal(old.modTime) && fi.Size() == old.size {
+		return nil
+	}
+	hm, err := parseHostMap(t.HostMapFile)
+	if err != nil {
+		return err
+	}
+	t.hostRoutes.Store(hm)
+	t.Log.Info().Str("file", t.HostMapFile).Int("aliases", len(hm.aliases)).Int("domains", len(hm.domains)).Msg("Host routes loaded")
+	return nil
+}
+
+// watchHostMap reloads the host map file as it changes until stop is closed
+func (t *WSTunnelServer) watchHostMap(stop <-chan struct{}) {
+	ticker := time.NewTicker(hostMapReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.loadHostMap(); err != nil {
+				t.Log.Error().Err(err).Str("file", t.HostMapFile).Msg("Cannot reload host routes, keeping the current ones")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// hostToken returns the tunnel a request's host routes to, "" if it isn't routed
+func (t *WSTunnelServer) hostToken(r *http.Request) token {
+	hm := t.hostRoutes.Load()
+	if hm == nil {
+		return ""
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if tok, ok := hm.domains[host]; ok {
+		return tok
+	}
+	domain := strings.ToLower(strings.Trim(t.TunnelDomain, "."))
+	if domain == "" {
+		return ""
+	}
+	alias, ok := strings.CutSuffix(host, "."+domain)
+	if !ok || strings.Contains(alias, ".") {
+		return ""
+	}
+	return hm.aliases[alias]
+}
+
+// hostRouter sends the requests of routed hosts to routed and the others to next
+func (t *WSTunnelServer) hostRouter(routed, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.hostToken(r) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		routed.ServeHTTP(w, r)
+	})
+}
+
+// payloadHostHandler handles payload requests with the tunnel picked by their Host header.
+// Payload requests are requests that are to be forwarded through the tunnel.
+func payloadHostHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	// Wrap the response writer with our safe wrapper
+	safeW := &safeResponseWriter{ResponseWriter: w}
+
+	tok := t.hostToken(r)
+	if tok == "" {
+		// the host map was reloaded in the meantime
+		t.Log.Info().Str("host", r.Host).Msg("HTTP Host no longer routed")
+		safeError(safeW, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+	payloadHandler(t, safeW, r, tok)
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func writeHostMap(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Cannot write host map: %v", err)
+	}
+}
+
+func TestParseHostMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeHostMap(t, path, "# routes\n\nMyApp   token-1234567890123  # the app\nShop.Example.com. token-abcdefghijklmn\n")
+	hm, err := parseHostMap(path)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if hm.aliases["myapp"] != "token-1234567890123" || hm.domains["shop.example.com"] != "token-abcdefghijklmn" ||
+		len(hm.aliases) != 1 || len(hm.domains) != 1 {
+		t.Errorf("Unexpected routes: %+v", hm)
+	}
+
+	for name, content := range map[string]string{
+		"missing token": "myapp\n",
+		"short token":   "myapp short\n",
+		"duplicate":     "myapp token-1234567890123\nMYAPP token-abcdefghijklmn\n",
+	} {
+		writeHostMap(t, path, content)
+		if _, err := parseHostMap(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestHostToken(t *testing.T) {
+	srv := &WSTunnelServer{TunnelDomain: "Tunnels.Example.com."}
+	srv.hostRoutes.Store(&hostMap{
+		aliases: map[string]token{"myapp": "alias-token"},
+		domains: map[string]token{"shop.example.com": "domain-token"},
+	})
+	for host, expected := range map[string]token{
+		"myapp.tunnels.example.com":      "alias-token",
+		"MyApp.Tunnels.Example.com:8443": "alias-token",
+		"shop.example.com":               "domain-token",
+		"shop.example.com.:80":           "domain-token",
+		"other.tunnels.example.com":      "",
+		"a.myapp.tunnels.example.com":    "",
+		"tunnels.example.com":            "",
+		"myapp":                          "",
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if tok := srv.hostToken(r); tok != expected {
+			t.Errorf("%s: expected %q, got %q", host, expected, tok)
+		}
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	})
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeHostMap(t, path, "# no routes yet\n")
+	env := setupTunnelTest(t, backend, false, "-host-map", path, "-tunnel-domain", "tunnels.example.com")
+	writeHostMap(t, path, "myapp "+env.token+"\nshop.example.com "+env.token+"\n")
+	if err := env.wstunsrv.loadHostMap(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	get := func(host, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, env.wstunURL+path, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// every path of a routed host goes through the tunnel, even those of the server
+	for _, host := range []string{"myapp.tunnels.example.com", "shop.example.com"} {
+		for _, p := range []string{"/", "/static/app.js", "/admin/monitoring"} {
+			if code, body := get(host, p); code != http.StatusOK || body != p {
+				t.Errorf("%s%s: expected the app's %s, got %d %q", host, p, p, code, body)
+			}
+		}
+	}
+	if code, _ := get("unknown.tunnels.example.com", "/x"); code != http.StatusBadRequest {
+		t.Errorf("Unrouted host: expected 400 for a missing token, got %d", code)
+	}
+
+	// a reload picks up new routes, a broken file keeps the current ones
+	writeHostMap(t, path, "renamed "+env.token+"\n")
+	if err := env.wstunsrv.loadHostMap(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if code, _ := get("myapp.tunnels.example.com", "/x"); code != http.StatusBadRequest {
+		t.Errorf("Removed alias still routed: %d", code)
+	}
+	if code, body := get("renamed.tunnels.example.com", "/x"); code != http.StatusOK || body != "/x" {
+		t.Errorf("New alias not routed: %d %q", code, body)
+	}
+	writeHostMap(t, path, "renamed\n")
+	if err := env.wstunsrv.loadHostMap(); err == nil {
+		t.Error("Broken host map accepted")
+	}
+	if code, _ := get("renamed.tunnels.example.com", "/x"); code != http.StatusOK {
+		t.Errorf("Routes lost on a broken reload: %d", code)
+	}
+}
+
+// TestHostRoutingBasePath checks that routed hosts get the base path stripped like other requests
+func TestHostRoutingBasePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeHostMap(t, path, "# no routes yet\n")
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-host-map", path, "-base-path", "/wstunnel")
+	writeHostMap(t, path, "shop.example.com "+env.token+"\n")
+	if err := env.wstunsrv.loadHostMap(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	h.Set(protocolHeader, "2")
+	ws, _, err := websocket.DefaultDialer.Dial(env.wsURL+"/wstunnel/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	for _, p := range []string{"/wstunnel/app.js", "/app.js"} {
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, env.wstunURL+p, nil)
+			req.Host = "shop.example.com"
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+		_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		typ, _, id, head, err := recvFrame(ws)
+		for err == nil && typ != frameHeaders {
+			typ, _, id, head, err = recvFrame(ws)
+		}
+		if err != nil {
+			t.Fatalf("%s: no request came through: %v", p, err)
+		}
+		if !strings.HasPrefix(string(head), "GET /app.js ") {
+			t.Errorf("%s: expected the base path to be stripped, got %q", p, strings.SplitN(string(head), "\r\n", 2)[0])
+		}
+		_ = sendFrame(ws, frameHeaders, 0, id, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+		_ = sendFrame(ws, frameEnd, 0, id, nil)
+	}
+}
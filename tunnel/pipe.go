@@ -0,0 +1,192 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// errStreamOverflow fails a stream whose reader fell too far behind its writer
+var errStreamOverflow = errors.New("stream buffer overflow, reader too slow")
+
+// defaultStreamBuffer is the number of bytes a stream may hold for a slow reader
+const defaultStreamBuffer = 16 * 1024 * 1024
+
+// streamPipe is an in-memory pipe whose writes never wait for the reader: data piles up
+// until the reader gets to it. The websocket readers use it to hand messages over to
+// consumers without one slow consumer holding up every other stream on the websocket. A
+// stream that has more than limit bytes pending is failed instead, unless the pipe blocks: a
+// version 1 websocket carries one response at a time, so there the writer waits for the
+// reader to catch up, which holds up reading the websocket like before streams existed.
+type streamPipe struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	chunks [][]byte // pending data
+	size   int      // bytes in chunks
+	limit  int      // maximum size
+	block  bool     // whether writes wait for the reader rather than overflow
+	werr   error    // set once the writer is done, io.EOF for a normal end
+	rerr   error    // set once the reader is done
+	// release, if set, is told about data leaving the pipe: read by the reader, or dropped
+	// when the pipe is closed or overflows
+	release func(n int, consumed bool)
+}
+
+// streamReader is the read half of a streamPipe
+type streamReader struct{ p *streamPipe }
+
+// streamWriter is the write half of a streamPipe
+type streamWriter struct{ p *streamPipe }
+
+// newStreamPipe creates a pipe that buffers up to limit bytes, limit <= 0 uses the default
+func newStreamPipe(limit int) (*streamReader, *streamWriter) {
+	if limit <= 0 {
+		limit = defaultStreamBuffer
+	}
+	p := &streamPipe{limit: limit}
+	p.cond.L = &p.mu
+	return &streamReader{p}, &streamWriter{p}
+}
+
+// newBlockingPipe creates a pipe whose writes wait while limit bytes are pending, limit <= 0
+// uses the default
+func newBlockingPipe(limit int) (*streamReader, *streamWriter) {
+	pr, pw := newStreamPipe(limit)
+	pr.p.block = true
+	return pr, pw
+}
+
+func (p *streamPipe) read(b []byte) (int, error) {
+	n, err := p.take(b)
+	if n > 0 && p.release != nil {
+		p.release(n, true)
+	}
+	return n, err
+}
+
+func (p *streamPipe) take(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.size == 0 {
+		if p.rerr != nil {
+			return 0, io.ErrClosedPipe
+		}
+		if p.werr != nil {
+			return 0, p.werr
+		}
+		p.cond.Wait()
+	}
+	if p.rerr != nil {
+		return 0, io.ErrClosedPipe
+	}
+	n := 0
+	for n < len(b) && len(p.chunks) > 0 {
+		c := copy(b[n:], p.chunks[0])
+		n += c
+		if c == len(p.chunks[0]) {
+			p.chunks[0] = nil
+			p.chunks = p.chunks[1:]
+		} else {
+			p.chunks[0] = p.chunks[0][c:]
+		}
+	}
+	p.size -= n
+	if p.block {
+		// a writer may be waiting for room
+		p.cond.Broadcast()
+	}
+	return n, nil
+}
+
+func (p *streamPipe) write(b []byte) (int, error) {
+	n, dropped, err := p.put(b)
+	if dropped > 0 && p.release != nil {
+		p.release(dropped, false)
+	}
+	return n, err
+}
+
+func (p *streamPipe) put(b []byte) (n, dropped int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// a write larger than the limit goes through once everything else is read
+	for p.block && p.rerr == nil && p.size > 0 && p.size+len(b) > p.limit {
+		p.cond.Wait()
+	}
+	switch {
+	case p.rerr != nil:
+		return 0, 0, p.rerr
+	case p.werr != nil:
+		return 0, 0, io.ErrClosedPipe
+	case len(b) == 0:
+		return 0, 0, nil
+	case !p.block && p.size+len(b) > p.limit:
+		// drop what's pending so the reader learns right away
+		p.werr = errStreamOverflow
+		dropped = p.size
+		p.chunks, p.size = nil, 0
+		p.cond.Broadcast()
+		return 0, dropped, errStreamOverflow
+	}
+	p.chunks = append(p.chunks, append([]byte(nil), b...))
+	p.size += len(b)
+	p.cond.Signal()
+	return len(b), 0, nil
+}
+
+func (p *streamPipe) closeRead(err error) {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	p.mu.Lock()
+	dropped := p.size
+	if p.rerr == nil {
+		p.rerr = err
+		p.chunks, p.size = nil, 0
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	if p.release != nil {
+		p.release(dropped, false)
+	}
+}
+
+func (p *streamPipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.werr == nil {
+		p.werr = err
+	}
+	p.cond.Broadcast()
+}
+
+// Read reads pending data, waiting for some if there is none. Once the writer is closed and
+// everything is read it returns the writer's error, io.EOF after a plain Close.
+func (r *streamReader) Read(b []byte) (int, error) { return r.p.read(b) }
+
+// Close closes the reader, subsequent writes fail with io.ErrClosedPipe
+func (r *streamReader) Close() error { return r.CloseWithError(nil) }
+
+// CloseWithError closes the reader, subsequent writes fail with err
+func (r *streamReader) CloseWithError(err error) error {
+	r.p.closeRead(err)
+	return nil
+}
+
+// Write queues data for the reader without waiting, it fails with errStreamOverflow if that
+// exceeds the pipe's limit. The writes of a blocking pipe wait for room instead.
+func (w *streamWriter) Write(b []byte) (int, error) { return w.p.write(b) }
+
+// Close ends the stream, the reader gets io.EOF once it has read everything
+func (w *streamWriter) Close() error { return w.CloseWithError(nil) }
+
+// CloseWithError ends the stream, the reader gets err once it has read everything
+func (w *streamWriter) CloseWithError(err error) error {
+	w.p.closeWrite(err)
+	return nil
+}
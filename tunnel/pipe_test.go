@@ -0,0 +1,299 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStreamPipe(t *testing.T) {
+	pr, pw := newStreamPipe(1024)
+	for _, s := range []string{"hello ", "streaming ", "world"} {
+		if _, err := pw.Write([]byte(s)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	_ = pw.Close()
+	// writes never waited for the reader, everything is still there after the close
+	got, err := io.ReadAll(pr)
+	if err != nil || string(got) != "hello streaming world" {
+		t.Errorf("Expected the written data, got %q %v", got, err)
+	}
+	if _, err := pw.Write([]byte("late")); err != io.ErrClosedPipe {
+		t.Errorf("Expected io.ErrClosedPipe writing after close, got %v", err)
+	}
+}
+
+func TestStreamPipeWaitsForData(t *testing.T) {
+	pr, pw := newStreamPipe(1024)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = pw.Write([]byte("late data"))
+		_ = pw.CloseWithError(errors.New("writer failed"))
+	}()
+	buf := make([]byte, 4)
+	n, err := pr.Read(buf)
+	if err != nil || string(buf[:n]) != "late" {
+		t.Errorf("Expected a partial read, got %q %v", buf[:n], err)
+	}
+	rest, err := io.ReadAll(pr)
+	if string(rest) != " data" || err == nil || err.Error() != "writer failed" {
+		t.Errorf("Expected the rest followed by the writer's error, got %q %v", rest, err)
+	}
+}
+
+func TestStreamPipeOverflow(t *testing.T) {
+	pr, pw := newStreamPipe(10)
+	if _, err := pw.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("Write up to the limit failed: %v", err)
+	}
+	if _, err := pw.Write([]byte("x")); err != errStreamOverflow {
+		t.Errorf("Expected errStreamOverflow, got %v", err)
+	}
+	// the reader learns about it right away rather than after reading what's pending
+	if n, err := pr.Read(make([]byte, 100)); n != 0 || err != errStreamOverflow {
+		t.Errorf("Expected errStreamOverflow for the reader, got %d %v", n, err)
+	}
+}
+
+func TestStreamPipeReaderClose(t *testing.T) {
+	pr, pw := newStreamPipe(1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := pr.Read(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	timeout := errors.New("timeout")
+	_ = pr.CloseWithError(timeout)
+	select {
+	case err := <-done:
+		if err != io.ErrClosedPipe {
+			t.Errorf("Expected io.ErrClosedPipe for a blocked reader, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Closing the reader did not unblock Read")
+	}
+	if _, err := pw.Write([]byte("x")); err != timeout {
+		t.Errorf("Expected the reader's error on write, got %v", err)
+	}
+}
+
+func TestStreamPipeBlocks(t *testing.T) {
+	pr, pw := newBlockingPipe(10)
+	written := make(chan error, 1)
+	go func() {
+		_, err := pw.Write([]byte("0123456789"))
+		if err == nil {
+			// waits for the reader, and goes through whole though it's over the limit
+			_, err = pw.Write(bytes.Repeat([]byte("x"), 20))
+		}
+		_ = pw.Close()
+		written <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-written:
+		t.Fatalf("Write didn't wait for the reader: %v", err)
+	default:
+	}
+	got, err := io.ReadAll(pr)
+	if err != nil || len(got) != 30 {
+		t.Errorf("Expected 30 bytes, got %d %v", len(got), err)
+	}
+	if err := <-written; err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+
+	// closing the reader releases a waiting writer
+	pr, pw = newBlockingPipe(1)
+	_, _ = pw.Write([]byte("x"))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = pr.Close()
+	}()
+	if _, err := pw.Write([]byte("y")); err != io.ErrClosedPipe {
+		t.Errorf("Expected io.ErrClosedPipe, got %v", err)
+	}
+}
+
+// bigBackend serves size bytes on /big and a short reply on everything else
+func bigBackend(size int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/big" {
+			_, _ = io.WriteString(w, "fast")
+			return
+		}
+		chunk := bytes.Repeat([]byte("x"), 64*1024)
+		for n := 0; n < size; n += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func getFast(t testing.TB, env *tunnelTestEnv) {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(env.wstunURL + "/_token/" + env.token + "/fast")
+	if err != nil {
+		t.Fatalf("Request stuck behind the slow caller: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "fast" {
+		t.Fatalf("Expected fast, got %q", body)
+	}
+}
+
+// TestSlowCallerDoesNotBlockTunnel checks that a caller that doesn't read its response
+// doesn't hold up the other requests on the tunnel
+func TestSlowCallerDoesNotBlockTunnel(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	env := setupTunnelTest(t, bigBackend(size), false)
+
+	slow, err := http.Get(env.wstunURL + "/_token/" + env.token + "/big")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = slow.Body.Close() }()
+	for i := 0; i < 5; i++ {
+		getFast(t, env)
+	}
+
+	// the slow caller still gets everything once it gets around to reading
+	n, err := io.Copy(io.Discard, slow.Body)
+	if err != nil || n != size {
+		t.Errorf("Expected %d bytes, got %d %v", size, n, err)
+	}
+}
+
+// TestSlowCallerOverflow checks that, without flow control, a response is dropped when its
+// caller falls more than the buffer limit behind
+func TestSlowCallerOverflow(t *testing.T) {
+	const size = 32 * 1024 * 1024
+	env := setupTunnelTest(t, bigBackend(size), false, "-max-response-buffer", "1048576",
+		"-stream-window", "0")
+
+	slow, err := http.Get(env.wstunURL + "/_token/" + env.token + "/big")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = slow.Body.Close() }()
+	getFast(t, env)
+
+	time.Sleep(500 * time.Millisecond)
+	n, _ := io.Copy(io.Discard, slow.Body)
+	if n >= size {
+		t.Errorf("Expected the response to be cut short, got all %d bytes", n)
+	}
+	getFast(t, env)
+}
+
+// TestV1SlowCaller checks that a version 1 client's response larger than the buffer reaches
+// a caller that reads it slowly, the websocket waits for the caller instead
+func TestV1SlowCaller(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-max-response-buffer", "1048576")
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	ws, _, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	go func() {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		var id int16
+		if _, err := fmt.Fscanf(io.LimitReader(r, 4), "%04x", &id); err != nil {
+			return
+		}
+		w, err := ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(w, "%04xHTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", id, size)
+		chunk := bytes.Repeat([]byte("x"), 64*1024)
+		for n := 0; n < size; n += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		_ = w.Close()
+	}()
+
+	resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/big")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// read at a trickle at first, so the response is far more than the buffer ahead
+	buf := make([]byte, 64*1024)
+	read := 0
+	for i := 0; i < 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+		n, err := resp.Body.Read(buf)
+		read += n
+		if err != nil {
+			t.Fatalf("Response cut short after %d bytes: %v", read, err)
+		}
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || read+int(n) != size {
+		t.Errorf("Expected %d bytes, got %d %v", size, read+int(n), err)
+	}
+}
+
+// benchmarkRequests measures requests going through the tunnel, optionally while another
+// caller keeps pulling large responses at a trickle
+func benchmarkRequests(b *testing.B, slowCaller bool) {
+	env := setupTunnelTest(b, bigBackend(16*1024*1024), false)
+	if slowCaller {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/big")
+				if err != nil {
+					return
+				}
+				for {
+					select {
+					case <-stop:
+						_ = resp.Body.Close()
+						return
+					case <-time.After(20 * time.Millisecond):
+					}
+					if _, err := resp.Body.Read(buf); err != nil {
+						break
+					}
+				}
+				_ = resp.Body.Close()
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+	for b.Loop() {
+		getFast(b, env)
+	}
+}
+
+func BenchmarkRequests(b *testing.B) {
+	benchmarkRequests(b, false)
+}
+
+func BenchmarkRequestsBehindSlowCaller(b *testing.B) {
+	benchmarkRequests(b, true)
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Token connection policies.
+//
+// Clients that connect with the same token share its requests by default (shared). A token
+// can instead be kept to a single client: exclusive-reject refuses the websockets of a second
+// client with a 409 while the first one is connected, exclusive-takeover lets the new client in
+// and closes the websockets of the previous one with a close code that tells it why, upon which
+// it stops instead of reconnecting and taking the token back. The websockets of a client's pool
+// count as one client. -token-policy sets the policy of all tokens, -token-policies that of
+// given tokens.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connection policies of a token
+const (
+	policyShared            = "shared"
+	policyExclusiveReject   = "exclusive-reject"
+	policyExclusiveTakeover = "exclusive-takeover"
+)
+
+// closeTakenOver is the websocket close code telling a client another one took over its token
+const closeTakenOver = 4001
+
+// validPolicy returns whether a connection policy exists
+func validPolicy(policy string) bool {
+	return policy == policyShared || policy == policyExclusiveReject || policy == policyExclusiveTakeover
+}
+
+// parsePolicies reads a comma-separated list of token:policy pairs, valid tells which
+// policies exist
+func parsePolicies(list string, valid func(string) bool) (map[token]string, error) {
+	policies := make(map[token]string)
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("expected token:policy, got %q", pair)
+		}
+		tok, policy := token(strings.TrimSpace(pair[:i])), strings.TrimSpace(pair[i+1:])
+		if len(tok) < minTokenLen {
+			return nil, fmt.Errorf("token %s too short", cutToken(tok))
+		}
+		if !valid(policy) {
+			return nil, fmt.Errorf("unknown policy %q for token %s", policy, cutToken(tok))
+		}
+		policies[tok] = policy
+	}
+	return policies, nil
+}
+
+// tokenPolicy returns the connection policy of a token
+func (t *WSTunnelServer) tokenPolicy(tok token) string {
+	if policy, ok := t.TokenPolicies[tok]; ok {
+		return policy
+	}
+	if t.TokenPolicy == "" {
+		return policyShared
+	}
+	return t.TokenPolicy
+}
+
+// clientKey identifies the client a tunnel websocket belongs to, a websocket outside of a pool
+// is a client of its own
+func clientKey(rc *remoteConn) string {
+	if rc.pool != "" {
+		return rc.pool
+	}
+	return fmt.Sprintf("%p", rc)
+}
+
+// otherClients returns the websockets of the tunnel that belong to another client than rc
+func (rs *remoteServer) otherClients(rc *remoteConn) []*remoteConn {
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	var others []*remoteConn
+	for c := range rs.conns {
+		if c.client != rc.client {
+			others = append(others, c)
+		}
+	}
+	return others
+}
+
+// clientCount returns how many clients have websockets on the tunnel
+func (rs *remoteServer) clientCount() int {
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	clients := make(map[string]bool)
+	for c := range rs.conns {
+		clients[c.client] = true
+	}
+	return len(clients)
+}
+
+// admitClient applies the token's policy to a new tunnel websocket before it's accepted, it
+// returns false if the websocket is refused. The websocket of an exclusive-reject token holds
+// the token for its client from then on, until dismissClient, so that two clients connecting
+// at the same time can't both get in.
+func (t *WSTunnelServer) admitClient(tok token, rc *remoteConn, addr string) bool {
+	if t.tokenPolicy(tok) != policyExclusiveReject {
+		return true
+	}
+	t.tokenClientsMutex.Lock()
+	for client := range t.exclusiveHolders[tok] {
+		if client != rc.client {
+			t.tokenClientsMutex.Unlock()
+			t.recordTokenEvent(tok, TunnelEventRejected, addr, "exclusive token in use by another client")
+			return false
+		}
+	}
+	if t.exclusiveHolders == nil {
+		t.exclusiveHolders = make(map[token]map[string]int)
+	}
+	if t.exclusiveHolders[tok] == nil {
+		t.exclusiveHolders[tok] = make(map[string]int)
+	}
+	t.exclusiveHolders[tok][rc.client]++
+	t.tokenClientsMutex.Unlock()
+	return true
+}
+
+// dismissClient undoes admitClient once a tunnel websocket is gone or didn't make it
+func (t *WSTunnelServer) dismissClient(tok token, rc *remoteConn) {
+	if t.tokenPolicy(tok) != policyExclusiveReject {
+		return
+	}
+	t.tokenClientsMutex.Lock()
+	defer t.tokenClientsMutex.Unlock()
+	if n := t.exclusiveHolders[tok][rc.client]; n > 1 {
+		t.exclusiveHolders[tok][rc.client] = n - 1
+		return
+	}
+	delete(t.exclusiveHolders[tok], rc.client)
+	if len(t.exclusiveHolders[tok]) == 0 {
+		delete(t.exclusiveHolders, tok)
+	}
+}
+
+// takeOver closes the websockets of the other clients of an exclusive-takeover token once a
+// new client got in
+func (t *WSTunnelServer) takeOver(rs *remoteServer, rc *remoteConn, addr string) {
+	if t.tokenPolicy(rs.token) != policyExclusiveTakeover {
+		return
+	}
+	others := rs.otherClients(rc)
+	if len(others) == 0 {
+		return
+	}
+	msg := websocket.FormatCloseMessage(closeTakenOver, "token taken over by another client")
+	for _, old := range others {
+		rs.log.Info().Str("ws", wsp(old.ws)).Str("addr", addr).Msg("WS   closing, taken over by another client")
+		_ = old.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		_ = old.ws.Close()
+	}
+	t.recordTokenEvent(rs.token, TunnelEventTakeover, addr,
+		fmt.Sprintf("closed %d websockets of the previous client", len(others)))
+}
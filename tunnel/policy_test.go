@@ -0,0 +1,193 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialPool opens a raw tunnel websocket as part of a client's pool, it returns the status of
+// the handshake and the websocket if it was accepted
+func dialPool(t *testing.T, env *tunnelTestEnv, pool string) (int, *websocket.Conn) {
+	t.Helper()
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	h.Set(poolHeader, pool)
+	ws, resp, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if resp == nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if ws != nil {
+		t.Cleanup(func() { _ = ws.Close() })
+	}
+	return resp.StatusCode, ws
+}
+
+// tunnelClients returns how many clients are connected with the test token
+func tunnelClients(env *tunnelTestEnv) int {
+	env.wstunsrv.serverRegistryMutex.Lock()
+	rs := env.wstunsrv.serverRegistry[token(env.token)]
+	env.wstunsrv.serverRegistryMutex.Unlock()
+	if rs == nil {
+		return 0
+	}
+	return rs.clientCount()
+}
+
+func TestParsePolicies(t *testing.T) {
+	tokA, tokB := "aaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbb"
+	policies, err := parsePolicies(tokA+":exclusive-reject, "+tokB+":exclusive-takeover,", validPolicy)
+	if err != nil {
+		t.Fatalf("parsePolicies: %v", err)
+	}
+	if policies[token(tokA)] != policyExclusiveReject || policies[token(tokB)] != policyExclusiveTakeover {
+		t.Errorf("Unexpected policies: %v", policies)
+	}
+	for _, bad := range []string{tokA, tokA + ":exclusive", "short:shared"} {
+		if _, err := parsePolicies(bad, validPolicy); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+
+	srv := &WSTunnelServer{TokenPolicy: policyExclusiveReject, TokenPolicies: policies}
+	if p := srv.tokenPolicy(token(tokB)); p != policyExclusiveTakeover {
+		t.Errorf("Expected the token's own policy, got %s", p)
+	}
+	if p := srv.tokenPolicy("cccccccccccccccccc"); p != policyExclusiveReject {
+		t.Errorf("Expected the default policy, got %s", p)
+	}
+	if p := (&WSTunnelServer{}).tokenPolicy(token(tokA)); p != policyShared {
+		t.Errorf("Expected tokens to be shared by default, got %s", p)
+	}
+}
+
+func TestTokenPolicyShared(t *testing.T) {
+	env := setupTunnelTest(t, http.NotFoundHandler(), false)
+	if code, _ := dialPool(t, env, "other-client"); code != http.StatusSwitchingProtocols {
+		t.Fatalf("Second client of a shared token: expected 101, got %d", code)
+	}
+	if n := tunnelClients(env); n != 2 {
+		t.Errorf("Expected 2 clients, got %d", n)
+	}
+}
+
+func TestTokenPolicyReject(t *testing.T) {
+	env := setupTunnelTest(t, http.NotFoundHandler(), false, "-token-policy", policyExclusiveReject)
+
+	if code, _ := dialPool(t, env, "other-client"); code != http.StatusConflict {
+		t.Errorf("Second client of an exclusive token: expected 409, got %d", code)
+	}
+	code, ws := dialPool(t, env, env.wstuncli.pool.id)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Websocket of the connected client: expected 101, got %d", code)
+	}
+	_ = ws.Close()
+	if d := claimEvents(t, env, TunnelEventRejected); len(d) != 1 || d[0] != "exclusive token in use by another client" {
+		t.Errorf("Unexpected rejections: %q", d)
+	}
+
+	stopClient(t, env)
+	if code, _ := dialPool(t, env, "other-client"); code != http.StatusSwitchingProtocols {
+		t.Errorf("Client of an exclusive token nobody holds: expected 101, got %d", code)
+	}
+}
+
+func TestAdmitClient(t *testing.T) {
+	srv := &WSTunnelServer{TokenPolicy: policyExclusiveReject}
+	tok := token("aaaaaaaaaaaaaaaaaa")
+	a1, a2, b := &remoteConn{client: "a"}, &remoteConn{client: "a"}, &remoteConn{client: "b"}
+	// the token is held from admission on, before any websocket of the client is up
+	if !srv.admitClient(tok, a1, "") || srv.admitClient(tok, b, "") {
+		t.Fatal("Expected the first client only to be admitted")
+	}
+	if !srv.admitClient(tok, a2, "") {
+		t.Error("Expected another websocket of the client holding the token to be admitted")
+	}
+	srv.dismissClient(tok, a1)
+	if srv.admitClient(tok, b, "") {
+		t.Error("Client admitted while the holder still has a websocket")
+	}
+	srv.dismissClient(tok, a2)
+	if !srv.admitClient(tok, b, "") {
+		t.Error("Client not admitted once the holder is gone")
+	}
+}
+
+// TestTokenPolicyRejectConcurrent checks that only one of several clients connecting at the
+// same time gets an exclusive token
+func TestTokenPolicyRejectConcurrent(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-token-policy", policyExclusiveReject)
+	codes := make(chan int, 10)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func(pool string) {
+			defer wg.Done()
+			<-start
+			h := http.Header{}
+			h.Set("Origin", env.token)
+			h.Set(poolHeader, pool)
+			ws, resp, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+			if ws != nil {
+				t.Cleanup(func() { _ = ws.Close() })
+			}
+			if resp == nil {
+				codes <- 0
+				t.Errorf("Dial failed: %v", err)
+				return
+			}
+			codes <- resp.StatusCode
+		}("client-" + strconv.Itoa(i))
+	}
+	close(start)
+	wg.Wait()
+	close(codes)
+	admitted := 0
+	for code := range codes {
+		if code == http.StatusSwitchingProtocols {
+			admitted++
+		} else if code != http.StatusConflict {
+			t.Errorf("Unexpected status %d", code)
+		}
+	}
+	if admitted != 1 || tunnelClients(env) != 1 {
+		t.Errorf("Expected a single client to get in, got %d (%d connected)", admitted, tunnelClients(env))
+	}
+}
+
+func TestTokenPolicyTakeover(t *testing.T) {
+	env := setupTunnelTest(t, http.NotFoundHandler(), false, "-token-policy", policyExclusiveTakeover)
+
+	if code, _ := dialPool(t, env, "new-client"); code != http.StatusSwitchingProtocols {
+		t.Fatalf("Client taking the token over: expected 101, got %d", code)
+	}
+	select {
+	case <-env.wstuncli.pool.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client that was taken over didn't stop")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := tunnelClients(env); n != 1 {
+		t.Errorf("Expected the new client only, got %d clients", n)
+	}
+	if d := claimEvents(t, env, TunnelEventTakeover); len(d) != 1 {
+		t.Errorf("Expected a takeover event, got %q", d)
+	}
+
+	data, err := env.wstunsrv.getAdminService().GetAuditingData(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get auditing data: %v", err)
+	}
+	tun := data.Tunnels[env.token]
+	if tun == nil || tun.Policy != policyExclusiveTakeover || tun.Clients != 1 {
+		t.Errorf("Unexpected auditing data: %+v", tun)
+	}
+}
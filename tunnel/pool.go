@@ -0,0 +1,267 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Websocket pools.
+//
+// A client can keep several websockets open to the server. Each websocket's writer on the
+// server pulls the next request off the tunnel's queue whenever it's free, so requests get
+// spread across the websockets and one that is stuck only holds up the requests sent on it.
+// On top of these active websockets the client keeps warm spares: they are connected and
+// pinged but the server doesn't send requests on them until the client activates one, which
+// it does as soon as an active websocket dies. The dead websocket is reopened as a spare in
+// the background, so losing a websocket doesn't cost a reconnect cycle, and the responses
+// still being worked on go back over another websocket (see resume.go).
+//
+// The websockets of a client announce their pool with the X-Tunnel-Pool header, the server
+// counts them as a single client. Spares add X-Tunnel-Spare and need protocol version 2, they
+// are activated with an "activate" control frame.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// poolHeader identifies the client a websocket belongs to on the handshake
+	poolHeader = "X-Tunnel-Pool"
+	// spareHeader marks a websocket that shouldn't get requests until it's activated
+	spareHeader = "X-Tunnel-Spare"
+	// controlActivate turns a spare websocket into an active one
+	controlActivate = "activate"
+)
+
+// errTunnelClosed fails the requests in flight on a websocket that went away
+var errTunnelClosed = errors.New("tunnel websocket closed before the response was complete")
+
+// randomID returns a random id, clients use them to identify their pool and session
+func randomID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//===== Server =====
+
+// isSpare returns whether a tunnel websocket handshake asks for a spare
+func isSpare(h http.Header, version int) bool {
+	return version >= protocolV2 && h.Get(spareHeader) != ""
+}
+
+// activate lets the websocket's writer send requests
+func (rc *remoteConn) activate() {
+	rc.activateOnce.Do(func() { close(rc.active) })
+}
+
+// isActive returns whether the websocket may get requests
+func (rc *remoteConn) isActive() bool {
+	select {
+	case <-rc.active:
+		return true
+	default:
+		return false
+	}
+}
+
+// reserveClient counts a new tunnel websocket against the token's client limit, the
+// websockets of a pool count as one client. It returns false when the limit is reached.
+func (t *WSTunnelServer) reserveClient(tok token, pool string) bool {
+	t.tokenClientsMutex.Lock()
+	defer t.tokenClientsMutex.Unlock()
+	if pool != "" && t.poolSockets[tok][pool] > 0 {
+		t.poolSockets[tok][pool]++
+		return true
+	}
+	if t.tokenClients[tok] >= t.MaxClientsPerToken {
+		return false
+	}
+	t.tokenClients[tok]++
+	if pool != "" {
+		if t.poolSockets == nil {
+			t.poolSockets = make(map[token]map[string]int)
+		}
+		if t.poolSockets[tok] == nil {
+			t.poolSockets[tok] = make(map[string]int)
+		}
+		t.poolSockets[tok][pool] = 1
+	}
+	return true
+}
+
+// releaseClient undoes reserveClient once a tunnel websocket is gone
+func (t *WSTunnelServer) releaseClient(tok token, pool string) {
+	t.tokenClientsMutex.Lock()
+	defer t.tokenClientsMutex.Unlock()
+	if pool != "" {
+		if n := t.poolSockets[tok][pool]; n > 1 {
+			t.poolSockets[tok][pool] = n - 1
+			return
+		}
+		delete(t.poolSockets[tok], pool)
+		if len(t.poolSockets[tok]) == 0 {
+			delete(t.poolSockets, tok)
+		}
+	}
+	if count, exists := t.tokenClients[tok]; exists && count > 0 {
+		t.tokenClients[tok] = count - 1
+		if t.tokenClients[tok] == 0 {
+			delete(t.tokenClients, tok)
+		}
+	}
+}
+
+//===== Client =====
+
+// wsPool keeps track of the websockets of a client
+type wsPool struct {
+	mu      sync.Mutex
+	id      string                 // identifies the pool to the server
+	conns   map[*WSConnection]bool // open websockets, true for the active ones
+	dialing int                    // active websockets being opened
+	size    int                    // active websockets wanted
+	v2      chan struct{}          // closed once the server speaks version 2, spares need it
+	v2Once  sync.Once
+	done    chan struct{} // closed when the client stops
+	stop    sync.Once
+}
+
+func newWSPool(size int) *wsPool {
+	return &wsPool{
+		id:    randomID(),
+		conns: make(map[*WSConnection]bool),
+		size:  size,
+		v2:    make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// reserve picks the role of the next websocket to open: active while there are fewer than
+// wanted, spare otherwise
+func (p *wsPool) reserve() (spare bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active := p.dialing
+	for _, a := range p.conns {
+		if a {
+			active++
+		}
+	}
+	if active < p.size {
+		p.dialing++
+		return false
+	}
+	return true
+}
+
+// opened adds a websocket to the pool, or just gives back the reservation if wsc is nil. It
+// returns whether there's an active websocket.
+func (p *wsPool) opened(wsc *WSConnection, spare bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !spare {
+		p.dialing--
+	}
+	if wsc != nil {
+		p.conns[wsc] = !spare
+		if wsc.version >= protocolV2 {
+			p.v2Once.Do(func() { close(p.v2) })
+		}
+	}
+	return p.hasActive()
+}
+
+// closed removes a websocket from the pool. If it was active, a spare is returned to
+// replace it. It also returns whether there's still an active websocket.
+func (p *wsPool) closed(wsc *WSConnection) (promoted *WSConnection, connected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wasActive := p.conns[wsc]
+	delete(p.conns, wsc)
+	if wasActive {
+		for c, a := range p.conns {
+			if !a {
+				p.conns[c] = true
+				promoted = c
+				break
+			}
+		}
+	}
+	return promoted, p.hasActive()
+}
+
+func (p *wsPool) hasActive() bool {
+	for _, a := range p.conns {
+		if a {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns the open websockets
+func (p *wsPool) all() []*WSConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := make([]*WSConnection, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// close makes the websocket keepers stop
+func (p *wsPool) close() {
+	p.stop.Do(func() { close(p.done) })
+}
+
+// keepWebsocket keeps a websocket of the pool open until the client stops, reopening it
+// when it dies
+func (t *WSTunnelClient) keepWebsocket() {
+	p := t.pool
+	for {
+		timer := time.NewTimer(10 * time.Second)
+		spare := p.reserve()
+		if spare {
+			// spares are only useful with a server that can activate them
+			select {
+			case <-p.v2:
+			case <-p.done:
+				timer.Stop()
+				return
+			}
+		}
+		wsc := t.openWebsocket(spare)
+		t.setConnected(p.opened(wsc, spare))
+		if wsc != nil {
+			if !spare {
+				t.setConn(wsc)
+			}
+			wsc.handleRequests()
+			promoted, connected := p.closed(wsc)
+			if promoted != nil {
+				t.activate(promoted)
+			}
+			t.setConnected(connected)
+		}
+		select {
+		case <-p.done:
+			timer.Stop()
+			return
+		case <-timer.C: // ensure we don't open connections too rapidly
+		}
+	}
+}
+
+// activate puts a spare websocket to work in place of one that died
+func (t *WSTunnelClient) activate(wsc *WSConnection) {
+	if err := wsc.writeFrame(frameControl, 0, 0, []byte(controlActivate)); err != nil {
+		wsc.Log.Warn().Err(err).Msg("WS   cannot activate spare")
+		return
+	}
+	t.setConn(wsc)
+	wsc.Log.Info().Msg("WS   spare activated")
+}
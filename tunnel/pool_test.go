@@ -0,0 +1,204 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitPool waits for a client to have n websockets open and returns them
+func waitPool(t *testing.T, cli *WSTunnelClient, n int) []*WSConnection {
+	t.Helper()
+	// websockets are reopened at most every 10 seconds
+	deadline := time.Now().Add(12 * time.Second)
+	for {
+		conns := cli.pool.all()
+		if len(conns) == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d websockets, got %d", n, len(conns))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// activeConns splits a client's websockets into active ones and spares
+func activeConns(cli *WSTunnelClient) (active, spares []*WSConnection) {
+	cli.pool.mu.Lock()
+	defer cli.pool.mu.Unlock()
+	for c, a := range cli.pool.conns {
+		if a {
+			active = append(active, c)
+		} else {
+			spares = append(spares, c)
+		}
+	}
+	return active, spares
+}
+
+func TestReserveClient(t *testing.T) {
+	srv := &WSTunnelServer{MaxClientsPerToken: 2, tokenClients: make(map[token]int)}
+	tok := token("some-token-1234567890")
+	for i := 0; i < 4; i++ {
+		if !srv.reserveClient(tok, "pool-a") {
+			t.Fatalf("Websocket %d of a pool was refused", i)
+		}
+	}
+	if !srv.reserveClient(tok, "") {
+		t.Fatal("Second client was refused")
+	}
+	if srv.reserveClient(tok, "pool-b") || srv.reserveClient(tok, "") {
+		t.Fatal("Third client was accepted")
+	}
+	for i := 0; i < 3; i++ {
+		srv.releaseClient(tok, "pool-a")
+	}
+	if srv.reserveClient(tok, "pool-b") {
+		t.Fatal("Client accepted while pool-a still has a websocket")
+	}
+	srv.releaseClient(tok, "pool-a")
+	if !srv.reserveClient(tok, "pool-b") {
+		t.Fatal("Client refused after pool-a went away")
+	}
+	if srv.tokenClients[tok] != 2 || len(srv.poolSockets[tok]) != 1 {
+		t.Errorf("Unexpected accounting: %d clients, pools %v", srv.tokenClients[tok], srv.poolSockets[tok])
+	}
+}
+
+// TestPoolSpreadsRequests checks that requests are spread across the active websockets and
+// that spares don't get any
+func TestPoolSpreadsRequests(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(w, "ok")
+	})
+	env := setupTunnelServer(t, backend, "-max-clients-per-token", "1")
+	startTunnelClient(t, env, backend, false, "-websockets", "3", "-spare-websockets", "1")
+	waitPool(t, env.wstuncli, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/x")
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected 200, got %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	active, spares := activeConns(env.wstuncli)
+	if len(active) != 3 || len(spares) != 1 {
+		t.Fatalf("Expected 3 active websockets and a spare, got %d and %d", len(active), len(spares))
+	}
+	for _, c := range active {
+		if c.traffic.bytes[msgIn].Load() == 0 {
+			t.Error("An active websocket got no requests")
+		}
+	}
+	if n := spares[0].traffic.bytes[msgIn].Load(); n != 0 {
+		t.Errorf("The spare got %d bytes of requests", n)
+	}
+	// the pool counts as a single client
+	stats := tunnelStats(t, env)
+	if stats["total_clients"] != "1" {
+		t.Errorf("Expected the pool to count as one client, got %v", stats)
+	}
+}
+
+// TestSpareTakesOver checks that a spare takes requests as soon as the active websocket dies
+// and that a new spare gets opened
+func TestSpareTakesOver(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})
+	env := setupTunnelServer(t, backend)
+	startTunnelClient(t, env, backend, false, "-websockets", "1", "-spare-websockets", "1")
+	waitPool(t, env.wstuncli, 2)
+	getOK(t, env)
+
+	active, spares := activeConns(env.wstuncli)
+	_ = active[0].ws.Close()
+	start := time.Now()
+	getOK(t, env)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Request took %s after the websocket died, expected the spare to take it", elapsed)
+	}
+	if active, _ := activeConns(env.wstuncli); len(active) != 1 || active[0] != spares[0] {
+		t.Error("Expected the spare to be the active websocket")
+	}
+	// the dead websocket gets replaced by a new spare
+	conns := waitPool(t, env.wstuncli, 2)
+	for _, c := range conns {
+		if c == active[0] {
+			t.Error("Dead websocket still in the pool")
+		}
+	}
+}
+
+func getOK(t *testing.T, env *tunnelTestEnv) {
+	t.Helper()
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(env.wstunURL + "/_token/" + env.token + "/x")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+}
+
+// TestDeadWebsocketFailsRequests checks that the requests in flight on a websocket that dies
+// fail right away when they can't be resumed instead of waiting for the timeout
+func TestDeadWebsocketFailsRequests(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			received <- struct{}{}
+			<-release
+		}
+		_, _ = io.WriteString(w, "ok")
+	})
+	defer close(release)
+	env := setupTunnelServer(t, backend, "-resume-timeout", "0")
+	startTunnelClient(t, env, backend, false, "-websockets", "1", "-spare-websockets", "1")
+	waitPool(t, env.wstuncli, 2)
+
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/hang")
+		if err != nil {
+			done <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-received
+	active, _ := activeConns(env.wstuncli)
+	_ = active[0].ws.Close()
+	select {
+	case code := <-done:
+		if code != http.StatusBadGateway {
+			t.Errorf("Expected 502, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request in flight on the dead websocket didn't fail")
+	}
+	// the other requests go through the spare
+	getOK(t, env)
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Session resumption.
+//
+// Version 2 clients name their session in the X-Tunnel-Session handshake header, using the
+// same id on every websocket they open for as long as they run, and the server echoes it when
+// it agrees to resume requests. When a websocket dies the requests that reached the client
+// through it are not failed: the client keeps working on them and sends their responses over
+// another websocket of the session, one of its pool or the one it reconnects with. The server
+// accepts a response on any websocket of the session the request was sent to.
+//
+// A request the server wrote to a dying websocket may or may not have made it to the client,
+// so the client reports on every websocket of the session that it loses: a "resume <ws>
+// <id>..." control frame sent over another websocket lists the requests it got through the
+// dead one and is still working on, <ws> being the id the server gave the websocket in the
+// X-Tunnel-Conn handshake header. The other requests sent on it never reached the client and
+// are sent again if their body wasn't consumed yet. Nothing else is ever replayed, so neither
+// are non-idempotent requests. Requests that the client doesn't report or resume within the
+// resume timeout fail, as do responses that were already coming through when their websocket
+// died.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionHeader names the session of the client on the websocket handshake
+	sessionHeader = "X-Tunnel-Session"
+	// connHeader gives the client the id of a resumable websocket
+	connHeader = "X-Tunnel-Conn"
+	// controlResume reports the requests the client got through a websocket that went away
+	controlResume = "resume"
+	// defaultResumeTimeout is how long requests of a dead websocket wait to be resumed, in
+	// seconds
+	defaultResumeTimeout = 30
+	// resumeWait is how long the client waits for a websocket to send a response over when
+	// the one its request came in on died
+	resumeWait = defaultResumeTimeout * time.Second
+)
+
+//===== Server =====
+
+// acceptSession returns the session of a tunnel websocket handshake, "" if the requests sent
+// on it can't be resumed
+func (t *WSTunnelServer) acceptSession(h http.Header, version int) string {
+	if version < protocolV2 || t.ResumeTimeout <= 0 {
+		return ""
+	}
+	return h.Get(sessionHeader)
+}
+
+// requestFor returns the request a frame received on rc is about, nil if there is none. If
+// resume is set, a request sent on another websocket of the same session is taken over: its
+// response comes through rc from now on.
+func (rs *remoteServer) requestFor(rc *remoteConn, id uint32, resume bool) *remoteRequest {
+	rs.requestSetMutex.Lock()
+	defer rs.requestSetMutex.Unlock()
+	req := rs.requestSet[id]
+	switch {
+	case req == nil || req.conn == nil:
+		return nil
+	case req.conn == rc:
+		return req
+	case resume && rc.session != "" && req.conn.session == rc.session:
+		req.log.Info().Str("ws", wsp(rc.ws)).Msg("WS   RCV resumed response")
+		req.conn = rc
+		return req
+	}
+	return nil
+}
+
+// resumeRequests handles the client's report on a websocket of its session that went away.
+// The requests it lists are resumed on rc, the others sent on the dead websocket never reached
+// the client.
+func (rs *remoteServer) resumeRequests(rc *remoteConn, report string) {
+	fields := strings.Fields(report)
+	if rc.session == "" || len(fields) == 0 {
+		return
+	}
+	held := make(map[uint32]bool)
+	for _, f := range fields[1:] {
+		if id, err := strconv.ParseUint(f, 10, 32); err == nil {
+			held[uint32(id)] = true
+		}
+	}
+	var dead *remoteConn
+	rs.requestSetMutex.Lock()
+	for _, req := range rs.requestSet {
+		c := req.conn
+		if c == nil || c == rc || c.session != rc.session || c.id != fields[0] {
+			continue
+		}
+		dead = c
+		switch {
+		case held[req.id]:
+			req.log.Info().Str("ws", wsp(rc.ws)).Msg("WS   request resumed")
+			req.conn = rc
+		case !req.sent.Load():
+			// still being sent, the sender finds out the websocket is gone
+		case req.bodyRead.Load():
+			req.log.Info().Msg("WS   request body lost with the websocket")
+			failRequest(req)
+		default:
+			req.log.Info().Msg("WS   request isn't held by the client, retrying")
+			select {
+			case req.replyChan <- responseBuffer{err: errMaybeSent}:
+			default:
+			}
+		}
+	}
+	rs.requestSetMutex.Unlock()
+	rs.log.Info().Str("ws", wsp(rc.ws)).Str("dead", fields[0]).Int("requests", len(held)).Msg("WS   RCV resume")
+	if dead != nil {
+		// the server may not have noticed yet, nothing more must be sent on it
+		_ = dead.ws.Close()
+	}
+}
+
+// failRequests deals with the requests that reached the client through a websocket that went
+// away. If the client can resume them, they get the resume timeout for their response to
+// start coming in on another websocket of the session, otherwise they fail right away.
+// Responses that were already streaming get cut by their pipe, and requests that didn't reach
+// the client are retried by their sender.
+func (rs *remoteServer) failRequests(rc *remoteConn, resume time.Duration) {
+	rs.requestSetMutex.Lock()
+	defer rs.requestSetMutex.Unlock()
+	for _, req := range rs.requestSet {
+		if req.conn != rc || !req.sent.Load() {
+			continue
+		}
+		if rc.session == "" {
+			failRequest(req)
+			continue
+		}
+		req.log.Info().Dur("timeout", resume).Msg("WS   waiting for the client to resume the request")
+		time.AfterFunc(resume, func() { rs.resumeExpired(rc, req) })
+	}
+}
+
+// resumeExpired fails a request that is still waiting to be resumed
+func (rs *remoteServer) resumeExpired(rc *remoteConn, req *remoteRequest) {
+	rs.requestSetMutex.Lock()
+	defer rs.requestSetMutex.Unlock()
+	if rs.requestSet[req.id] != req || req.conn != rc {
+		return // done with, or resumed
+	}
+	req.log.Info().Msg("WS   request not resumed in time")
+	failRequest(req)
+}
+
+// failRequest tells a request handler that no response is coming
+func failRequest(req *remoteRequest) {
+	select {
+	case req.replyChan <- responseBuffer{err: errTunnelClosed}:
+	default:
+	}
+}
+
+//===== Client =====
+
+// pick returns an open websocket other than except that can carry responses of the session,
+// preferably an active one
+func (p *wsPool) pick(except *WSConnection) *WSConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var spare *WSConnection
+	for c, active := range p.conns {
+		if c == except || !c.resumable {
+			continue
+		}
+		if active {
+			return c
+		}
+		spare = c
+	}
+	return spare
+}
+
+// resumeConn waits for a websocket of the session other than dead to carry on with a
+// response. It gives up after resumeWait, when abort is closed or when the client stops.
+func (t *WSTunnelClient) resumeConn(dead *WSConnection, abort <-chan struct{}) *WSConnection {
+	if !dead.resumable || t.pool == nil {
+		return nil
+	}
+	timeout := time.NewTimer(resumeWait)
+	defer timeout.Stop()
+	for {
+		if wsc := t.pool.pick(dead); wsc != nil {
+			return wsc
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout.C:
+			return nil
+		case <-abort:
+			return nil
+		case <-t.pool.done:
+			return nil
+		}
+	}
+}
+
+// responseSender returns the frame sender of the response to request id. Until the head of
+// the response is out, a websocket that dies is replaced by another one of the session.
+func (wsc *WSConnection) responseSender(id uint32, abort <-chan struct{}) func(typ byte, payload []byte) error {
+	conn, send := wsc, wsc.streamSender(id, abort)
+	started := false
+	return func(typ byte, payload []byte) error {
+		for {
+			err := send(typ, payload)
+			if err == nil {
+				started = true
+				return nil
+			}
+			if started {
+				return err
+			}
+			next := wsc.tun.resumeConn(conn, abort)
+			if next == nil {
+				return err
+			}
+			wsc.Log.Info().Uint32("id", id).Str("via", fmt.Sprintf("%p", next.ws)).Msg("WS   resuming response")
+			conn, send = next, next.streamSender(id, abort)
+		}
+	}
+}
+
+// reportResume tells the server which of the requests that came in on a websocket that went
+// away the client is still working on, over another websocket of the session
+func (wsc *WSConnection) reportResume() {
+	t := wsc.tun
+	report := controlResume + " " + wsc.connID
+	t.requestsMutex.Lock()
+	for id, r := range t.requests {
+		if r.wsc == wsc {
+			report += " " + strconv.FormatUint(uint64(id), 10)
+		}
+	}
+	t.requestsMutex.Unlock()
+	deadline := time.Now().Add(resumeWait)
+	for time.Now().Before(deadline) {
+		next := t.resumeConn(wsc, nil)
+		if next == nil {
+			break
+		}
+		if err := next.writeFrame(frameControl, 0, 0, []byte(report)); err == nil {
+			wsc.Log.Info().Str("via", fmt.Sprintf("%p", next.ws)).Msg("WS   reported requests to resume")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	wsc.Log.Warn().Msg("WS   cannot report requests to resume")
+}
+
+// clientRequest is a version 2 request the client is working on
+type clientRequest struct {
+	cancel context.CancelFunc
+	wsc    *WSConnection // websocket the request came in on
+}
+
+// startRequest registers a version 2 request and returns its context
+func (wsc *WSConnection) startRequest(id uint32) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := wsc.tun
+	t.requestsMutex.Lock()
+	defer t.requestsMutex.Unlock()
+	if t.requests == nil {
+		t.requests = make(map[uint32]clientRequest)
+	}
+	t.requests[id] = clientRequest{cancel: cancel, wsc: wsc}
+	return ctx
+}
+
+// releaseRequest cancels the context of a request and forgets about it, this is a no-op
+// for requests that are already released or were not registered by startRequest. Requests
+// are tracked by the client rather than the websocket since the server cancels a resumed
+// request on the websocket its response goes back on.
+func (wsc *WSConnection) releaseRequest(id uint32) {
+	t := wsc.tun
+	t.requestsMutex.Lock()
+	r, ok := t.requests[id]
+	delete(t.requests, id)
+	t.requestsMutex.Unlock()
+	if ok {
+		r.cancel()
+	}
+}
+
+// abandonRequests cancels the requests that came in on a websocket which went away without
+// a way to send their responses back
+func (wsc *WSConnection) abandonRequests() {
+	t := wsc.tun
+	t.requestsMutex.Lock()
+	defer t.requestsMutex.Unlock()
+	for id, r := range t.requests {
+		if r.wsc == wsc {
+			r.cancel()
+			delete(t.requests, id)
+		}
+	}
+}
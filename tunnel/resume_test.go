@@ -0,0 +1,152 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRequestFor(t *testing.T) {
+	rs := &remoteServer{requestSet: make(map[uint32]*remoteRequest)}
+	dead := &remoteConn{session: "s1"}
+	req := &remoteRequest{id: 7, conn: dead, log: zerolog.Nop()}
+	rs.requestSet[7] = req
+
+	if rs.requestFor(&remoteConn{session: "s2"}, 7, true) != nil {
+		t.Error("A websocket of another session took the request over")
+	}
+	if rs.requestFor(&remoteConn{}, 7, true) != nil {
+		t.Error("A websocket without session took the request over")
+	}
+	other := &remoteConn{session: "s1"}
+	if rs.requestFor(other, 7, false) != nil {
+		t.Error("Request taken over by a frame that doesn't start a response")
+	}
+	if rs.requestFor(other, 7, true) != req || req.conn != other {
+		t.Fatal("The session's other websocket didn't take the request over")
+	}
+	if rs.requestFor(dead, 7, false) != nil {
+		t.Error("The dead websocket still gets the request")
+	}
+	if rs.requestFor(other, 8, true) != nil {
+		t.Error("Got a request for an unknown id")
+	}
+}
+
+// resumeBackend answers POSTs once released and counts how many it got
+func resumeBackend(received chan<- struct{}, release <-chan struct{}, calls *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			calls.Add(1)
+			body, _ := io.ReadAll(r.Body)
+			received <- struct{}{}
+			<-release
+			_, _ = io.WriteString(w, "done "+string(body))
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	})
+}
+
+// postThroughDeadWebsocket posts a request, kills the websocket it's sent on while the local
+// server works on it and checks that the response makes it back without the request being
+// sent twice
+func postThroughDeadWebsocket(t *testing.T, cliArgs ...string) time.Duration {
+	received := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	backend := resumeBackend(received, release, &calls)
+	env := setupTunnelServer(t, backend)
+	startTunnelClient(t, env, backend, false, cliArgs...)
+	waitPool(t, env.wstuncli, len(env.wstuncli.pool.all()))
+	getOK(t, env)
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Post(env.wstunURL+"/_token/"+env.token+"/order", "text/plain", strings.NewReader("42"))
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		done <- result{code: resp.StatusCode, body: string(body)}
+	}()
+	<-received
+	active, _ := activeConns(env.wstuncli)
+	_ = active[0].ws.Close()
+	start := time.Now()
+	close(release)
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.code != http.StatusOK || res.body != "done 42" {
+			t.Errorf("Expected the response to be resumed, got %d %q %v", res.code, res.body, res.err)
+		}
+	case <-time.After(25 * time.Second):
+		t.Fatal("Response was not resumed")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("The local server got the request %d times", n)
+	}
+	return time.Since(start)
+}
+
+// TestResumeOnSpare checks that a response goes back over a spare when the websocket its
+// request came in on dies
+func TestResumeOnSpare(t *testing.T) {
+	if elapsed := postThroughDeadWebsocket(t, "-websockets", "1", "-spare-websockets", "1"); elapsed > 2*time.Second {
+		t.Errorf("Resuming on the spare took %s", elapsed)
+	}
+}
+
+// TestResumeAfterReconnect checks that a response goes back over the websocket the client
+// reconnects with when it had no other one
+func TestResumeAfterReconnect(t *testing.T) {
+	postThroughDeadWebsocket(t, "-websockets", "1", "-spare-websockets", "0")
+}
+
+// TestResumeTimeout checks that requests fail when the client goes away for good
+func TestResumeTimeout(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	var calls atomic.Int32
+	backend := resumeBackend(received, release, &calls)
+	env := setupTunnelServer(t, backend, "-resume-timeout", "1")
+	startTunnelClient(t, env, backend, false, "-websockets", "1", "-spare-websockets", "0")
+	waitPool(t, env.wstuncli, 1)
+
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(env.wstunURL+"/_token/"+env.token+"/order", "text/plain", strings.NewReader("42"))
+		if err != nil {
+			done <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-received
+	env.wstuncli.Stop()
+	select {
+	case code := <-done:
+		if code != http.StatusBadGateway {
+			t.Errorf("Expected 502, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request wasn't failed after the resume timeout")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Retry policy.
+//
+// A request that broke off before it could be handed to the client (ErrRetry) is sent again,
+// whatever its method. A request that was sent on a websocket that died and that the client
+// doesn't report holding (errMaybeSent) may have been run already, so it's only retried if it's
+// safe to run twice: it has an idempotent method (-retry-methods) or carries an Idempotency-Key
+// header, which tells the local server to run it only once. A request gets at most
+// -retry-attempts attempts, the first one included, with a backoff between them that starts at
+// -retry-backoff and doubles after each attempt. Every attempt is recorded with the request in
+// the admin database.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader marks a request the local server is known to run only once
+	idempotencyKeyHeader = "Idempotency-Key"
+	// defaultRetryMethods are the idempotent methods of RFC 9110
+	defaultRetryMethods  = "GET,HEAD,OPTIONS,TRACE,PUT,DELETE"
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 100 // milliseconds
+	// maxRetryBackoff caps the wait between two attempts
+	maxRetryBackoff = 5 * time.Second
+)
+
+// idempotentMethods are the methods retried by servers that don't set RetryMethods
+var idempotentMethods = parseMethods(defaultRetryMethods)
+
+// parseMethods turns a comma-separated list of methods into a set
+func parseMethods(list string) map[string]bool {
+	methods := make(map[string]bool)
+	for _, m := range strings.Split(list, ",") {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			methods[m] = true
+		}
+	}
+	return methods
+}
+
+// canRetry returns whether a request may be sent through the tunnel again, maybeSent tells
+// whether the client may have got it
+func (t *WSTunnelServer) canRetry(r *http.Request, maybeSent bool) bool {
+	methods := t.RetryMethods
+	if methods == nil {
+		methods = idempotentMethods
+	}
+	return !maybeSent || methods[r.Method] || r.Header.Get(idempotencyKeyHeader) != ""
+}
+
+// retryAttempts returns how many attempts a request gets, defaultRetryAttempts if RetryAttempts
+// isn't set
+func (t *WSTunnelServer) retryAttempts() int {
+	if t.RetryAttempts <= 0 {
+		return defaultRetryAttempts
+	}
+	return t.RetryAttempts
+}
+
+// retryBackoff returns how long to wait before attempt n, n > 1
+func (t *WSTunnelServer) retryBackoff(n int) time.Duration {
+	d := t.RetryBackoff
+	for i := 2; i < n && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// waitRetry waits before attempt n of a request, it returns false if the caller went away or
+// the request's deadline would pass in the meantime
+func (t *WSTunnelServer) waitRetry(ctx context.Context, req *remoteRequest, n int) bool {
+	d := t.retryBackoff(n)
+	if time.Now().Add(d).After(req.deadline) {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// attemptOutcome describes how an attempt at a request ended for the admin database
+func attemptOutcome(retry bool, statusCode int) string {
+	switch {
+	case retry:
+		return "retry"
+	case statusCode > 0:
+		return fmt.Sprintf("HTTP %d", statusCode)
+	}
+	return "no response"
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	srv := &WSTunnelServer{RetryMethods: parseMethods(" get, put ,,DELETE"), RetryBackoff: time.Second}
+	for method, expected := range map[string]bool{"GET": true, "PUT": true, "DELETE": true, "POST": false, "PATCH": false} {
+		r, _ := http.NewRequest(method, "/x", nil)
+		if srv.canRetry(r, true) != expected {
+			t.Errorf("%s: expected retry %v", method, expected)
+		}
+		if !srv.canRetry(r, false) {
+			t.Errorf("%s: not retried though it never reached the client", method)
+		}
+	}
+	r, _ := http.NewRequest(http.MethodPost, "/x", nil)
+	r.Header.Set(idempotencyKeyHeader, "order-42")
+	if !srv.canRetry(r, true) {
+		t.Error("POST with an Idempotency-Key not retried")
+	}
+
+	for n, expected := range map[int]time.Duration{2: time.Second, 3: 2 * time.Second, 4: 4 * time.Second, 9: maxRetryBackoff} {
+		if d := srv.retryBackoff(n); d != expected {
+			t.Errorf("Attempt %d: expected a backoff of %s, got %s", n, expected, d)
+		}
+	}
+
+	req := &remoteRequest{deadline: time.Now().Add(500 * time.Millisecond)}
+	if srv.waitRetry(context.Background(), req, 2) {
+		t.Error("Waited for a retry past the request's deadline")
+	}
+}
+
+// dialSession opens a raw version 2 websocket of a resumable session, it returns the id the
+// server gave the websocket
+func dialSession(t *testing.T, env *tunnelTestEnv, spare bool) (*websocket.Conn, string) {
+	t.Helper()
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	h.Set(protocolHeader, "2")
+	h.Set(poolHeader, "retry-pool")
+	h.Set(sessionHeader, "retry-session")
+	if spare {
+		h.Set(spareHeader, "1")
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+	return ws, resp.Header.Get(connHeader)
+}
+
+// recvRequest waits for the head of a request on a raw websocket, it returns its id or 0 if
+// none came within timeout
+func recvRequest(ws *websocket.Conn, timeout time.Duration) uint32 {
+	_ = ws.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		typ, _, id, _, err := recvFrame(ws)
+		if err != nil {
+			return 0
+		}
+		if typ == frameHeaders {
+			return id
+		}
+	}
+}
+
+// sendLostRequest sends a request through a websocket that the client then reports as dead
+// without holding the request, the server can't tell whether it got through. It returns the
+// status the caller got and whether the request came in again on the other websocket.
+func sendLostRequest(t *testing.T, env *tunnelTestEnv, method string, hdr http.Header) (int, bool) {
+	active, activeID := dialSession(t, env, false)
+	spare, _ := dialSession(t, env, true)
+
+	done := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(method, env.wstunURL+"/_token/"+env.token+"/lost", nil)
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	if recvRequest(active, 5*time.Second) == 0 {
+		t.Fatal("The request didn't come in")
+	}
+	_ = sendFrame(spare, frameControl, 0, 0, []byte(controlActivate))
+	_ = sendFrame(spare, frameControl, 0, 0, []byte(controlResume+" "+activeID))
+
+	retried := false
+	if id := recvRequest(spare, time.Second); id != 0 {
+		retried = true
+		_ = spare.SetReadDeadline(time.Time{})
+		_ = sendFrame(spare, frameHeaders, 0, id, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		_ = sendFrame(spare, frameEnd, 0, id, nil)
+	}
+	select {
+	case code := <-done:
+		return code, retried
+	case <-time.After(5 * time.Second):
+		t.Fatal("No response")
+	}
+	return 0, false
+}
+
+// attemptLog returns what the admin database recorded about the attempts at the last request
+func attemptLog(t *testing.T, env *tunnelTestEnv) (int, string) {
+	t.Helper()
+	var attempts int
+	var log string
+	err := env.wstunsrv.getAdminService().db.QueryRow(
+		"SELECT attempts, attempt_log FROM request_events ORDER BY id DESC LIMIT 1").Scan(&attempts, &log)
+	if err != nil {
+		t.Fatalf("Cannot read the request's attempts: %v", err)
+	}
+	return attempts, log
+}
+
+func TestRetryIdempotentRequest(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	code, retried := sendLostRequest(t, env, http.MethodGet, nil)
+	if code != http.StatusOK || !retried {
+		t.Errorf("Expected the GET to be retried, got %d (retried: %v)", code, retried)
+	}
+	if n, log := attemptLog(t, env); n != 2 || log != "1:retry 2:HTTP 200" {
+		t.Errorf("Unexpected attempts recorded: %d %q", n, log)
+	}
+}
+
+func TestRetryRefusesPost(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	code, retried := sendLostRequest(t, env, http.MethodPost, nil)
+	if code != http.StatusBadGateway || retried {
+		t.Errorf("Expected the POST to fail without a retry, got %d (retried: %v)", code, retried)
+	}
+	if n, log := attemptLog(t, env); n != 1 || log != "1:retry" {
+		t.Errorf("Unexpected attempts recorded: %d %q", n, log)
+	}
+}
+
+func TestRetryIdempotencyKey(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	hdr := http.Header{idempotencyKeyHeader: {"order-42"}}
+	code, retried := sendLostRequest(t, env, http.MethodPost, hdr)
+	if code != http.StatusOK || !retried {
+		t.Errorf("Expected the POST with a key to be retried, got %d (retried: %v)", code, retried)
+	}
+}
+
+// TestRetryDefaults checks that servers that don't set the retry policy get the default one
+func TestRetryDefaults(t *testing.T) {
+	srv := &WSTunnelServer{}
+	if n := srv.retryAttempts(); n != defaultRetryAttempts {
+		t.Errorf("Expected %d attempts, got %d", defaultRetryAttempts, n)
+	}
+	for method, expected := range map[string]bool{"GET": true, "PUT": true, "POST": false} {
+		r, _ := http.NewRequest(method, "/x", nil)
+		if srv.canRetry(r, true) != expected {
+			t.Errorf("%s: expected retry %v", method, expected)
+		}
+	}
+}
+
+func TestRetryAttemptsFlag(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-retry-attempts", "1")
+	code, retried := sendLostRequest(t, env, http.MethodGet, nil)
+	if code != http.StatusGatewayTimeout || retried {
+		t.Errorf("Expected no retry with a single attempt, got %d (retried: %v)", code, retried)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Cookie routing.
+//
+// A web app browsed through /_token/<token>/ loads its assets and links with absolute paths
+// that lack the prefix. With -route-cookie the server answers requests with the prefix with a
+// routing cookie, signed with -route-cookie-key so it can't be made up for another token and
+// scoped to the server's base path, and routes requests that have neither the prefix nor an
+// X-Token header to the tunnel the cookie names. The cookie is removed from the requests before
+// they go through the tunnel. Requests with the prefix also tell the local server the base path
+// of the server in an X-Forwarded-Prefix header, the token isn't passed on. The prefix set by a
+// proxy in front of the server is only kept with -trust-forwarded-prefix.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// routeCookieName is the name of the routing cookie
+	routeCookieName = "wstunnel_route"
+	// forwardedPrefixHeader tells the local server the path prefix it's served under
+	forwardedPrefixHeader = "X-Forwarded-Prefix"
+)
+
+// setupRouteCookie sets the key routing cookies are signed with, a random one if there's no
+// RouteCookieKey, in which case cookies don't survive a restart of the server
+func (t *WSTunnelServer) setupRouteCookie() {
+	if t.RouteCookieKey != "" {
+		t.routeCookieKey = []byte(t.RouteCookieKey)
+		return
+	}
+	t.routeCookieKey = make([]byte, 32)
+	_, _ = rand.Read(t.routeCookieKey)
+}
+
+// routeCookieValue returns the signed value of the routing cookie for a tunnel
+func (t *WSTunnelServer) routeCookieValue(tok token) string {
+	mac := hmac.New(sha256.New, t.routeCookieKey)
+	mac.Write([]byte(tok))
+	return base64.RawURLEncoding.EncodeToString([]byte(tok)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookieToken returns the tunnel the routing cookie of a request names, "" if it has no valid
+// one
+func (t *WSTunnelServer) cookieToken(r *http.Request) token {
+	c, err := r.Cookie(routeCookieName)
+	if err != nil {
+		return ""
+	}
+	enc, _, _ := strings.Cut(c.Value, ".")
+	tok, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || !hmac.Equal([]byte(c.Value), []byte(t.routeCookieValue(token(tok)))) {
+		return ""
+	}
+	return token(tok)
+}
+
+// setRouteCookie routes the requests of a browser to a tunnel from now on
+func (t *WSTunnelServer) setRouteCookie(w http.ResponseWriter, r *http.Request, tok token) {
+	value := t.routeCookieValue(tok)
+	if c, err := r.Cookie(routeCookieName); err == nil && c.Value == value {
+		return
+	}
+	t.setServerCookie(w, r, routeCookieName, value)
+}
+
+// setServerCookie sets a cookie of the server itself, scoped to its base path
+func (t *WSTunnelServer) setServerCookie(w http.ResponseWriter, r *http.Request, name, value string) {
+	path := t.BasePath
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// dropCookie removes a cookie of the server from a request, it's not for the local server
+func dropCookie(r *http.Request, cookie string) {
+	var kept []string
+	for _, line := range r.Header.Values("Cookie") {
+		for _, part := range strings.Split(line, ";") {
+			name, _, _ := strings.Cut(part, "=")
+			if part = strings.TrimSpace(part); part != "" && strings.TrimSpace(name) != cookie {
+				kept = append(kept, part)
+			}
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// setForwardedPrefix tells the local server the base path a request came in under, after the
+// prefix of a trusted proxy in front of the server unless that one already ends with it
+func (t *WSTunnelServer) setForwardedPrefix(r *http.Request) {
+	prefix := ""
+	if t.TrustForwardedPrefix {
+		prefix = strings.TrimSuffix(r.Header.Get(forwardedPrefixHeader), "/")
+	}
+	if !strings.HasSuffix(prefix, t.BasePath) {
+		prefix += t.BasePath
+	}
+	r.Header.Del(forwardedPrefixHeader)
+	if prefix != "" {
+		r.Header.Set(forwardedPrefixHeader, prefix)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// cookieBackend answers with the path, prefix and cookies of the requests it gets
+func cookieBackend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path+"|"+r.Header.Get(forwardedPrefixHeader)+"|"+r.Header.Get("Cookie"))
+	})
+}
+
+func cookieGet(t *testing.T, c *http.Client, url string, cookies ...*http.Cookie) (int, string, *http.Response) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), resp
+}
+
+func TestRouteCookie(t *testing.T) {
+	env := setupTunnelTest(t, cookieBackend(), false, "-route-cookie", "-route-cookie-key", "s3cret")
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	theme := &http.Cookie{Name: "theme", Value: "dark"}
+
+	// the page sets the cookie, the local server learns about the prefix
+	code, body, resp := cookieGet(t, browser, env.wstunURL+"/_token/"+env.token+"/app/", theme)
+	if expected := "/app/||theme=dark"; code != http.StatusOK || body != expected {
+		t.Errorf("Expected %q, got %d %q", expected, code, body)
+	}
+	if sc := resp.Header.Get("Set-Cookie"); !strings.Contains(sc, routeCookieName+"=") ||
+		!strings.Contains(sc, "Path=/") || !strings.Contains(sc, "HttpOnly") {
+		t.Errorf("Unexpected routing cookie: %q", sc)
+	}
+
+	// its assets are routed by the cookie, which the local server doesn't see
+	code, body, resp = cookieGet(t, browser, env.wstunURL+"/static/app.js", theme)
+	if expected := "/static/app.js||theme=dark"; code != http.StatusOK || body != expected {
+		t.Errorf("Expected %q, got %d %q", expected, code, body)
+	}
+	if sc := resp.Header.Get("Set-Cookie"); sc != "" {
+		t.Errorf("Cookie set again: %q", sc)
+	}
+
+	// a cookie that wasn't signed by the server doesn't route
+	forged := &http.Cookie{Name: routeCookieName, Value: env.wstunsrv.routeCookieValue(token(env.token)) + "x"}
+	if code, _, _ := cookieGet(t, http.DefaultClient, env.wstunURL+"/static/app.js", forged); code != http.StatusBadRequest {
+		t.Errorf("Forged cookie: expected 400, got %d", code)
+	}
+	other := &WSTunnelServer{RouteCookieKey: "other"}
+	other.setupRouteCookie()
+	forged.Value = other.routeCookieValue(token(env.token))
+	if code, _, _ := cookieGet(t, http.DefaultClient, env.wstunURL+"/static/app.js", forged); code != http.StatusBadRequest {
+		t.Errorf("Cookie signed with another key: expected 400, got %d", code)
+	}
+}
+
+func TestRouteCookieOff(t *testing.T) {
+	env := setupTunnelTest(t, cookieBackend(), false)
+	code, body, resp := cookieGet(t, http.DefaultClient, env.wstunURL+"/_token/"+env.token+"/app/")
+	if code != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		t.Errorf("Expected no routing cookie, got %d %q", code, resp.Header.Get("Set-Cookie"))
+	}
+	// the token isn't passed on
+	if expected := "/app/||"; body != expected {
+		t.Errorf("Expected %q, got %q", expected, body)
+	}
+}
+
+func TestRouteCookieBasePath(t *testing.T) {
+	srv := &WSTunnelServer{RouteCookie: true, BasePath: "/wstunnel"}
+	srv.setupRouteCookie()
+	r := httptest.NewRequest(http.MethodGet, "/_token/abc/", nil)
+	r.Header.Set(forwardedPrefixHeader, "/edge/")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	srv.setRouteCookie(w, r, "abc")
+	srv.setForwardedPrefix(r)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != "/wstunnel" || !cookies[0].Secure {
+		t.Errorf("Unexpected cookie: %+v", cookies)
+	}
+	if p := r.Header.Get(forwardedPrefixHeader); p != "/wstunnel" {
+		t.Errorf("Prefix of an untrusted proxy kept: %q", p)
+	}
+
+	r.AddCookie(cookies[0])
+	if tok := srv.cookieToken(r); tok != "abc" {
+		t.Errorf("Cookie routes to %q", tok)
+	}
+}
+
+func TestForwardedPrefixTrusted(t *testing.T) {
+	srv := &WSTunnelServer{BasePath: "/wstunnel", TrustForwardedPrefix: true}
+	for incoming, expected := range map[string]string{
+		"":                 "/wstunnel",
+		"/edge/":           "/edge/wstunnel",
+		"/edge/wstunnel":   "/edge/wstunnel",
+		"/wstunnel/":       "/wstunnel",
+		"/other/wstunnel2": "/other/wstunnel2/wstunnel",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/app/", nil)
+		if incoming != "" {
+			r.Header.Set(forwardedPrefixHeader, incoming)
+		}
+		srv.setForwardedPrefix(r)
+		if p := r.Header.Get(forwardedPrefixHeader); p != expected {
+			t.Errorf("%q: expected %q, got %q", incoming, expected, p)
+		}
+	}
+
+	// without a base path or a trusted prefix there's nothing to tell
+	r := httptest.NewRequest(http.MethodGet, "/app/", nil)
+	r.Header.Set(forwardedPrefixHeader, "/edge")
+	(&WSTunnelServer{}).setForwardedPrefix(r)
+	if _, ok := r.Header[forwardedPrefixHeader]; ok {
+		t.Errorf("Unexpected prefix %q", r.Header.Get(forwardedPrefixHeader))
+	}
+}
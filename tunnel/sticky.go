@@ -0,0 +1,115 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Sticky sessions.
+//
+// A stateful local server run behind several clients of a token breaks when the requests of a
+// caller land on different clients. With -sticky-cookie the server hands each caller a cookie
+// naming its session, with -sticky-header it takes the session from a header of the caller's
+// choosing, such as a user id (hashed, the value isn't kept). The first request of a session
+// pins it to the client that gets it, and its next requests go to that same client as long as
+// they come within -sticky-ttl seconds of each other. When the client is gone, the request is
+// balanced as usual and the session gets pinned to the client it lands on. The cookie is removed
+// from the requests before they go through the tunnel.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// stickyCookieName is the name of the cookie that names the session of a caller
+const stickyCookieName = "wstunnel_sticky"
+
+// defaultStickyTTL is how long a session stays pinned without requests by default
+const defaultStickyTTL = 10 * time.Minute
+
+// stickyPin binds a session to a client of the tunnel
+type stickyPin struct {
+	client  string // see clientKey
+	expires time.Time
+}
+
+// affinity returns the session a request belongs to, "" if it isn't sticky. A caller without a
+// session cookie gets one.
+func (t *WSTunnelServer) affinity(w http.ResponseWriter, r *http.Request) string {
+	if t.StickyHeader != "" {
+		if v := r.Header.Get(t.StickyHeader); v != "" {
+			sum := sha256.Sum256([]byte(v))
+			return "header:" + hex.EncodeToString(sum[:])
+		}
+	}
+	if !t.StickyCookie {
+		return ""
+	}
+	session := ""
+	if c, err := r.Cookie(stickyCookieName); err == nil && c.Value != "" {
+		session = c.Value
+		dropCookie(r, stickyCookieName)
+	} else {
+		session = randomID() + randomID()
+		t.setServerCookie(w, r, stickyCookieName, session)
+	}
+	return "cookie:" + session
+}
+
+// stickyClient returns the client a session is pinned to if it can take the request, and
+// extends the pin. The caller holds wsMutex.
+func (rs *remoteServer) stickyClient(session string, clients []*balanceClient) *balanceClient {
+	pin := rs.sticky[session]
+	if session == "" || pin == nil || time.Now().After(pin.expires) {
+		return nil
+	}
+	for _, c := range clients {
+		if c.key == pin.client {
+			pin.expires = time.Now().Add(rs.pinTTL())
+			return c
+		}
+	}
+	rs.log.Info().Msg("WS   sticky client gone, pinning the session to another one")
+	return nil
+}
+
+// pin binds a session to a client, forgetting the sessions whose pin expired. The caller holds
+// wsMutex.
+func (rs *remoteServer) pin(session, client string) {
+	if session == "" {
+		return
+	}
+	now := time.Now()
+	if rs.sticky == nil {
+		rs.sticky = make(map[string]*stickyPin)
+	}
+	if now.Sub(rs.stickySwept) > rs.pinTTL() {
+		for s, p := range rs.sticky {
+			if now.After(p.expires) {
+				delete(rs.sticky, s)
+			}
+		}
+		rs.stickySwept = now
+	}
+	rs.sticky[session] = &stickyPin{client: client, expires: now.Add(rs.pinTTL())}
+}
+
+// pinTTL returns how long a pin of the tunnel lasts without requests
+func (rs *remoteServer) pinTTL() time.Duration {
+	if rs.stickyTTL > 0 {
+		return rs.stickyTTL
+	}
+	return defaultStickyTTL
+}
+
+// stickySessions returns how many sessions are pinned to a client of the tunnel
+func (rs *remoteServer) stickySessions() int {
+	rs.wsMutex.Lock()
+	defer rs.wsMutex.Unlock()
+	n := 0
+	for _, p := range rs.sticky {
+		if time.Now().Before(p.expires) {
+			n++
+		}
+	}
+	return n
+}
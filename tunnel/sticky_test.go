@@ -0,0 +1,178 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// queueSticky adds n requests of a sticky session to a tunnel
+func queueSticky(t *testing.T, rs *remoteServer, session string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		req := &remoteRequest{replyChan: make(chan responseBuffer, 1), log: zerolog.Nop(), affinity: session}
+		if err := rs.AddRequest(req); err != nil {
+			t.Fatalf("AddRequest: %v", err)
+		}
+	}
+}
+
+func TestStickyPins(t *testing.T) {
+	rs := balancedServer(balanceRoundRobin)
+	a := addBalancedConn(rs, "a", 1, 0)
+	b := addBalancedConn(rs, "b", 1, 0)
+	queueSticky(t, rs, "s1", 5)
+	queueSticky(t, rs, "s2", 5)
+	assertQueued(t, []*remoteConn{a, b}, 5, 5)
+	// requests outside of sessions are balanced as usual
+	queueRequests(t, rs, 4)
+	assertQueued(t, []*remoteConn{a, b}, 7, 7)
+	if n := rs.stickySessions(); n != 2 {
+		t.Errorf("Expected 2 sticky sessions, got %d", n)
+	}
+}
+
+func TestStickyFirstFree(t *testing.T) {
+	rs := balancedServer(balanceFirstFree)
+	a := addBalancedConn(rs, "a", 1, 0)
+	b := addBalancedConn(rs, "b", 1, 0)
+	queueSticky(t, rs, "s1", 3)
+	queueRequests(t, rs, 2)
+	if len(a.queue)+len(b.queue) != 3 || (len(a.queue) != 0 && len(b.queue) != 0) {
+		t.Errorf("Expected the session on one websocket, got %d and %d", len(a.queue), len(b.queue))
+	}
+	if len(rs.requestQueue) != 2 {
+		t.Errorf("Expected the other requests in the tunnel's queue, got %d", len(rs.requestQueue))
+	}
+}
+
+func TestStickyFallback(t *testing.T) {
+	rs := balancedServer(balanceRoundRobin)
+	a := addBalancedConn(rs, "a", 1, 0)
+	b := addBalancedConn(rs, "b", 1, 0)
+	queueSticky(t, rs, "s1", 3)
+	assertQueued(t, []*remoteConn{a, b}, 3, 0)
+
+	// the session moves with its requests when its client goes away, and stays moved
+	rs.undispatch(a)
+	rs.wsDown(a)
+	assertQueued(t, []*remoteConn{a, b}, 0, 3)
+	c := addBalancedConn(rs, "c", 1, 0)
+	queueSticky(t, rs, "s1", 3)
+	assertQueued(t, []*remoteConn{a, b, c}, 0, 6, 0)
+}
+
+func TestStickyExpires(t *testing.T) {
+	rs := balancedServer(balanceRoundRobin)
+	rs.stickyTTL = 20 * time.Millisecond
+	a := addBalancedConn(rs, "a", 1, 0)
+	b := addBalancedConn(rs, "b", 1, 0)
+	queueSticky(t, rs, "s1", 1)
+	time.Sleep(30 * time.Millisecond)
+	if n := rs.stickySessions(); n != 0 {
+		t.Errorf("Expected the pin to have expired, got %d sessions", n)
+	}
+	queueSticky(t, rs, "s1", 1)
+	assertQueued(t, []*remoteConn{a, b}, 1, 1)
+}
+
+func TestAffinity(t *testing.T) {
+	srv := &WSTunnelServer{StickyCookie: true, StickyHeader: "X-User"}
+
+	r1 := httptest.NewRequest("GET", "/x", nil)
+	r1.Header.Set("X-User", "alice")
+	r2 := httptest.NewRequest("GET", "/y", nil)
+	r2.Header.Set("X-User", "alice")
+	w := httptest.NewRecorder()
+	if s1, s2 := srv.affinity(w, r1), srv.affinity(w, r2); s1 == "" || s1 != s2 {
+		t.Errorf("Expected the same session for the same header, got %q and %q", s1, s2)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Session cookie set for a request sticky by header")
+	}
+
+	// without the header the session comes from the cookie, which the local server doesn't see
+	w = httptest.NewRecorder()
+	session := srv.affinity(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stickyCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected a session cookie, got %v", cookies)
+	}
+	r3 := httptest.NewRequest("GET", "/", nil)
+	r3.AddCookie(cookies[0])
+	r3.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	if again := srv.affinity(httptest.NewRecorder(), r3); again != session {
+		t.Errorf("Expected the cookie's session %q, got %q", session, again)
+	}
+	if c := r3.Header.Get("Cookie"); c != "app=1" {
+		t.Errorf("Expected the session cookie to be removed, got %q", c)
+	}
+
+	if s := (&WSTunnelServer{}).affinity(w, r1); s != "" {
+		t.Errorf("Expected no session without sticky sessions, got %q", s)
+	}
+}
+
+// TestStickyClients checks that a caller sticks to one of two real clients of a token and
+// moves to the other one when it goes away
+func TestStickyClients(t *testing.T) {
+	var hits [2]atomic.Int32
+	counter := func(n *atomic.Int32) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n.Add(1)
+			_, _ = w.Write([]byte("ok"))
+		})
+	}
+	env := setupTunnelServer(t, http.NotFoundHandler(), "-balance", balanceRoundRobin, "-sticky-cookie")
+	var clients [2]*WSTunnelClient
+	for i := range clients {
+		startTunnelClient(t, env, counter(&hits[i]), true, "-spare-websockets", "0")
+		clients[i] = env.wstuncli
+	}
+
+	jar, _ := cookiejar.New(nil)
+	caller := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+	get := func() {
+		t.Helper()
+		resp, err := caller.Get(env.wstunURL + "/_token/" + env.token + "/x")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", resp.StatusCode)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		get()
+	}
+	pinned := 0
+	if hits[1].Load() > 0 {
+		pinned = 1
+	}
+	if hits[pinned].Load() != 10 {
+		t.Fatalf("Expected all requests on one client, got %d and %d", hits[0].Load(), hits[1].Load())
+	}
+
+	clients[pinned].Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnelClients(env) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("The server didn't notice the client went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		get()
+	}
+	if other := hits[1-pinned].Load(); other != 5 {
+		t.Errorf("Expected the session to move to the other client, it got %d requests", other)
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type tunnelTestEnv struct {
+	server   *httptest.Server
+	wstunsrv *WSTunnelServer
+	wstuncli *WSTunnelClient
+	wstunURL string
+	wsURL    string
+	token    string
+}
+
+// setupTunnelTest starts a tunnel server and client in front of backend. If internal is
+// set the backend is used as the client's InternalServer instead of being dialed over HTTP.
+func setupTunnelTest(t testing.TB, backend http.Handler, internal bool, srvArgs ...string) *tunnelTestEnv {
+	t.Helper()
+	env := setupTunnelServer(t, backend, srvArgs...)
+	startTunnelClient(t, env, backend, internal)
+	return env
+}
+
+// startTunnelClient connects a tunnel client with extra command line args to a test server
+func startTunnelClient(t testing.TB, env *tunnelTestEnv, backend http.Handler, internal bool, cliArgs ...string) {
+	t.Helper()
+	wstuncli := NewWSTunnelClient(append([]string{
+		"-token", env.token,
+		"-tunnel", env.wsURL,
+		"-server", env.server.URL,
+		"-timeout", "10",
+	}, cliArgs...))
+	if internal {
+		wstuncli.InternalServer = backend
+	}
+	if err := wstuncli.Start(); err != nil {
+		t.Fatalf("Error starting client: %v", err)
+	}
+	t.Cleanup(wstuncli.Stop)
+	env.wstuncli = wstuncli
+
+	start := time.Now()
+	for !wstuncli.IsConnected() {
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(start) > 6*time.Second {
+			t.Fatalf("Client failed to connect within 6 seconds")
+		}
+	}
+}
+
+// setupTunnelServer starts a tunnel server and a backend but no tunnel client
+func setupTunnelServer(t testing.TB, backend http.Handler, srvArgs ...string) *tunnelTestEnv {
+	t.Helper()
+
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	wstunsrv := NewWSTunnelServer(srvArgs)
+	wstunsrv.Start(listener)
+	t.Cleanup(wstunsrv.Stop)
+
+	return &tunnelTestEnv{
+		server:   server,
+		wstunsrv: wstunsrv,
+		wstunURL: "http://" + listener.Addr().String(),
+		wsURL:    "ws://" + listener.Addr().String(),
+		token:    "test-token-" + strconv.Itoa(rand.Int()%1000000) + "-1234567890",
+	}
+}
+
+// slowBackend writes a first chunk, then waits for release before writing the rest
+func slowBackend(release chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("first-chunk\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+		}
+		_, _ = w.Write([]byte("second-chunk\n"))
+	})
+}
+
+func testIncrementalResponse(t *testing.T, internal bool) {
+	release := make(chan struct{})
+	env := setupTunnelTest(t, slowBackend(release), internal)
+
+	resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/stream")
+	if err != nil {
+		close(release)
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// the first chunk must arrive while the backend is still blocked
+	br := bufio.NewReader(resp.Body)
+	got := make(chan string, 1)
+	go func() {
+		line, _ := br.ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if line != "first-chunk\n" {
+			t.Errorf("Expected first chunk, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("First chunk was not streamed before the backend finished")
+	}
+	close(release)
+
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Error reading rest of response: %v", err)
+	}
+	if string(rest) != "second-chunk\n" {
+		t.Errorf("Expected second chunk, got %q", string(rest))
+	}
+}
+
+func TestStreamedResponse(t *testing.T) {
+	testIncrementalResponse(t, false)
+}
+
+func TestStreamedInternalResponse(t *testing.T) {
+	testIncrementalResponse(t, true)
+}
+
+func TestStreamedLargeResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 256*1024) // 4MB
+	env := setupTunnelTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}), false)
+
+	resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/large")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("Response body mismatch: got %d bytes, expected %d", len(got), len(body))
+	}
+}
+
+// echoBodyBackend replies with a copy of the request body and reports its length
+func echoBodyBackend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("X-Body-Length", strconv.Itoa(len(body)))
+		_, _ = w.Write(body)
+	})
+}
+
+func testLargeUpload(t *testing.T, internal bool) {
+	env := setupTunnelTest(t, echoBodyBackend(), internal)
+	body := bytes.Repeat([]byte("fedcba9876543210"), 256*1024) // 4MB
+
+	// hide the length so the upload is sent with chunked encoding
+	resp, err := http.Post(env.wstunURL+"/_token/"+env.token+"/upload", "application/octet-stream",
+		io.MultiReader(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("Upload mismatch: backend saw %s bytes, echoed %d, expected %d",
+			resp.Header.Get("X-Body-Length"), len(got), len(body))
+	}
+}
+
+func TestStreamedUpload(t *testing.T) {
+	testLargeUpload(t, false)
+}
+
+func TestStreamedInternalUpload(t *testing.T) {
+	testLargeUpload(t, true)
+}
+
+// TestStreamedRequestStartsEarly checks that the backend sees the request before the caller
+// has finished sending its body
+func TestStreamedRequestStartsEarly(t *testing.T) {
+	gotHead := make(chan struct{})
+	env := setupTunnelTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(gotHead)
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}), false)
+
+	pr, pw := io.Pipe()
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Post(env.wstunURL+"/_token/"+env.token+"/upload", "text/plain", pr)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		b, err := io.ReadAll(resp.Body)
+		done <- result{string(b), err}
+	}()
+
+	_, _ = pw.Write([]byte("first,"))
+	select {
+	case <-gotHead:
+	case <-time.After(5 * time.Second):
+		_ = pw.Close()
+		t.Fatal("Backend did not get the request before the body was complete")
+	}
+	_, _ = pw.Write([]byte("second"))
+	_ = pw.Close()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("Request failed: %v", res.err)
+	}
+	if res.body != "first,second" {
+		t.Errorf("Expected echoed body, got %q", res.body)
+	}
+}
+
+// countingReader records how much of a request body has been consumed
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func testExpectContinue(t *testing.T, internal bool) {
+	const limit = 1024
+	env := setupTunnelTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}), internal)
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+
+	post := func(body []byte) (*http.Response, *countingReader) {
+		cr := &countingReader{r: bytes.NewReader(body)}
+		req, _ := http.NewRequest("POST", env.wstunURL+"/_token/"+env.token+"/upload", cr)
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp, cr
+	}
+
+	// too large: the backend rejects it without the body being transferred
+	resp, cr := post(bytes.Repeat([]byte("x"), 1024*1024))
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", resp.StatusCode)
+	}
+	if n := cr.n.Load(); n != 0 {
+		t.Errorf("Expected the rejected body not to be sent, %d bytes were read", n)
+	}
+
+	// small enough: the body goes through once the backend asks for it
+	resp, cr = post([]byte("small upload"))
+	got, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != 200 || string(got) != "small upload" {
+		t.Errorf("Expected 200 with echoed body, got %d %q", resp.StatusCode, string(got))
+	}
+	if n := cr.n.Load(); n != int64(len("small upload")) {
+		t.Errorf("Expected the whole body to be sent, %d bytes were read", n)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	testExpectContinue(t, false)
+}
+
+func TestExpectContinueInternal(t *testing.T) {
+	testExpectContinue(t, true)
+}
+
+// eventBackend sends count server-sent events, every seconds apart, then stalls until the
+// request goes away, which is signalled on gone
+func eventBackend(count int, every time.Duration, gone chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < count; i++ {
+			_, _ = fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(every)
+		}
+		<-r.Context().Done()
+		close(gone)
+	})
+}
+
+func testEventStream(t *testing.T, internal bool) {
+	gone := make(chan struct{})
+	// the stream lasts well beyond the request timeout but never pauses for long
+	env := setupTunnelTest(t, eventBackend(8, 250*time.Millisecond, gone), internal,
+		"-httptimeout", "1", "-stream-idle-timeout", "1")
+
+	start := time.Now()
+	resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/events")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+
+	br := bufio.NewReader(resp.Body)
+	for i := 0; i < 8; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended after %d events: %v", i, err)
+		}
+		if expected := fmt.Sprintf("data: event %d\n", i); line != expected {
+			t.Errorf("Expected %q, got %q", expected, line)
+		}
+		// each event is flushed as it is produced
+		if elapsed, due := time.Since(start), time.Duration(i+1)*250*time.Millisecond; elapsed > due+time.Second {
+			t.Errorf("Event %d arrived after %v", i, elapsed)
+		}
+		_, _ = br.ReadString('\n')
+	}
+
+	// once the backend stalls the idle timeout ends the stream
+	if rest, _ := io.ReadAll(br); len(rest) != 0 {
+		t.Errorf("Expected no more events, got %q", rest)
+	}
+	if elapsed := time.Since(start); elapsed > 6*time.Second {
+		t.Errorf("Stalled stream was not cut off by the idle timeout, took %v", elapsed)
+	}
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend was not cancelled after the idle timeout")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	testEventStream(t, false)
+}
+
+func TestEventStreamInternal(t *testing.T) {
+	testEventStream(t, true)
+}
+
+// TestFixedResponseKeepsDeadline checks that responses of known length are still held to
+// the request timeout
+func TestFixedResponseKeepsDeadline(t *testing.T) {
+	env := setupTunnelTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "20")
+		_, _ = io.WriteString(w, "0123456789")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}), false, "-httptimeout", "1", "-stream-idle-timeout", "30")
+
+	start := time.Now()
+	resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/fixed")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("Expected the truncated response to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Response outlived the request timeout: %v", elapsed)
+	}
+}
+
+func TestIsStreamingResponse(t *testing.T) {
+	tests := []struct {
+		contentType string
+		length      int64
+		encoding    []string
+		expected    bool
+	}{
+		{"text/event-stream", -1, nil, true},
+		{"text/event-stream; charset=utf-8", 100, nil, true},
+		{"application/json", -1, []string{"chunked"}, true},
+		{"application/json", 100, nil, false},
+		{"text/html", -1, nil, false}, // read until close, e.g. an HTTP/1.0 response
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}, ContentLength: tt.length, TransferEncoding: tt.encoding}
+		resp.Header.Set("Content-Type", tt.contentType)
+		if got := isStreamingResponse(resp); got != tt.expected {
+			t.Errorf("isStreamingResponse(%q, %d, %v) = %v, expected %v",
+				tt.contentType, tt.length, tt.encoding, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// trailerBackend sends a body followed by a checksum and a status trailer, and echoes the
+// trailers of the request it got. The checksum is announced unless the path is /undeclared.
+func trailerBackend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/undeclared" {
+			w.Header().Set("Trailer", "X-Checksum")
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, "body=%s req-checksum=%s", body, r.Trailer.Get("X-Checksum"))
+		w.(http.Flusher).Flush()
+		w.Header().Set(http.TrailerPrefix+"X-Checksum", "sum-of-"+string(body))
+		w.Header().Set(http.TrailerPrefix+"X-Status", "0")
+	})
+}
+
+// postWithTrailer sends a chunked request whose body is followed by a checksum trailer
+func postWithTrailer(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = io.WriteString(pw, body)
+		_ = pw.Close()
+	}()
+	req, err := http.NewRequest(http.MethodPost, url, pr)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	req.Trailer = http.Header{"X-Checksum": {"client-sum"}}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	return resp
+}
+
+func TestTrailers(t *testing.T) {
+	backend := trailerBackend()
+	env := setupTunnelTest(t, backend, false)
+
+	for _, path := range []string{"/declared", "/undeclared"} {
+		resp := postWithTrailer(t, env.wstunURL+"/_token/"+env.token+path, "hello")
+		_, declared := resp.Trailer["X-Checksum"]
+		if path == "/declared" && !declared {
+			t.Errorf("Trailer not announced to the caller, got %v", resp.Trailer)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "body=hello req-checksum=client-sum" {
+			t.Errorf("%s: request trailer didn't reach the backend: %q", path, body)
+		}
+		if got := resp.Trailer.Get("X-Checksum"); got != "sum-of-hello" {
+			t.Errorf("%s: expected the checksum trailer, got %q", path, got)
+		}
+		if got := resp.Trailer.Get("X-Status"); got != "0" {
+			t.Errorf("%s: expected the status trailer, got %q", path, got)
+		}
+	}
+}
+
+// TestTrailersV1 checks that trailers go through version 1 clients as well
+func TestTrailersV1(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	ws, _, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	reqTrailer := make(chan string, 1)
+	go func() {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		var id int16
+		if _, err := fmt.Fscanf(io.LimitReader(r, 4), "%04x", &id); err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err != nil {
+			return
+		}
+		_, _ = io.ReadAll(req.Body)
+		reqTrailer <- req.Trailer.Get("X-Checksum")
+		w, err := ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(w, "%04x", id)
+		_, _ = io.WriteString(w, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n"+
+			"2\r\nok\r\n0\r\nX-Checksum: legacy-sum\r\n\r\n")
+		_ = w.Close()
+	}()
+
+	resp := postWithTrailer(t, env.wstunURL+"/_token/"+env.token+"/x", "payload")
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" || resp.Trailer.Get("X-Checksum") != "legacy-sum" {
+		t.Errorf("Expected ok with a trailer, got %q %v", body, resp.Trailer)
+	}
+	select {
+	case sum := <-reqTrailer:
+		if sum != "client-sum" {
+			t.Errorf("Expected the request trailer, got %q", sum)
+		}
+	default:
+		t.Error("Version 1 client did not receive the request")
+	}
+}
+
+func TestCopyResponseTrailers(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\n" +
+		"3\r\nabc\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: fine\r\n\r\n"
+	rec := httptest.NewRecorder()
+	code, err := writeResponse(rec, strings.NewReader(raw))
+	if err != nil || code != 200 {
+		t.Fatalf("writeResponse returned %d %v", code, err)
+	}
+	res := rec.Result()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "abc" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" || res.Trailer.Get("Grpc-Message") != "fine" {
+		t.Errorf("Trailers not passed on, got %v", res.Trailer)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// WebSocket passthrough.
+//
+// A request carrying "Upgrade: websocket" is forwarded like any other request, except that
+// the request stream is left open after the handshake. If the local server switches
+// protocols, the client sends the 101 response back and from then on the request stream
+// carries the bytes the caller sends and the response stream the bytes the local server
+// sends. The server hijacks the caller's connection to relay them, so websocket frames
+// travel untouched between the caller and the local server. This requires protocol v2.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errUpgradeUnsupported is returned for websocket requests when the client only speaks v1
+var errUpgradeUnsupported = errors.New("tunnel client does not support websocket upgrades")
+
+// isUpgrade returns whether a request asks for a websocket to be tunneled
+func isUpgrade(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// keepUpgradeHeaders puts back the hop-by-hop headers the websocket handshake relies on
+func keepUpgradeHeaders(h http.Header) {
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "websocket")
+}
+
+// writeResponseHead writes the status line and headers of a response with no body
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// relay shuttles an upgraded connection through the tunnel: what is read from conn is sent
+// as data frames on fw and what arrives on stream is written to conn. Either side closing
+// tears down the other, relay returns once both directions are done.
+func relay(conn io.ReadWriteCloser, fw *frameWriter, stream io.ReadCloser) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(conn, stream)
+		_ = conn.Close()
+		close(done)
+	}()
+	if err := copyFrames(fw, conn); err != nil && fw.err == nil {
+		_ = fw.Abort(err)
+	} else {
+		_ = fw.Close()
+	}
+	_ = stream.Close()
+	<-done
+}
+
+// readWriteCloser assembles a connection from its parts
+type readWriteCloser struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// readCloser assembles a stream from its parts
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// relayUpgrade finishes a websocket request on the server once the client's response starts
+// coming in. Unless the local server refused the upgrade, the caller's connection is hijacked
+// and relayed through the tunnel. It returns the status code and an error if the exchange
+// did not complete.
+func relayUpgrade(rs *remoteServer, req *remoteRequest, w http.ResponseWriter, r *http.Request,
+	pr *streamReader) (int, error) {
+	safeW, ok := w.(*safeResponseWriter)
+	if !ok {
+		safeW = &safeResponseWriter{ResponseWriter: w}
+	}
+	fw := rs.requestStream(req)
+
+	br := bufio.NewReader(pr)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		_ = fw.Close()
+		_ = pr.Close()
+		return writeParseError(safeW, err), nil
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// not upgraded: the exchange is a plain request/response one
+		_ = fw.Close()
+		return copyResponse(safeW, resp, readCloser{br, pr})
+	}
+
+	conn, brw, err := http.NewResponseController(safeW).Hijack()
+	if err != nil {
+		_ = fw.Abort(err)
+		_ = pr.Close()
+		safeError(safeW, "Cannot upgrade connection", http.StatusInternalServerError)
+		return http.StatusInternalServerError, err
+	}
+	safeW.statusCode = http.StatusSwitchingProtocols
+	// hand the caller the local server's handshake response
+	_ = conn.SetDeadline(time.Time{})
+	if err := writeResponseHead(brw, resp); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		_ = fw.Abort(err)
+		_ = pr.Close()
+		_ = conn.Close()
+		return http.StatusSwitchingProtocols, err
+	}
+
+	// the caller may have sent data right behind its handshake
+	buffered := io.LimitReader(brw.Reader, int64(brw.Reader.Buffered()))
+	relay(readWriteCloser{io.MultiReader(buffered, conn), conn, conn}, fw, readCloser{br, pr})
+	req.log.Info().Str("ws", fmt.Sprintf("%p", conn)).Msg("HTTP websocket closed")
+	return http.StatusSwitchingProtocols, nil
+}
+
+// requestStream returns a frameWriter that continues the stream of a request whose headers
+// have already been sent
+func (rs *remoteServer) requestStream(req *remoteRequest) *frameWriter {
+	rs.requestSetMutex.Lock()
+	rc := req.conn
+	rs.requestSetMutex.Unlock()
+	fw := newFrameWriter(rc.streamSender(req))
+	fw.sent = true
+	return fw
+}
+
+// relayUpgradeResponse finishes a websocket request on the client once the local server
+// switched protocols: the handshake response is sent to the server and the upgraded
+// connection is relayed through the tunnel
+func (wsc *WSConnection) relayUpgradeResponse(id uint32, resp *http.Response, conn io.ReadWriteCloser, stream io.ReadCloser) {
+	var abort <-chan struct{}
+	if resp.Request != nil {
+		abort = resp.Request.Context().Done()
+	}
+	fw := newFrameWriter(wsc.streamSender(id, abort))
+	if err := writeResponseHead(fw, resp); err != nil || fw.Flush() != nil {
+		_ = conn.Close()
+		_ = stream.Close()
+		return
+	}
+	relay(conn, fw, stream)
+}
+
+// Hijack lets internal handlers take over the connection, e.g. to accept a websocket. The
+// handler gets one end of a pipe, the other end is relayed through the tunnel.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.started == nil {
+		return nil, nil, errors.New("connection can't be hijacked on a v1 tunnel")
+	}
+	if rw.resp.StatusCode != -1 || rw.hijacked != nil {
+		return nil, nil, http.ErrHijacked
+	}
+	handlerEnd, tunnelEnd := net.Pipe()
+	rw.hijacked = tunnelEnd
+	rw.once.Do(func() { close(rw.started) })
+	return handlerEnd, bufio.NewReadWriter(bufio.NewReader(handlerEnd), bufio.NewWriter(handlerEnd)), nil
+}
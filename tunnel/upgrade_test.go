@@ -0,0 +1,182 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoWebsocket is a backend that echoes websocket messages, prefixed by the path they were
+// requested on
+func echoWebsocket() http.Handler {
+	upgrader := websocket.Upgrader{
+		CheckOrigin:  func(*http.Request) bool { return true },
+		Subprotocols: []string{"echo"},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/refuse" {
+			http.Error(w, "no websockets here", http.StatusForbidden)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = ws.Close() }()
+		for {
+			typ, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(typ, append([]byte(r.URL.Path+":"), msg...)); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func wsEcho(t *testing.T, ws *websocket.Conn, msg string, expected string) {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	_, got, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(got) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(got))
+	}
+}
+
+func testWebsocketUpgrade(t *testing.T, internal bool) {
+	env := setupTunnelTest(t, echoWebsocket(), internal)
+	wsBase := "ws" + strings.TrimPrefix(env.wstunURL, "http")
+
+	dialer := websocket.Dialer{Subprotocols: []string{"echo"}}
+	ws, resp, err := dialer.Dial(wsBase+"/_token/"+env.token+"/chat", nil)
+	if err != nil {
+		t.Fatalf("Dial through the tunnel failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Expected 101, got %d", resp.StatusCode)
+	}
+	if ws.Subprotocol() != "echo" {
+		t.Errorf("Expected the backend's subprotocol, got %q", ws.Subprotocol())
+	}
+
+	wsEcho(t, ws, "hello", "/chat:hello")
+	big := strings.Repeat("0123456789", 10000) // spans several tunnel frames
+	wsEcho(t, ws, big, "/chat:"+big)
+
+	// regular requests keep flowing next to the websocket
+	res, err := http.Get(env.wstunURL + "/_token/" + env.token + "/refuse")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a plain request, got %d", res.StatusCode)
+	}
+	wsEcho(t, ws, "still there", "/chat:still there")
+
+	// the header based route works too
+	h := http.Header{}
+	h.Set("X-Token", env.token)
+	ws2, _, err := websocket.DefaultDialer.Dial(wsBase+"/other", h)
+	if err != nil {
+		t.Fatalf("Dial with X-Token failed: %v", err)
+	}
+	defer func() { _ = ws2.Close() }()
+	wsEcho(t, ws2, "hi", "/other:hi")
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	testWebsocketUpgrade(t, false)
+}
+
+func TestWebsocketUpgradeInternal(t *testing.T) {
+	testWebsocketUpgrade(t, true)
+}
+
+func TestWebsocketUpgradeRefused(t *testing.T) {
+	env := setupTunnelTest(t, echoWebsocket(), false)
+	wsBase := "ws" + strings.TrimPrefix(env.wstunURL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsBase+"/_token/"+env.token+"/refuse", nil)
+	if err == nil {
+		t.Fatal("Expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the backend's 403, got %v", resp)
+	}
+
+	// the tunnel is still usable afterwards
+	ws, _, err := websocket.DefaultDialer.Dial(wsBase+"/_token/"+env.token+"/after", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	wsEcho(t, ws, "ok", "/after:ok")
+}
+
+// TestWebsocketUpgradeClosedByBackend checks that the caller sees the websocket close when
+// the backend ends it
+func TestWebsocketUpgradeClosedByBackend(t *testing.T) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	env := setupTunnelTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = ws.WriteMessage(websocket.TextMessage, []byte("bye"))
+		_ = ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"), time.Now().Add(time.Second))
+		_ = ws.Close()
+	}), false)
+	wsBase := "ws" + strings.TrimPrefix(env.wstunURL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsBase+"/_token/"+env.token+"/x", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := ws.ReadMessage()
+	if err != nil || string(msg) != "bye" {
+		t.Fatalf("Expected bye, got %q %v", msg, err)
+	}
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected a normal close, got %v", err)
+	}
+}
+
+// TestWebsocketUpgradeV1Client checks that websockets are refused for clients that can't
+// relay them
+func TestWebsocketUpgradeV1Client(t *testing.T) {
+	env := setupTunnelServer(t, http.NotFoundHandler())
+	h := http.Header{}
+	h.Set("Origin", env.token)
+	tun, _, err := websocket.DefaultDialer.Dial(env.wsURL+"/_tunnel", h)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = tun.Close() }()
+
+	wsBase := "ws" + strings.TrimPrefix(env.wstunURL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(wsBase+"/_token/"+env.token+"/x", nil)
+	if err == nil {
+		t.Fatal("Expected the handshake to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %v", resp)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+// Write scheduling on the client.
+//
+// Everything the client sends on a websocket goes through the connection's writeQueue and is
+// written by a single goroutine, writeLoop. Senders hand over one frame at a time and wait for
+// it to be written, so the queue holds at most one frame per stream. When several are
+// pending, control frames go first, then frames that start or end a message, then data frames
+// of the stream that has sent the least so far. A large response thus moves forward in
+// chunks in between everything else, and a small response started in the middle of it goes
+// out right away instead of after it.
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errWriteQueueClosed is returned for writes submitted after the websocket went away
+var errWriteQueueClosed = errors.New("tunnel websocket closed")
+
+// Write priorities, lower goes first
+const (
+	priorityControl = iota // ping acks and control messages
+	priorityMessage        // headers, end and error frames
+	priorityData           // data frames and version 1 messages
+)
+
+// writeItem is one write waiting for its turn
+type writeItem struct {
+	priority int
+	id       uint32                      // stream the write belongs to
+	size     int                         // bytes accounted to the stream
+	last     bool                        // whether this ends the stream
+	write    func(*websocket.Conn) error // performs the write
+	seq      uint64                      // submission order
+	done     chan error                  // receives the outcome of the write
+}
+
+// writeQueue orders the writes of a websocket
+type writeQueue struct {
+	mu        sync.Mutex
+	items     []*writeItem     // pending writes
+	sent      map[uint32]int64 // bytes written by streams in progress
+	seq       uint64           // last submission
+	ready     chan struct{}    // signalled when a write is submitted
+	closed    chan struct{}    // closed once nothing gets written anymore
+	closeOnce sync.Once
+}
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{
+		sent:   make(map[uint32]int64),
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// submit queues a write and waits for it to be done. Once the queue is closed, a write that
+// writeLoop hasn't taken yet fails while one it has taken is waited for, the caller may only
+// reuse what the write refers to after that.
+func (q *writeQueue) submit(it *writeItem) error {
+	it.done = make(chan error, 1)
+	q.mu.Lock()
+	q.seq++
+	it.seq = q.seq
+	q.items = append(q.items, it)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	select {
+	case err := <-it.done:
+		return err
+	case <-q.closed:
+		if q.remove(it) {
+			return errWriteQueueClosed
+		}
+		return <-it.done
+	}
+}
+
+// remove takes a write writeLoop hasn't taken yet off the queue, it returns false if the write
+// was taken
+func (q *writeQueue) remove(it *writeItem) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.items {
+		if other == it {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// next removes the write to perform next from the queue, nil if there is none
+func (q *writeQueue) next() *writeItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	best := -1
+	for i, it := range q.items {
+		if best < 0 || q.before(it, q.items[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	it := q.items[best]
+	q.items = append(q.items[:best], q.items[best+1:]...)
+	return it
+}
+
+// before returns whether a should be written before b
+func (q *writeQueue) before(a, b *writeItem) bool {
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	if a.priority == priorityData {
+		if sa, sb := q.sent[a.id], q.sent[b.id]; sa != sb {
+			return sa < sb
+		}
+	}
+	return a.seq < b.seq
+}
+
+// wrote accounts for a write that was performed
+func (q *writeQueue) wrote(it *writeItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if it.last {
+		delete(q.sent, it.id)
+	} else if it.size > 0 {
+		q.sent[it.id] += int64(it.size)
+	}
+}
+
+// close makes pending and future writes fail
+func (q *writeQueue) close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// writeLoop performs the writes submitted to the connection's queue until it's closed
+func (wsc *WSConnection) writeLoop() {
+	q := wsc.queue
+	for {
+		select {
+		case <-q.ready:
+		case <-q.closed:
+			return
+		}
+		for it := q.next(); it != nil; it = q.next() {
+			err := it.write(wsc.ws)
+			if err != nil {
+				// the websocket is no good anymore, make the reader notice
+				if err := wsc.ws.Close(); err != nil {
+					wsc.Log.Error().Err(err).Msg("Failed to close websocket")
+				}
+			}
+			q.wrote(it)
+			it.done <- err
+		}
+	}
+}
+
+// framePriority returns the priority of a frame of type typ
+func framePriority(typ byte) int {
+	switch typ {
+	case frameData:
+		return priorityData
+	case frameHeaders, frameEnd, frameError:
+		return priorityMessage
+	default:
+		return priorityControl
+	}
+}
+
+// Write a single version 2 frame to the websocket
+func (wsc *WSConnection) writeFrame(typ, flags byte, id uint32, payload []byte) error {
+	return wsc.queue.submit(&writeItem{
+		priority: framePriority(typ),
+		id:       id,
+		size:     len(payload),
+		last:     typ == frameEnd || typ == frameError,
+		write: func(ws *websocket.Conn) error {
+			if err := ws.SetWriteDeadline(time.Time{}); err != nil {
+				return err
+			}
+			setWriteCompression(ws, wsc.tun.CompressionThreshold, frameHeaderLen+len(payload))
+			w, err := ws.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				return err
+			}
+			if err := writeFrameTo(wsc.traffic.writer(w), typ, flags, id, payload); err != nil {
+				return err
+			}
+			return w.Close()
+		},
+	})
+}
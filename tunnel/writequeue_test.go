@@ -0,0 +1,132 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWriteQueueOrder(t *testing.T) {
+	q := newWriteQueue()
+	q.sent[1] = 1024 * 1024 // a large response well under way
+	q.sent[2] = 100         // a small one that just started
+	add := func(priority int, id uint32) *writeItem {
+		q.seq++
+		it := &writeItem{priority: priority, id: id, seq: q.seq}
+		q.items = append(q.items, it)
+		return it
+	}
+	big := add(priorityData, 1)
+	small := add(priorityData, 2)
+	headers := add(priorityMessage, 3)
+	ping := add(priorityControl, 0)
+	big2 := add(priorityData, 4)
+	big2.id = 1 // same stream as big, submitted later
+
+	expected := []*writeItem{ping, headers, small, big, big2}
+	for i, want := range expected {
+		if got := q.next(); got != want {
+			t.Fatalf("Write %d: expected item for stream %d priority %d, got stream %d priority %d",
+				i, want.id, want.priority, got.id, got.priority)
+		}
+	}
+	if q.next() != nil {
+		t.Error("Expected the queue to be empty")
+	}
+}
+
+func TestWriteQueueAccounting(t *testing.T) {
+	q := newWriteQueue()
+	q.wrote(&writeItem{id: 5, size: 300})
+	q.wrote(&writeItem{id: 5, size: 200})
+	if q.sent[5] != 500 {
+		t.Errorf("Expected 500 bytes sent, got %d", q.sent[5])
+	}
+	q.wrote(&writeItem{id: 5, last: true})
+	if _, ok := q.sent[5]; ok {
+		t.Error("Expected a finished stream to be forgotten")
+	}
+}
+
+func TestWriteQueueClosed(t *testing.T) {
+	q := newWriteQueue()
+	q.close()
+	if err := q.submit(&writeItem{}); err != errWriteQueueClosed {
+		t.Errorf("Expected errWriteQueueClosed, got %v", err)
+	}
+}
+
+// TestWriteQueueClosedWhileWriting checks that a write being performed when the queue closes is
+// waited for, and one that is still queued is dropped
+func TestWriteQueueClosedWhileWriting(t *testing.T) {
+	q := newWriteQueue()
+	submitted := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { submitted <- q.submit(&writeItem{}) }()
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		n := len(q.items)
+		q.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("Writes not queued")
+		}
+	}
+	// writeLoop takes a write and is still performing it
+	it := q.next()
+	q.close()
+	if err := <-submitted; err != errWriteQueueClosed {
+		t.Errorf("Expected the queued write to fail, got %v", err)
+	}
+	if len(q.items) != 0 {
+		t.Errorf("Expected the queued write to be dropped, %d left", len(q.items))
+	}
+	select {
+	case err := <-submitted:
+		t.Fatalf("Write returned while being performed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	it.done <- nil
+	if err := <-submitted; err != nil {
+		t.Errorf("Expected the write performed to succeed, got %v", err)
+	}
+}
+
+// TestSmallResponseOvertakesLargeOne checks that a short response isn't held up by a large
+// one being sent at the same time
+func TestSmallResponseOvertakesLargeOne(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	env := setupTunnelTest(t, bigBackend(size), false, "-max-response-buffer", "134217728")
+
+	big := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(env.wstunURL + "/_token/" + env.token + "/big")
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		big <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		getFast(t, env)
+	}
+	select {
+	case err := <-big:
+		if err != nil {
+			t.Fatalf("Large response failed: %v", err)
+		}
+		t.Log("Large response finished before the small ones, nothing was measured")
+	default:
+	}
+	if err := <-big; err != nil {
+		t.Errorf("Large response failed: %v", err)
+	}
+}
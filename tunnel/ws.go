@@ -12,7 +12,10 @@ import (
 	"html"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	// imported per documentation - https://golang.org/pkg/net/http/pprof/
 	_ "net/http/pprof"
@@ -51,6 +54,21 @@ func (w *safeResponseWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
+// Unwrap gives http.ResponseController access to the underlying ResponseWriter
+func (w *safeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements http.Flusher so streamed responses can be pushed out to the caller
+func (w *safeResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // safeError is a safer replacement for http.Error that sets headers before WriteHeader
 func safeError(w http.ResponseWriter, error string, code int) {
 	// Wrap the response writer if it's not already wrapped
@@ -70,6 +88,141 @@ const minWriteDeadline = 5 * time.Second
 
 func wsp(ws *websocket.Conn) string { return fmt.Sprintf("%p", ws) }
 
+// remoteConn is the server end of a single tunnel websocket
+type remoteConn struct {
+	ws         *websocket.Conn
+	version    int        // negotiated protocol version
+	writeMutex sync.Mutex // serializes writers, v2 requests are streamed concurrently
+	// version 1 only carries 15-bit ids, requests in flight are mapped to their real id
+	legacyIDs    map[int16]uint32
+	lastLegacyID int16
+	legacyMutex  sync.Mutex
+	// version 2 flow control, nil when the peer doesn't do it
+	sendWin *sendWindows // what the client lets us send
+	recvWin *recvWindows // what we let the client send
+	// compression
+	threshold int            // size below which messages aren't compressed
+	traffic   *tunnelTraffic // bytes carried by the websocket
+	// pooling
+	pool         string        // client pool the websocket belongs to, if any
+	active       chan struct{} // closed once the websocket may get requests
+	activateOnce sync.Once
+	session      string // client session, "" if its requests can't be resumed
+	id           string // identifies the websocket to the client for resumption
+	client       string // identifies the client the websocket belongs to, see clientKey
+	// registry, see connections.go
+	addr          string       // address of the client
+	clientVersion string       // version of the client
+	connectedAt   time.Time    // when the websocket connected
+	served        atomic.Int64 // requests sent on the websocket
+	rtt           atomic.Int64 // last round-trip time to the client in nanoseconds
+	// load balancing, see balance.go
+	queue    chan *remoteRequest // requests assigned to the websocket
+	draining bool                // set once the websocket doesn't get requests anymore, protected by wsMutex
+	weight   int                 // share of the requests the client wants
+	priority int                 // clients with the lowest priority get the requests
+}
+
+// writeDeadline returns the websocket write deadline to use for a request. It is at least
+// minWriteDeadline to avoid killing the shared WebSocket when a near-expired request's
+// tight deadline triggers a write timeout.
+func writeDeadline(deadline time.Time) time.Time {
+	if time.Until(deadline) < minWriteDeadline {
+		return time.Now().Add(minWriteDeadline)
+	}
+	return deadline
+}
+
+// legacyID allocates the version 1 id under which a request is sent
+func (rc *remoteConn) legacyID(id uint32) int16 {
+	rc.legacyMutex.Lock()
+	defer rc.legacyMutex.Unlock()
+	if rc.legacyIDs == nil {
+		rc.legacyIDs = make(map[int16]uint32)
+	}
+	for i := 0; i < 32000; i++ {
+		rc.lastLegacyID = (rc.lastLegacyID + 1) % 32000
+		if _, used := rc.legacyIDs[rc.lastLegacyID]; !used {
+			break
+		}
+	}
+	rc.legacyIDs[rc.lastLegacyID] = id
+	return rc.lastLegacyID
+}
+
+// requestID returns the real id of a request sent with a version 1 id and forgets the mapping
+func (rc *remoteConn) requestID(legacyID int16) (uint32, bool) {
+	rc.legacyMutex.Lock()
+	defer rc.legacyMutex.Unlock()
+	id, ok := rc.legacyIDs[legacyID]
+	delete(rc.legacyIDs, legacyID)
+	return id, ok
+}
+
+// writeMessage writes a complete version 1 message to the websocket
+func (rc *remoteConn) writeMessage(id uint32, msg []byte, deadline time.Time) error {
+	rc.writeMutex.Lock()
+	defer rc.writeMutex.Unlock()
+	if err := rc.ws.SetWriteDeadline(writeDeadline(deadline)); err != nil {
+		return err
+	}
+	setWriteCompression(rc.ws, rc.threshold, len(msg))
+	mw, err := rc.ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	w := rc.traffic.writer(mw)
+	// write the request Id
+	if _, err = fmt.Fprintf(w, "%04x", rc.legacyID(id)); err != nil {
+		return err
+	}
+	// write the request itself
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// writeFrame writes a single version 2 frame to the websocket, on error the websocket is
+// closed so the reader notices and the tunnel gets torn down
+func (rc *remoteConn) writeFrame(typ, flags byte, id uint32, payload []byte, deadline time.Time) error {
+	rc.writeMutex.Lock()
+	defer rc.writeMutex.Unlock()
+	err := rc.ws.SetWriteDeadline(writeDeadline(deadline))
+	var w io.WriteCloser
+	if err == nil {
+		setWriteCompression(rc.ws, rc.threshold, frameHeaderLen+len(payload))
+		w, err = rc.ws.NextWriter(websocket.BinaryMessage)
+	}
+	if err == nil {
+		err = writeFrameTo(rc.traffic.writer(w), typ, flags, id, payload)
+		if err == nil {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		_ = rc.ws.Close()
+	}
+	return err
+}
+
+// streamSender returns the frame sender of a request's stream, it waits for flow control
+// credit while the caller is still around. The request counts as sent once its head is out.
+func (rc *remoteConn) streamSender(req *remoteRequest) func(typ byte, payload []byte) error {
+	return rc.sendWin.sendStream(req.id, req.httpReq.Context().Done(), func(typ byte, payload []byte) error {
+		err := rc.writeFrame(typ, 0, req.id, payload, req.deadline)
+		if err == nil && typ == frameHeaders {
+			req.sent.Store(true)
+		}
+		return err
+	})
+}
+
+// sendWindowUpdate hands credit for n bytes of stream id back to the client
+func (rc *remoteConn) sendWindowUpdate(id uint32, n int) error {
+	return rc.writeFrame(frameControl, 0, id, []byte(controlWindow+" "+strconv.Itoa(n)), time.Time{})
+}
+
 // Handler for websockets tunnel establishment requests
 func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 	addr := r.Header.Get("X-Forwarded-For")
@@ -145,28 +298,19 @@ func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check max clients per token limit and reserve quota before upgrade
+	pool := r.Header.Get(poolHeader)
 	var quotaReserved bool
 	if t.MaxClientsPerToken > 0 {
-		t.tokenClientsMutex.Lock()
-		currentClients := t.tokenClients[tokenStr]
-		if currentClients >= t.MaxClientsPerToken {
-			t.tokenClientsMutex.Unlock()
+		if !t.reserveClient(tokenStr, pool) {
 			httpError(t.Log, w, logTok, fmt.Sprintf("Maximum number of clients (%d) reached for this token", t.MaxClientsPerToken), 429)
 			return
 		}
-		t.tokenClients[tokenStr] = currentClients + 1
 		quotaReserved = true
-		t.tokenClientsMutex.Unlock()
 
 		// Set up rollback in case upgrade fails
 		defer func() {
 			if quotaReserved {
-				t.tokenClientsMutex.Lock()
-				t.tokenClients[tokenStr]--
-				if t.tokenClients[tokenStr] <= 0 {
-					delete(t.tokenClients, tokenStr)
-				}
-				t.tokenClientsMutex.Unlock()
+				t.releaseClient(tokenStr, pool)
 			}
 		}()
 	}
@@ -178,8 +322,65 @@ func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins for tunnel connections
 		},
+		EnableCompression: t.Compression,
+	}
+	// Pick the protocol version, clients that don't ask for one speak version 1
+	respHeader := http.Header{}
+	rc := &remoteConn{
+		version:   negotiateProtocol(r.Header),
+		threshold: t.CompressionThreshold,
+		traffic:   &tunnelTraffic{},
+		pool:      pool,
+		active:    make(chan struct{}),
 	}
-	ws, err := upgrader.Upgrade(w, r, nil)
+	rc.session = t.acceptSession(r.Header, rc.version)
+	rc.client = clientKey(rc)
+	rc.weight, rc.priority = parseBalanceHeaders(r.Header)
+	// Make sure the websocket belongs to the client that claimed the token, a claim made now
+	// hands the client the secret to present on its other websockets
+	claim, err := t.claimToken(tokenStr, r.Header.Get(claimHeader), rc.client, addr)
+	if err != nil {
+		t.Log.Info().Str("token", logTok).Str("addr", addr).Str("err", err.Error()).Msg("WS new tunnel connection rejected")
+		httpError(t.Log, w, logTok, "Token claimed by another client", 403)
+		return
+	}
+	if claim != nil {
+		respHeader.Set(claimHeader, claim.secret)
+	}
+	// Drop the claim if the websocket doesn't come up
+	defer func() {
+		if claim != nil {
+			t.releaseClaim(tokenStr, claim)
+		}
+	}()
+	if !t.admitClient(tokenStr, rc, addr) {
+		t.Log.Info().Str("token", logTok).Str("addr", addr).Str("err", "Token in use by another client").Msg("WS new tunnel connection rejected")
+		httpError(t.Log, w, logTok, "Token in use by another client", 409)
+		return
+	}
+	admitted := true
+	defer func() {
+		if admitted {
+			t.dismissClient(tokenStr, rc)
+		}
+	}()
+	spare := isSpare(r.Header, rc.version)
+	if !spare {
+		rc.activate()
+	}
+	if rc.version > protocolV1 {
+		respHeader.Set(protocolHeader, strconv.Itoa(rc.version))
+		// hold each other to the flow control windows
+		setWindowHeader(respHeader, t.StreamWindow, t.ConnWindow)
+		rc.sendWin = newSendWindows(parseWindowHeader(r.Header))
+		rc.recvWin = newRecvWindows(t.StreamWindow, t.ConnWindow, rc.sendWindowUpdate)
+	}
+	rc.id = strconv.FormatUint(t.lastConnID.Add(1), 10)
+	if rc.session != "" {
+		respHeader.Set(sessionHeader, rc.session)
+		respHeader.Set(connHeader, rc.id)
+	}
+	ws, err := upgrader.Upgrade(&trafficHijacker{ResponseWriter: w, tt: rc.traffic}, r, respHeader)
 	if err != nil {
 		if _, ok := err.(websocket.HandshakeError); ok {
 			t.Log.Info().Str("token", logTok).Str("addr", addr).Str("err", "Not a websocket handshake").Msg("WS new tunnel connection rejected")
@@ -191,16 +392,26 @@ func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Upgrade successful, don't rollback quota
+	// Upgrade successful, don't rollback quota, admission or claim
 	quotaReserved = false
+	admitted = false
+	if claim != nil {
+		t.confirmClaim(tokenStr, claim, addr)
+		claim = nil
+	}
 	// Get/Create RemoteServer
 	rs := t.getRemoteServer(tokenStr, true)
-	rs.remoteAddr = addr
-	rs.lastActivity = time.Now()
+	rs.setRemoteAddr(addr)
+	rs.touch()
+	compressed := t.Compression && compressionNegotiated(r.Header)
+	rs.compressed.Store(compressed)
+	rc.traffic.total = &rs.traffic
+	rc.queue = make(chan *remoteRequest, cap(rs.requestQueue))
 	// Extract and store client version from header
 	clientVersion := r.Header.Get("X-Client-Version")
 	rs.setClientVersion(clientVersion)
-	t.Log.Info().Str("token", logTok).Str("addr", addr).Str("ws", wsp(ws)).Str("client_version", clientVersion).Msg("WS new tunnel connection")
+	rc.addr, rc.clientVersion, rc.connectedAt = addr, clientVersion, time.Now()
+	t.Log.Info().Str("token", logTok).Str("addr", addr).Str("ws", wsp(ws)).Str("client_version", clientVersion).Int("protocol", rc.version).Bool("compression", compressed).Bool("spare", spare).Bool("resumable", rc.session != "").Msg("WS new tunnel connection")
 	if as := t.getAdminService(); as != nil {
 		if err := as.RecordTunnelEvent(context.Background(), string(tokenStr), TunnelEventConnected, addr, "", "", clientVersion, ""); err != nil {
 			t.Log.Warn().Err(err).Msg("Failed to record tunnel connect event")
@@ -208,20 +419,25 @@ func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 	}
 	// do reverse DNS lookup asynchronously
 	go func() {
-		name, whois := ipAddrLookup(t.Log, rs.remoteAddr)
+		name, whois := ipAddrLookup(t.Log, addr)
 		rs.setRemoteInfo(name, whois)
 	}()
 	// Start timeout handling
-	wsSetPingHandler(t, ws, rs)
+	rc.ws = ws
+	wsSetPingHandler(t, rc, rs)
+	rs.wsUp(rc)
+	rc.probeRTT()
+	t.takeOver(rs, rc, addr)
 	// Create synchronization channel
 	ch := make(chan int, 2)
 	// Spawn goroutine to read responses
-	go wsReader(t, rs, ws, ch, tokenStr, addr)
+	go wsReader(t, rs, rc, ch, tokenStr, addr)
 	// Send requests
-	wsWriter(rs, ws, ch)
+	wsWriter(rs, rc, ch)
 }
 
-func wsSetPingHandler(t *WSTunnelServer, ws *websocket.Conn, rs *remoteServer) {
+func wsSetPingHandler(t *WSTunnelServer, rc *remoteConn, rs *remoteServer) {
+	ws := rc.ws
 	// timeout handler sends a close message, waits a few seconds, then kills the socket
 	timeout := func() {
 		if err := ws.WriteControl(websocket.CloseMessage, nil, time.Now().Add(1*time.Second)); err != nil {
@@ -243,23 +459,43 @@ func wsSetPingHandler(t *WSTunnelServer, ws *websocket.Conn, rs *remoteServer) {
 			return err
 		}
 		// update lastActivity
-		rs.lastActivity = time.Now()
+		rs.touch()
+		rc.probeRTT()
 		return nil
 	}
 	ws.SetPingHandler(ph)
+	ws.SetPongHandler(rc.pong)
 }
 
 // Pick requests off the RemoteServer queue and send them into the tunnel
-func wsWriter(rs *remoteServer, ws *websocket.Conn, ch chan int) {
+func wsWriter(rs *remoteServer, rc *remoteConn, ch chan int) {
+	ws := rc.ws
 	var req *remoteRequest
 	var err error
+	// a spare websocket doesn't get requests until the client activates it
+	select {
+	case <-rc.active:
+	case <-ch:
+		rs.log.Info().Str("ws", wsp(ws)).Msg("WS closing spare on signal")
+		if err := ws.Close(); err != nil {
+			rs.log.Error().Err(err).Msg("Failed to close websocket")
+		}
+		return
+	}
 	for {
 		// fetch a request
 		select {
 		case req = <-rs.requestQueue:
-			// awesome...
+			if rs.balanced(req) {
+				// queued while no client could take it, its policy picks the websocket now
+				rs.requeue(req)
+				continue
+			}
+		case req = <-rc.queue:
+			// assigned to us by the balancing policy
 		case <-ch:
 			// time to close shop
+			rs.undispatch(rc)
 			rs.log.Info().Str("ws", wsp(ws)).Msg("WS closing on signal")
 			if err := ws.Close(); err != nil {
 				rs.log.Error().Err(err).Msg("Failed to close websocket")
@@ -274,40 +510,29 @@ func wsWriter(rs *remoteServer, ws *websocket.Conn, ch chan int) {
 			req.log.Info().Float64("ago", time.Since(req.deadline).Seconds()).Msg("WS   SND timeout before sending")
 			continue
 		}
-		// Use at least minWriteDeadline to avoid killing the shared WebSocket
-		// when a near-expired request's tight deadline triggers a write timeout
-		writeDeadline := req.deadline
-		if remaining := time.Until(writeDeadline); remaining < minWriteDeadline {
-			writeDeadline = time.Now().Add(minWriteDeadline)
+		if req.upgrade && rc.version < protocolV2 {
+			req.replyChan <- responseBuffer{err: errUpgradeUnsupported}
+			req.log.Info().Msg("WS   SND websocket upgrade not supported by client")
+			continue
 		}
-		if err = ws.SetWriteDeadline(writeDeadline); err != nil {
-			rs.log.Error().Err(err).Msg("Failed to set write deadline")
-			break // Break out of write loop on error
+		rs.requestSetMutex.Lock()
+		req.conn = rc
+		rs.requestSetMutex.Unlock()
+		rc.served.Add(1)
+		if rc.version >= protocolV2 {
+			// the body is pulled from the caller as it is sent, don't hold up other requests
+			go streamRequest(rc, req)
+			continue
 		}
-		var w io.WriteCloser
-		w, err = ws.NextWriter(websocket.BinaryMessage)
 		// got an error, reply with a "hey, retry" to the request handler
-		if err != nil {
-			break
-		}
-		// write the request Id
-		_, err = fmt.Fprintf(w, "%04x", req.id)
-		if err != nil {
-			break
-		}
-		// write the request itself
-		_, err = req.buffer.WriteTo(w)
-		if err != nil {
-			break
-		}
-		// done
-		err = w.Close()
-		if err != nil {
+		if err = rc.writeMessage(req.id, req.serialized(), req.deadline); err != nil {
 			break
 		}
+		req.sent.Store(true)
 		req.log.Info().Str("info", req.info).Msg("WS   SND")
 	}
-	// tell the sender to retry the request
+	// tell the sender to retry the request, elsewhere
+	rs.undispatch(rc)
 	req.replyChan <- responseBuffer{err: ErrRetry}
 	req.log.Info().Msg("WS error causes retry")
 	// close up shop
@@ -320,16 +545,100 @@ func wsWriter(rs *remoteServer, ws *websocket.Conn, ch chan int) {
 	}
 }
 
+// requestBody hands the caller's request body to a streamed request. It flushes what has
+// been written so far before each read, and for "Expect: 100-continue" requests it doesn't
+// touch the body (which would make net/http send the 100 to the caller) until the client
+// reports that the local server wants it.
+type requestBody struct {
+	body  io.Reader
+	fw    *frameWriter
+	wait  <-chan struct{} // closed when the body may be read, nil once it may
+	abort <-chan struct{} // closed when the caller's request is done
+	read  *atomic.Bool    // set once some of the body has been consumed
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if err := b.fw.Flush(); err != nil {
+		return 0, err
+	}
+	if b.wait != nil {
+		select {
+		case <-b.wait:
+			b.wait = nil
+		case <-b.abort:
+			return 0, errors.New("request finished before its body was requested")
+		}
+	}
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.read.Store(true)
+	}
+	return n, err
+}
+
+// Close leaves the body alone, net/http closes it when the handler returns
+func (b *requestBody) Close() error { return nil }
+
+// streamRequest sends a request through the tunnel as a sequence of frames, pulling the body
+// from the caller as it goes. Failures are reported to the request handler: a request that
+// didn't reach the client can be retried, one whose body broke off half way fails. A request
+// that reached the client without a body to send is left to wsReader, its response may still
+// come back on another websocket.
+func streamRequest(rc *remoteConn, req *remoteRequest) {
+	r := req.httpReq
+	fw := newFrameWriter(rc.streamSender(req))
+	out := new(http.Request)
+	*out = *r
+	out.Header = req.tunnelHeader()
+	var body *requestBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &requestBody{body: r.Body, fw: fw, abort: r.Context().Done(), read: &req.bodyRead}
+		if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+			body.wait = req.continued
+		}
+		out.Body = body
+	}
+
+	var closeErr error
+	if err := out.Write(fw); err != nil && fw.err == nil {
+		// couldn't get the body from the caller, make sure the client doesn't use a
+		// truncated request
+		req.log.Info().Err(err).Msg("WS   SND request aborted")
+		closeErr = fw.Abort(err)
+	} else if req.upgrade {
+		// the stream stays open to carry the connection once it's upgraded
+		closeErr = fw.Flush()
+	} else {
+		closeErr = fw.Close()
+	}
+	switch {
+	case closeErr != nil && !req.sent.Load():
+		req.log.Info().Err(closeErr).Msg("WS error causes retry")
+		req.replyChan <- responseBuffer{err: ErrRetry}
+	case closeErr != nil && req.bodyRead.Load():
+		req.log.Info().Err(closeErr).Msg("WS error while sending request body")
+		req.replyChan <- responseBuffer{err: errors.New("tunnel broke while sending request body")}
+	case closeErr != nil:
+		req.log.Info().Err(closeErr).Msg("WS error after the request reached the client")
+	default:
+		req.log.Info().Str("info", req.info).Msg("WS   SND")
+	}
+}
+
 // Read responses from the tunnel and fulfill pending requests
-func wsReader(t *WSTunnelServer, rs *remoteServer, ws *websocket.Conn, ch chan int, tokenStr token, remoteAddr string) {
+func wsReader(t *WSTunnelServer, rs *remoteServer, rc *remoteConn, ch chan int, tokenStr token, remoteAddr string) {
 	var err error
+	ws := rc.ws
 	logToken := cutToken(rs.token)
 
-	// the mutex remains locked unless we are within Cond.Wait()
-	rs.readCond.L.Lock()
+	// responses currently coming in on this websocket, they are buffered for the request
+	// handlers so that a slow caller never holds up reading the next message
+	streams := make(map[uint32]*streamWriter)
 	defer func() {
-		rs.readCond.L.Unlock()
-		rs.readCond.Signal()
+		for _, pw := range streams {
+			_ = pw.CloseWithError(errors.New("tunnel websocket closed"))
+		}
+		rc.sendWin.close()
 	}()
 
 	// continue reading until we get an error
@@ -345,34 +654,51 @@ func wsReader(t *WSTunnelServer, rs *remoteServer, ws *websocket.Conn, ch chan i
 		if err != nil {
 			break
 		}
+		r = rc.traffic.reader(r)
 		if t != websocket.BinaryMessage {
 			err = fmt.Errorf("non-binary message received, type=%d", t)
 			break
 		}
+		if rc.version >= protocolV2 {
+			if err = rc.readFrame(rs, r, streams); err != nil {
+				break
+			}
+			continue
+		}
 		// get request id
-		var id int16
-		_, err = fmt.Fscanf(io.LimitReader(r, 4), "%04x", &id)
+		var legacyID int16
+		_, err = fmt.Fscanf(io.LimitReader(r, 4), "%04x", &legacyID)
 		if err != nil {
 			break
 		}
 		// try to match request
 		rs.requestSetMutex.Lock()
-		req := rs.requestSet[id]
-		rs.lastActivity = time.Now()
+		var req *remoteRequest
+		id, ok := rc.requestID(legacyID)
+		if ok {
+			req = rs.requestSet[id]
+		}
 		rs.requestSetMutex.Unlock()
+		rs.touch()
 		// let's see...
-		if req != nil {
-			rb := responseBuffer{response: r}
-			// try to enqueue response
-			select {
-			case req.replyChan <- rb:
-				rs.log.Info().Int16("id", id).Str("ws", wsp(ws)).Msg("WS   RCV enqueued response")
-				rs.readCond.Wait() // wait for response to be sent
-			default:
-				rs.log.Info().Int16("id", id).Str("ws", wsp(ws)).Msg("WS   RCV can't enqueue response")
+		if req == nil {
+			rs.log.Info().Int16("id", legacyID).Str("ws", wsp(ws)).Msg("WS   RCV orphan response")
+			continue
+		}
+		// try to enqueue response, a slow caller holds up the websocket as it's the only
+		// response on it
+		pr, pw := newBlockingPipe(rs.responseBuffer)
+		select {
+		case req.replyChan <- responseBuffer{response: pr}:
+			rs.log.Info().Uint32("id", id).Str("ws", wsp(ws)).Msg("WS   RCV enqueued response")
+			if _, err := io.Copy(pw, r); err != nil {
+				rs.log.Info().Uint32("id", id).Str("ws", wsp(ws)).Err(err).Msg("WS   RCV response abandoned")
+				_ = pw.CloseWithError(err)
+			} else {
+				_ = pw.Close()
 			}
-		} else {
-			rs.log.Info().Int16("id", id).Str("ws", wsp(ws)).Msg("WS   RCV orphan response")
+		default:
+			rs.log.Info().Uint32("id", id).Str("ws", wsp(ws)).Msg("WS   RCV can't enqueue response")
 		}
 	}
 	// print error message
@@ -381,6 +707,11 @@ func wsReader(t *WSTunnelServer, rs *remoteServer, ws *websocket.Conn, ch chan i
 	}
 	// close up shop
 	ch <- 0 // notify sender
+	// the requests in flight on this websocket won't get a response here anymore
+	rs.failRequests(rc, t.ResumeTimeout)
+	t.dismissClient(tokenStr, rc)
+	t.claimantGone(tokenStr, rs, rc)
+	rs.wsDown(rc)
 
 	if as := t.getAdminService(); as != nil {
 		details := ""
@@ -394,14 +725,7 @@ func wsReader(t *WSTunnelServer, rs *remoteServer, ws *websocket.Conn, ch chan i
 
 	// Cleanup: decrement client count for this token
 	if t.MaxClientsPerToken > 0 {
-		t.tokenClientsMutex.Lock()
-		if count, exists := t.tokenClients[tokenStr]; exists && count > 0 {
-			t.tokenClients[tokenStr] = count - 1
-			if t.tokenClients[tokenStr] == 0 {
-				delete(t.tokenClients, tokenStr)
-			}
-		}
-		t.tokenClientsMutex.Unlock()
+		t.releaseClient(tokenStr, rc.pool)
 	}
 
 	time.Sleep(2 * time.Second)
@@ -410,6 +734,118 @@ func wsReader(t *WSTunnelServer, rs *remoteServer, ws *websocket.Conn, ch chan i
 	}
 }
 
+// readFrame processes a version 2 frame read from the tunnel. Responses are pushed through a
+// streamPipe to the request handler, which reads the other end.
+func (rc *remoteConn) readFrame(rs *remoteServer, r io.Reader, streams map[uint32]*streamWriter) error {
+	typ, flags, id, err := readFrameHeader(r)
+	if err != nil {
+		return err
+	}
+	ws := rc.ws
+	// a response starting or failing here may be for a request sent on a websocket of the
+	// session that went away
+	req := rs.requestFor(rc, id, typ == frameHeaders || typ == frameError)
+	rs.touch()
+
+	switch typ {
+	case frameHeaders:
+		payload, _ := io.ReadAll(r)
+		if req == nil {
+			rs.log.Info().Uint32("id", id).Str("ws", wsp(ws)).Msg("WS   RCV orphan response")
+			rc.recvWin.release(id, len(payload), false)
+			return nil
+		}
+		pr, pw := rc.recvWin.newPipe(id, rs.responseBuffer)
+		select {
+		case req.replyChan <- responseBuffer{response: pr}:
+			rs.log.Info().Uint32("id", id).Str("ws", wsp(ws)).Msg("WS   RCV streaming response")
+			streams[id] = pw
+			rc.feedStream(rs, req, id, payload, streams)
+		default:
+			// the request handler already got its answer, stop the client from sending more
+			rs.log.Info().Uint32("id", id).Str("ws", wsp(ws)).Msg("WS   RCV can't enqueue response")
+			rc.recvWin.release(id, len(payload), false)
+			rs.cancelRequest(req)
+		}
+
+	case frameData, frameEnd:
+		payload, _ := io.ReadAll(r)
+		pw := streams[id]
+		switch {
+		case pw == nil:
+			rs.log.Debug().Uint32("id", id).Str("ws", wsp(ws)).Msg("WS   RCV orphan frame")
+			rc.recvWin.release(id, len(payload), false)
+		case typ == frameEnd:
+			_ = pw.Close()
+			delete(streams, id)
+		default:
+			rc.feedStream(rs, req, id, payload, streams)
+		}
+
+	case frameError:
+		reason, _ := io.ReadAll(r)
+		rs.log.Info().Uint32("id", id).Str("ws", wsp(ws)).Str("err", string(reason)).Msg("WS   RCV error")
+		if pw := streams[id]; pw != nil {
+			_ = pw.CloseWithError(fmt.Errorf("client error: %s", reason))
+			delete(streams, id)
+		} else if req != nil {
+			select {
+			case req.replyChan <- responseBuffer{err: fmt.Errorf("client error: %s", reason)}:
+			default:
+			}
+		}
+
+	case framePing:
+		if flags&flagAck == 0 {
+			payload, _ := io.ReadAll(r)
+			return rc.writeFrame(framePing, flagAck, id, payload, time.Time{})
+		}
+
+	case frameControl:
+		payload, _ := io.ReadAll(r)
+		name, value := parseControl(payload)
+		switch {
+		case name == controlContinue && req != nil:
+			// the client wants the body of a request
+			req.allowBody()
+		case name == controlWindow:
+			n, _ := strconv.Atoi(value)
+			rc.sendWin.grant(id, n)
+		case name == controlActivate:
+			rs.log.Info().Str("ws", wsp(ws)).Msg("WS   spare activated")
+			rc.activate()
+		case name == controlResume:
+			rs.resumeRequests(rc, value)
+		case name != controlContinue:
+			rs.log.Debug().Str("control", name).Str("ws", wsp(ws)).Msg("WS   RCV unknown control")
+		}
+
+	default:
+		rs.log.Debug().Str("type", frameName(typ)).Uint32("id", id).Str("ws", wsp(ws)).Msg("WS   RCV ignored frame")
+	}
+	return nil
+}
+
+// feedStream hands a piece of a response to its request handler. If the handler is gone or
+// can't keep up, the rest of the response is dropped.
+func (rc *remoteConn) feedStream(rs *remoteServer, req *remoteRequest, id uint32, payload []byte,
+	streams map[uint32]*streamWriter) {
+	if _, err := streams[id].Write(payload); err != nil {
+		rs.log.Info().Uint32("id", id).Str("ws", wsp(rc.ws)).Err(err).Msg("WS   RCV response abandoned")
+		rc.recvWin.release(id, len(payload), false)
+		delete(streams, id)
+		rs.abandonResponse(req, err)
+	}
+}
+
+// abandonResponse stops the client from sending the rest of a response that can't be
+// delivered because the caller fell too far behind
+func (rs *remoteServer) abandonResponse(req *remoteRequest, err error) {
+	if err == errStreamOverflow && req != nil {
+		rs.cancelRequest(req)
+	}
+}
+
 // constantTimeEquals performs a constant-time comparison of two strings to prevent timing attacks.
 // It hashes both inputs to fixed-size digests before comparing, preventing length leakage
 // that would occur with subtle.ConstantTimeCompare on variable-length inputs.
@@ -13,19 +13,19 @@
 // This client also sends periodic ping messages through the websocket and expects prompt
 // responses. If no response is received, it closes the websocket and opens a new one.
 //
-// The main limitation of this client is that responses have to go throught the same socket
-// that the requests arrived on. Thus, if the websocket dies while an HTTP request is in progress
-// it impossible for the response to travel on the next websocket, instead it will be dropped
-// on the floor. This should not be difficult to fix, though.
+// If the websocket dies while an HTTP request is in progress, the response travels back on
+// another websocket of the client's session, see resume.go. With version 1 servers, or servers
+// that don't resume requests, it is dropped on the floor instead.
 //
-// Another limitation is that it keeps a single websocket open and can thus get stuck for
-// many seconds until the timeout on the websocket hits and a new one is opened.
+// To limit how long it can get stuck when a websocket dies, it spreads requests across a pool
+// of websockets and keeps spare ones open to take over right away, see pool.go.
 
 package tunnel
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"os"
@@ -54,40 +54,75 @@ import (
 )
 
 // WSTunnelClient represents a persistent tunnel that can cycle through many websockets. The
-// fields in this struct are relatively static/constant. The conn field points to the latest
-// websocket, but it's important to realize that there may be goroutines handling older
-// websockets that are not fully closed yet running at any point in time
+// fields in this struct are relatively static/constant. The pool field tracks the websockets
+// that are open and the conn field points to the latest active one, but it's important to
+// realize that there may be goroutines handling older websockets that are not fully closed
+// yet running at any point in time
 type WSTunnelClient struct {
-	Token          string         // Rendez-vous token
-	Password       string         // Optional password for token authentication
-	Tunnel         *url.URL       // websocket server to connect to (ws[s]://hostname:port)
-	Server         string         // local HTTP(S) server to send received requests to (default server)
-	InternalServer http.Handler   // internal Server to dispatch HTTP requests to
-	Regexp         *regexp.Regexp // regexp for allowed local HTTP(S) servers
-	Insecure       bool           // accept self-signed SSL certs from local HTTPS servers
-	Cert           string         // accept provided certificate from local HTTPS servers
-	Timeout        time.Duration  // timeout on websocket
-	Proxy          *url.URL       // if non-nil, external proxy to use
-	Log            zerolog.Logger // logger with "pkg=WStuncli"
-	StatusFd       *os.File       // output periodic tunnel status information
-	Connected      bool           // true when we have an active connection to wstunsrv
-	connMutex      sync.RWMutex   // protects Connected field
-	exitChan       chan struct{}  // channel to tell the tunnel goroutines to end
-	conn           *WSConnection
-	ClientPorts    []int              // array of ports for client to listen on.
-	connManager    *ConnectionManager // connection manager for retry logic
+	Token                string         // Rendez-vous token
+	Password             string         // Optional password for token authentication
+	Tunnel               *url.URL       // websocket server to connect to (ws[s]://hostname:port)
+	Server               string         // local HTTP(S) server to send received requests to (default server)
+	InternalServer       http.Handler   // internal Server to dispatch HTTP requests to
+	Regexp               *regexp.Regexp // regexp for allowed local HTTP(S) servers
+	Insecure             bool           // accept self-signed SSL certs from local HTTPS servers
+	Cert                 string         // accept provided certificate from local HTTPS servers
+	Timeout              time.Duration  // timeout on websocket
+	Proxy                *url.URL       // if non-nil, external proxy to use
+	Log                  zerolog.Logger // logger with "pkg=WStuncli"
+	StatusFd             *os.File       // output periodic tunnel status information
+	Connected            bool           // true when we have an active connection to wstunsrv
+	connMutex            sync.RWMutex   // protects Connected and conn fields
+	conn                 *WSConnection
+	ClientPorts          []int         // array of ports for client to listen on.
+	StreamWindow         int           // flow control window per request, 0 to turn flow control off
+	ConnWindow           int           // flow control window per websocket
+	Compression          bool          // ask for compressed websockets
+	CompressionThreshold int           // size below which messages aren't compressed
+	traffic              tunnelTraffic // bytes carried by all websockets
+	Websockets           int           // websockets requests are spread across
+	SpareWebsockets      int           // websockets kept open to replace those that die
+	pool                 *wsPool       // websockets currently open
+	session              string        // identifies the client to the server across websockets
+	ClaimFile            string        // file the secret of the token's claim is kept in, see claim.go
+	claim                *clientClaim  // secret the server bound the token to
+	Weight               int           // share of the token's requests the client asks for, see balance.go
+	Priority             int           // clients with the lowest priority get the token's requests on failover
+	// how requests are sent to local servers, see backend.go
+	BackendProtocol         string        // http1, h2 or h2c
+	BackendDialTimeout      time.Duration // timeout to connect to a local server, TLS handshake included
+	BackendHeaderTimeout    time.Duration // timeout for the response head once a request is sent, 0 for none
+	BackendKeepAlive        time.Duration // TCP keep-alive period of local server connections, 0 to turn it off
+	BackendIdleTimeout      time.Duration // how long idle local server connections are kept
+	BackendIdleConns        int           // idle local server connections kept, 0 for no limit
+	BackendIdleConnsPerHost int           // idle connections kept per local server
+	// version 2 requests in flight, cancelled when the server cancels them
+	requests      map[uint32]clientRequest
+	requestsMutex sync.Mutex
+	tlsConfig     *tls.Config        // TLS settings for the server and local servers
+	connManager   *ConnectionManager // connection manager for retry logic
+	httpClient    http.Client        // client used for all requests, gets special transport for -insecure
+	h2Client      http.Client        // client used for gRPC calls, over HTTP/2 only
+	upgradeClient http.Client        // client used for websocket handshakes, over HTTP/1.1
 	//ws             *websocket.Conn // websocket connection
 }
 
 // WSConnection represents a single websocket connection
 type WSConnection struct {
-	Log zerolog.Logger  // logger with "ws=0x1234"
-	ws  *websocket.Conn // websocket connection
-	tun *WSTunnelClient // link back to tunnel
+	Log     zerolog.Logger  // logger with "ws=0x1234"
+	ws      *websocket.Conn // websocket connection
+	tun     *WSTunnelClient // link back to tunnel
+	version int             // negotiated protocol version
+	queue   *writeQueue     // writes waiting for the writer goroutine
+	sendWin *sendWindows    // what the server lets us send, nil without flow control
+	recvWin *recvWindows    // what we let the server send, nil without flow control
+	traffic *tunnelTraffic  // bytes carried by the websocket
+	// whether the server takes responses to requests that came in on this websocket over
+	// other websockets of the session, and the id it gave the websocket for that
+	resumable bool
+	connID    string
 }
 
-var httpClient http.Client // client used for all requests, gets special transport for -insecure
-
 // IsConnected returns true if the client has an active connection to wstunsrv
 func (t *WSTunnelClient) IsConnected() bool {
 	t.connMutex.RLock()
@@ -95,6 +130,13 @@ func (t *WSTunnelClient) IsConnected() bool {
 	return t.Connected
 }
 
+// setConn records the latest active websocket
+func (t *WSTunnelClient) setConn(wsc *WSConnection) {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	t.conn = wsc
+}
+
 // setConnected sets the connection status
 func (t *WSTunnelClient) setConnected(connected bool) {
 	t.connMutex.Lock()
@@ -130,6 +172,38 @@ func NewWSTunnelClient(args []string) *WSTunnelClient {
 	cliFlag.StringVar(&wstunCli.Cert, "certfile", "", "path for trusted certificate in PEM-encoded format")
 	var logLevel = cliFlag.String("log-level", "info", "log level (debug, info, warn, error)")
 	var logPretty = cliFlag.Bool("log-pretty", false, "use human-readable console log output")
+	cliFlag.IntVar(&wstunCli.StreamWindow, "stream-window", defaultStreamWindow,
+		"bytes the server may send on a request before the local server consumes them, 0 to turn flow control off")
+	cliFlag.IntVar(&wstunCli.ConnWindow, "conn-window", defaultConnWindow,
+		"bytes the server may send across all requests before the local server consumes them, bounds the memory used per tunnel")
+	cliFlag.IntVar(&wstunCli.Websockets, "websockets", 1,
+		"number of websockets requests are spread across")
+	cliFlag.IntVar(&wstunCli.SpareWebsockets, "spare-websockets", 0,
+		"number of idle websockets kept open to take over from websockets that die")
+	cliFlag.StringVar(&wstunCli.BackendProtocol, "backend-protocol", backendHTTP1,
+		"protocol to speak to local servers: http1, h2 (HTTP/2 negotiated over TLS) or h2c (HTTP/2 only, without TLS for http:// servers)")
+	var backendDial = cliFlag.Int("backend-dial-timeout", defaultBackendDialTimeout,
+		"timeout in seconds to connect to a local server, TLS handshake included")
+	var backendHeader = cliFlag.Int("backend-header-timeout", 0,
+		"timeout in seconds for a local server to start responding once it got a request, 0 for none")
+	var backendKeepAlive = cliFlag.Int("backend-keepalive", defaultBackendKeepAlive,
+		"TCP keep-alive period in seconds of local server connections, 0 to turn keep-alives off")
+	var backendIdle = cliFlag.Int("backend-idle-timeout", defaultBackendIdleTimeout,
+		"seconds an idle local server connection is kept for reuse")
+	cliFlag.IntVar(&wstunCli.BackendIdleConns, "backend-idle-conns", defaultBackendIdleConns,
+		"maximum number of idle local server connections kept for reuse, 0 for no limit")
+	cliFlag.IntVar(&wstunCli.BackendIdleConnsPerHost, "backend-idle-conns-per-host", defaultBackendIdleConnsPer,
+		"maximum number of idle connections kept for reuse per local server")
+	cliFlag.StringVar(&wstunCli.ClaimFile, "claim-file", "",
+		"file to keep the secret in that servers which bind tokens to a client hand out, to keep the claim across restarts")
+	cliFlag.IntVar(&wstunCli.Weight, "weight", 1,
+		"share of the token's requests this client gets relative to its other clients, on servers that balance by weight")
+	cliFlag.IntVar(&wstunCli.Priority, "priority", 0,
+		"clients with a higher priority stand by until those with a lower one are gone, on servers that balance with failover")
+	cliFlag.BoolVar(&wstunCli.Compression, "compression", false,
+		"compress the tunnel websocket (permessage-deflate) if the server agrees to it")
+	cliFlag.IntVar(&wstunCli.CompressionThreshold, "compression-threshold", defaultCompressionThreshold,
+		"size in bytes below which tunnel messages aren't compressed")
 
 	// Bootstrap logger for pre-flag-parse errors. Uses stderr directly since
 	// LogPretty is not yet available (flags haven't been parsed).
@@ -157,6 +231,18 @@ func NewWSTunnelClient(args []string) *WSTunnelClient {
 	zerolog.SetGlobalLevel(level)
 
 	wstunCli.Timeout = calcWsTimeout(wstunCli.Log, *tout)
+	wstunCli.StreamWindow, wstunCli.ConnWindow = validateWindows(wstunCli.StreamWindow, wstunCli.ConnWindow)
+	if wstunCli.Websockets < 1 {
+		wstunCli.Log.Warn().Int("websockets", wstunCli.Websockets).Msg("Need at least one websocket, using 1")
+		wstunCli.Websockets = 1
+	}
+	if wstunCli.SpareWebsockets < 0 {
+		wstunCli.SpareWebsockets = 0
+	}
+	wstunCli.BackendDialTimeout = time.Duration(*backendDial) * time.Second
+	wstunCli.BackendHeaderTimeout = time.Duration(*backendHeader) * time.Second
+	wstunCli.BackendKeepAlive = time.Duration(*backendKeepAlive) * time.Second
+	wstunCli.BackendIdleTimeout = time.Duration(*backendIdle) * time.Second
 
 	// Parse token:password format
 	if *tokenArg != "" {
@@ -287,6 +373,7 @@ func (t *WSTunnelClient) Start() error {
 	}
 
 	tlsClientConfig := tls.Config{}
+	t.tlsConfig = &tlsClientConfig
 	if t.Insecure {
 		t.Log.Info().Msg("Accepting unverified SSL certs from local HTTPS servers")
 		tlsClientConfig.InsecureSkipVerify = t.Insecure
@@ -309,10 +396,8 @@ func (t *WSTunnelClient) Start() error {
 		t.Log.Info().Msg("Explicitly accepting provided SSL certificate")
 		tlsClientConfig.RootCAs = rootCAs
 	}
-	httpClient = http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tlsClientConfig,
-		},
+	if err := t.setupBackendClients(&tlsClientConfig); err != nil {
+		return err
 	}
 
 	if t.InternalServer != nil {
@@ -331,105 +416,120 @@ func (t *WSTunnelClient) Start() error {
 		t.Log.Info().Str("url", t.Proxy.Host).Str("user", username).Msg("Using HTTPS proxy")
 	}
 
-	// for test purposes we have a signal that tells wstuncli to exit instead of reopening
-	// a fresh connection.
-	t.exitChan = make(chan struct{}, 1)
+	// Keep the pool of websockets open to tunnel requests, they all belong to the session
+	if t.session == "" {
+		t.session = randomID()
+	}
+	t.claim = newClientClaim(t.ClaimFile, t.Log)
+	t.pool = newWSPool(t.Websockets)
+	for i := 0; i < t.Websockets+t.SpareWebsockets; i++ {
+		go t.keepWebsocket()
+	}
 
-	//===== Goroutine =====
+	return nil
+}
 
-	// Keep opening websocket connections to tunnel requests
-	go func() {
-		for {
-			d := &websocket.Dialer{
-				NetDial:         t.wsProxyDialer,
-				ReadBufferSize:  wsBufferSize,
-				WriteBufferSize: wsBufferSize,
-				TLSClientConfig: &tlsClientConfig,
-			}
-			h := make(http.Header)
-			h.Add("Origin", t.Token)
-			// Add client version header
-			h.Add("X-Client-Version", VV)
-			// Add Authorization header for token password if provided
-			if t.Password != "" {
-				credentials := t.Token + ":" + t.Password
-				encoded := base64.StdEncoding.EncodeToString([]byte(credentials))
-				h.Add("Authorization", "Basic "+encoded)
-			}
+// openWebsocket opens a websocket to the server, a spare if asked to. It returns nil if that
+// fails.
+func (t *WSTunnelClient) openWebsocket(spare bool) *WSConnection {
+	traffic := &tunnelTraffic{total: &t.traffic}
+	d := &websocket.Dialer{
+		NetDial:           traffic.dialer(t.wsProxyDialer),
+		ReadBufferSize:    wsBufferSize,
+		WriteBufferSize:   wsBufferSize,
+		TLSClientConfig:   t.tlsConfig,
+		EnableCompression: t.Compression,
+	}
+	h := make(http.Header)
+	h.Add("Origin", t.Token)
+	// Add client version header
+	h.Add("X-Client-Version", VV)
+	// Advertise the highest protocol version we speak and the windows we grant
+	h.Add(protocolHeader, strconv.Itoa(protocolMax))
+	setWindowHeader(h, t.StreamWindow, t.ConnWindow)
+	// Tell which pool and session the websocket belongs to
+	h.Add(poolHeader, t.pool.id)
+	h.Add(sessionHeader, t.session)
+	secret, claimed := t.claim.handshake()
+	if secret != "" {
+		h.Add(claimHeader, secret)
+	}
+	h.Add(weightHeader, strconv.Itoa(t.Weight))
+	h.Add(priorityHeader, strconv.Itoa(t.Priority))
+	if spare {
+		h.Add(spareHeader, "1")
+	}
+	// Add Authorization header for token password if provided
+	if t.Password != "" {
+		credentials := t.Token + ":" + t.Password
+		encoded := base64.StdEncoding.EncodeToString([]byte(credentials))
+		h.Add("Authorization", "Basic "+encoded)
+	}
 
-			// Also add tunnel URL-based auth if present (supports dual authentication)
-			if auth := proxyAuth(t.Tunnel); auth != "" {
-				// If we already have token auth, this becomes secondary auth
-				// Some servers may use both for different purposes
-				if t.Password == "" {
-					// No token password, so this is primary auth
-					h.Add("Authorization", auth)
-				} else {
-					// We already have Authorization header for token auth
-					// Add URL auth as a custom header that server can check if needed
-					h.Add("X-Tunnel-Authorization", auth)
-				}
-			}
-			url := fmt.Sprintf("%s://%s/_tunnel", t.Tunnel.Scheme, t.Tunnel.Host)
-			timer := time.NewTimer(10 * time.Second)
-			t.Log.Info().Str("url", url).Msg("WS   Opening")
-			ws, resp, err := d.Dial(url, h)
-			if err != nil {
-				extra := ""
-				if resp != nil {
-					extra = resp.Status
-					buf := make([]byte, 80)
-					n, err := resp.Body.Read(buf)
-					if err != nil && err != io.EOF {
-						t.Log.Error().Err(err).Msg("Failed to read response body")
-						return
-					}
-					if len(buf) > 0 {
-						extra = extra + " -- " + string(buf[:n])
-					}
-					if err := resp.Body.Close(); err != nil {
-						t.Log.Error().Err(err).Msg("Failed to close response body")
-					}
-				}
-				t.Log.Error().Err(err).Str("info", extra).Msg("Error opening connection")
-			} else {
-				t.conn = &WSConnection{ws: ws, tun: t,
-					Log: t.Log.With().Str("ws", fmt.Sprintf("%p", ws)).Logger()}
-				// Safety setting
-				ws.SetReadLimit(100 * 1024 * 1024)
-				// Request Loop
-				srv := t.Server
-				if t.InternalServer != nil {
-					srv = "<internal>"
-				}
-				t.conn.Log.Info().Str("server", srv).Msg("WS   ready")
-				t.setConnected(true)
-				t.conn.handleRequests()
-				t.setConnected(false)
+	// Also add tunnel URL-based auth if present (supports dual authentication)
+	if auth := proxyAuth(t.Tunnel); auth != "" {
+		// If we already have token auth, this becomes secondary auth
+		// Some servers may use both for different purposes
+		if t.Password == "" {
+			// No token password, so this is primary auth
+			h.Add("Authorization", auth)
+		} else {
+			// We already have Authorization header for token auth
+			// Add URL auth as a custom header that server can check if needed
+			h.Add("X-Tunnel-Authorization", auth)
+		}
+	}
+	url := fmt.Sprintf("%s://%s/_tunnel", t.Tunnel.Scheme, t.Tunnel.Host)
+	t.Log.Info().Str("url", url).Bool("spare", spare).Msg("WS   Opening")
+	ws, resp, err := d.Dial(url, h)
+	if err != nil {
+		claimed(nil)
+		extra := ""
+		if resp != nil {
+			extra = resp.Status
+			buf := make([]byte, 80)
+			n, err := resp.Body.Read(buf)
+			if err != nil && err != io.EOF {
+				t.Log.Error().Err(err).Msg("Failed to read response body")
 			}
-			// check whether we need to exit
-			exitLoop := false
-			select {
-			case <-t.exitChan:
-				exitLoop = true
-			default: // non-blocking receive
+			if n > 0 {
+				extra = extra + " -- " + string(buf[:n])
 			}
-			if exitLoop {
-				break
+			if err := resp.Body.Close(); err != nil {
+				t.Log.Error().Err(err).Msg("Failed to close response body")
 			}
-
-			<-timer.C // ensure we don't open connections too rapidly
 		}
-	}()
-
-	return nil
+		t.Log.Error().Err(err).Str("info", extra).Msg("Error opening connection")
+		return nil
+	}
+	claimed(resp)
+	wsc := &WSConnection{ws: ws, tun: t,
+		Log:       t.Log.With().Str("ws", fmt.Sprintf("%p", ws)).Logger(),
+		version:   negotiateProtocol(resp.Header),
+		queue:     newWriteQueue(),
+		traffic:   traffic,
+		resumable: resp.Header.Get(sessionHeader) == t.session,
+		connID:    resp.Header.Get(connHeader)}
+	wsc.setupFlowControl(resp.Header)
+	// Safety setting
+	ws.SetReadLimit(100 * 1024 * 1024)
+	srv := t.Server
+	if t.InternalServer != nil {
+		srv = "<internal>"
+	}
+	wsc.Log.Info().Str("server", srv).Int("protocol", wsc.version).Bool("spare", spare).
+		Bool("compression", compressionNegotiated(resp.Header)).Bool("resumable", wsc.resumable).Msg("WS   ready")
+	return wsc
 }
 
 // Stop closes the wstunnel channel
 func (t *WSTunnelClient) Stop() {
-	t.exitChan <- struct{}{}
-	if t.conn != nil && t.conn.ws != nil {
-		if err := t.conn.ws.Close(); err != nil {
+	if t.pool == nil {
+		return
+	}
+	t.pool.close()
+	for _, wsc := range t.pool.all() {
+		if err := wsc.ws.Close(); err != nil {
 			t.Log.Error().Err(err).Msg("Failed to close websocket")
 		}
 	}
@@ -438,21 +538,52 @@ func (t *WSTunnelClient) Stop() {
 // Main function to handle WS requests: it reads a request from the socket, then forks
 // a goroutine to perform the actual http request and return the result
 func (wsc *WSConnection) handleRequests() {
+	go wsc.writeLoop()
 	go wsc.pinger()
+	// bodies of streamed requests that are still being received, they are buffered so that
+	// a local server that is slow to read one doesn't hold up the others
+	streams := make(map[uint32]*streamWriter)
+	defer func() {
+		for _, pw := range streams {
+			_ = pw.CloseWithError(errors.New("tunnel websocket closed"))
+		}
+		wsc.sendWin.close()
+		if wsc.resumable {
+			// the responses go back on another websocket
+			go wsc.reportResume()
+		} else {
+			// nobody is left to take the responses
+			wsc.abandonRequests()
+		}
+	}()
 	for {
 		if err := wsc.ws.SetReadDeadline(time.Time{}); err != nil {
 			wsc.Log.Error().Err(err).Msg("Failed to set read deadline")
 			return
 		}
 		typ, r, err := wsc.ws.NextReader()
+		if websocket.IsCloseError(err, closeTakenOver) {
+			// reconnecting would take the token back from the client that took it over
+			wsc.Log.Error().Err(err).Msg("WS   tunnel taken over by another client, not reconnecting")
+			wsc.tun.pool.close()
+			break
+		}
 		if err != nil {
 			wsc.Log.Info().Err(err).Msg("WS   ReadMessage")
 			break
 		}
+		r = wsc.traffic.reader(r)
 		if typ != websocket.BinaryMessage {
 			wsc.Log.Warn().Int("type", int(typ)).Msg("WS   invalid message type")
 			break
 		}
+		if wsc.version >= protocolV2 {
+			if err := wsc.readFrame(streams, r); err != nil {
+				wsc.Log.Warn().Err(err).Msg("WS   cannot read frame")
+				break
+			}
+			continue
+		}
 		// read request id
 		var id int16
 		_, err = fmt.Fscanf(io.LimitReader(r, 4), "%04x", &id)
@@ -481,11 +612,16 @@ func (wsc *WSConnection) handleRequests() {
 			break
 		}
 		// Hand off to goroutine to finish off while we read the next request
-		if wsc.tun.InternalServer != nil {
-			go wsc.finishInternalRequest(id, req)
-		} else {
-			go wsc.finishRequest(id, req)
-		}
+		ctx, cancel := context.WithCancel(context.Background())
+		req = req.WithContext(withTunnelTimeout(ctx, req.Header))
+		go func() {
+			defer cancel()
+			if wsc.tun.InternalServer != nil {
+				wsc.finishInternalRequest(uint32(id), req)
+			} else {
+				wsc.finishRequest(uint32(id), req)
+			}
+		}()
 	}
 	// delay a few seconds to allow for writes to drain and then force-close the socket
 	go func() {
@@ -493,9 +629,142 @@ func (wsc *WSConnection) handleRequests() {
 		if err := wsc.ws.Close(); err != nil {
 			wsc.Log.Error().Err(err).Msg("Failed to close websocket")
 		}
+		wsc.queue.close()
 	}()
 }
 
+// readFrame processes a version 2 frame. A headers frame starts the request in a goroutine,
+// reading its body from a streamPipe that subsequent frames are fed into.
+func (wsc *WSConnection) readFrame(streams map[uint32]*streamWriter, r io.Reader) error {
+	typ, flags, id, err := readFrameHeader(r)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case frameHeaders:
+		if old := streams[id]; old != nil {
+			_ = old.CloseWithError(errors.New("request superseded"))
+		}
+		pr, pw := wsc.recvWin.newPipe(id, defaultStreamBuffer)
+		streams[id] = pw
+		go wsc.startStreamedRequest(wsc.startRequest(id), id, pr)
+
+	case frameData, frameEnd:
+		if streams[id] == nil {
+			wsc.Log.Debug().Uint32("id", id).Str("type", frameName(typ)).Msg("WS   frame for unknown request")
+			payload, _ := io.ReadAll(r)
+			wsc.recvWin.release(id, len(payload), false)
+			return nil
+		}
+
+	case frameError, frameCancel:
+		// the request can't be completed, make its body fail
+		reason, _ := io.ReadAll(r)
+		wsc.Log.Info().Uint32("id", id).Str("type", frameName(typ)).Str("reason", string(reason)).Msg("WS   request aborted")
+		if pw := streams[id]; pw != nil {
+			_ = pw.CloseWithError(fmt.Errorf("request aborted by server: %s", reason))
+			delete(streams, id)
+		}
+		if typ == frameCancel {
+			// the caller is gone, stop working on it
+			wsc.releaseRequest(id)
+		}
+		return nil
+
+	case framePing:
+		if flags&flagAck == 0 {
+			payload, _ := io.ReadAll(r)
+			return wsc.writeFrame(framePing, flagAck, id, payload)
+		}
+		return nil
+
+	case frameControl:
+		payload, _ := io.ReadAll(r)
+		if name, value := parseControl(payload); name == controlWindow {
+			n, _ := strconv.Atoi(value)
+			wsc.sendWin.grant(id, n)
+		} else {
+			wsc.Log.Debug().Uint32("id", id).Str("control", name).Msg("WS   unknown control")
+		}
+		return nil
+
+	default:
+		wsc.Log.Debug().Uint32("id", id).Str("type", frameName(typ)).Msg("WS   ignored frame")
+		return nil
+	}
+
+	pw := streams[id]
+	payload, _ := io.ReadAll(r)
+	if _, err := pw.Write(payload); err != nil {
+		// the request has been finished without reading all of its body or is too slow to
+		// read it
+		wsc.Log.Debug().Uint32("id", id).Err(err).Msg("WS   request body abandoned")
+		wsc.recvWin.release(id, len(payload), false)
+		delete(streams, id)
+		return nil
+	}
+	if typ == frameEnd {
+		_ = pw.Close()
+		delete(streams, id)
+	}
+	return nil
+}
+
+// startStreamedRequest reads a request from the stream of its frames and issues it
+func (wsc *WSConnection) startStreamedRequest(ctx context.Context, id uint32, pr *streamReader) {
+	br := bufio.NewReader(pr)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		wsc.Log.Warn().Uint32("id", id).Err(err).Msg("WS   cannot read request")
+		_ = pr.CloseWithError(err)
+		wsc.releaseRequest(id)
+		return
+	}
+	// the deadline goes away with the request's context when it's released
+	req = req.WithContext(withTunnelTimeout(ctx, req.Header))
+	body := req.Body
+	if isUpgrade(req) {
+		// past the handshake the stream carries what the caller sends on the websocket
+		body = io.NopCloser(br)
+	}
+	req.Body = &streamedRequestBody{
+		ReadCloser:   body,
+		pr:           pr,
+		wantContinue: strings.EqualFold(req.Header.Get("Expect"), "100-continue"),
+		sendContinue: func() error { return wsc.writeFrame(frameControl, 0, id, []byte(controlContinue)) },
+	}
+	if wsc.tun.InternalServer != nil {
+		wsc.finishInternalRequest(id, req)
+	} else {
+		wsc.finishRequest(id, req)
+		_ = req.Body.Close()
+	}
+}
+
+// streamedRequestBody is the body of a request received as a sequence of frames. The first
+// read tells the server to send the body if it's holding it back for a 100-continue. Closing
+// the body discards the rest of it rather than waiting for it to arrive.
+type streamedRequestBody struct {
+	io.ReadCloser
+	pr           *streamReader
+	wantContinue bool
+	sendContinue func() error
+}
+
+func (b *streamedRequestBody) Read(p []byte) (int, error) {
+	if b.wantContinue {
+		b.wantContinue = false
+		if err := b.sendContinue(); err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func (b *streamedRequestBody) Close() error {
+	return b.pr.Close()
+}
+
 //===== Keep-alive ping-pong =====
 
 // Pinger that keeps connections alive and terminates them if they seem stuck
@@ -567,6 +836,9 @@ func (wsc *WSConnection) writeStatus() {
 	if _, err := fmt.Fprintf(wsc.tun.StatusFd, "Time: %s\n", time.Now().UTC().Format(time.RFC3339)); err != nil {
 		wsc.Log.Error().Err(err).Msg("Failed to write to status file")
 	}
+	if _, err := fmt.Fprintf(wsc.tun.StatusFd, "Traffic: %s\n", &wsc.tun.traffic); err != nil {
+		wsc.Log.Error().Err(err).Msg("Failed to write to status file")
+	}
 }
 
 func (t *WSTunnelClient) wsDialerLocalPort(network string, addr string, ports []int) (conn net.Conn, err error) {
@@ -682,8 +954,8 @@ var hopHeaders = []string{
 	"Keep-Alive",
 	"Proxy-Authenticate",
 	"Proxy-Authorization",
-	"Te", // canonicalized version of "TE"
-	"Trailers",
+	"Te",      // canonicalized version of "TE"
+	"Trailer", // the values travel in the request's Trailer field
 	"Transfer-Encoding",
 	"Upgrade",
 	"Host",
@@ -694,6 +966,13 @@ var hopHeaders = []string{
 type responseWriter struct {
 	resp *http.Response
 	buf  *bytes.Buffer
+
+	// streaming mode: the body goes into a pipe and started is closed once the
+	// handler has committed to a status code
+	pw       *io.PipeWriter
+	started  chan struct{}
+	once     sync.Once
+	hijacked net.Conn // tunnel end of a hijacked connection
 }
 
 func newResponseWriter(req *http.Request) *responseWriter {
@@ -714,20 +993,48 @@ func newResponseWriter(req *http.Request) *responseWriter {
 
 }
 
+// newStreamingResponseWriter creates a responseWriter whose body can be read while the
+// handler is still writing it
+func newStreamingResponseWriter(req *http.Request) *responseWriter {
+	rw := newResponseWriter(req)
+	pr, pw := io.Pipe()
+	rw.resp.Body = pr
+	rw.buf = nil
+	rw.pw = pw
+	rw.started = make(chan struct{})
+	return rw
+}
+
 func (rw *responseWriter) Write(buf []byte) (int, error) {
 	if rw.resp.StatusCode == -1 {
 		rw.WriteHeader(200)
 	}
+	if rw.pw != nil {
+		return rw.pw.Write(buf)
+	}
 	return rw.buf.Write(buf)
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
+	if rw.started != nil && rw.resp.StatusCode != -1 {
+		return // headers are already on their way
+	}
 	rw.resp.StatusCode = code
 	rw.resp.Status = http.StatusText(code)
+	if rw.started != nil {
+		rw.once.Do(func() { close(rw.started) })
+	}
 }
 
 func (rw *responseWriter) Header() http.Header { return rw.resp.Header }
 
+// Flush implements http.Flusher, in streaming mode writes are forwarded as they happen
+func (rw *responseWriter) Flush() {
+	if rw.resp.StatusCode == -1 {
+		rw.WriteHeader(200)
+	}
+}
+
 func (rw *responseWriter) finishResponse() error {
 	if rw.resp.StatusCode == -1 {
 		return fmt.Errorf("HTTP internal handler did not call Write or WriteHeader")
@@ -737,21 +1044,35 @@ func (rw *responseWriter) finishResponse() error {
 	return nil
 }
 
-//===== HTTP driver and response sender =====
+// closeStream ends the body of a streaming response and releases anyone waiting for
+// the handler to start responding
+func (rw *responseWriter) closeStream(err error) {
+	rw.once.Do(func() { close(rw.started) })
+	_ = rw.pw.CloseWithError(err)
+}
 
-var wsWriterMutex sync.Mutex // mutex to allow a single goroutine to send a response at a time
+//===== HTTP driver and response sender =====
 
 // Issue a request to an internal handler. This duplicates some logic found in
 // net.http.serve http://golang.org/src/net/http/server.go?#L1124 and
 // net.http.readRequest http://golang.org/src/net/http/server.go?#L
-func (wsc *WSConnection) finishInternalRequest(id int16, req *http.Request) {
-	log := wsc.Log.With().Int16("id", id).Str("verb", req.Method).Str("uri", req.RequestURI).Logger()
+func (wsc *WSConnection) finishInternalRequest(id uint32, req *http.Request) {
+	log := wsc.Log.With().Uint32("id", id).Str("verb", req.Method).Str("uri", req.RequestURI).Logger()
 	log.Info().Msg("HTTP issuing internal request")
 
 	// Remove hop-by-hop headers
+	upgrade := wsc.version >= protocolV2 && isUpgrade(req)
+	te := req.Header["Te"]
 	for _, h := range hopHeaders {
 		req.Header.Del(h)
 	}
+	keepTE(req.Header, te)
+	var stream io.ReadCloser
+	if upgrade {
+		// the handler gets the handshake, the body carries the websocket once it's accepted
+		keepUpgradeHeaders(req.Header)
+		stream, req.Body = req.Body, http.NoBody
+	}
 
 	// Add fake protocol version
 	req.Proto = "HTTP/1.0"
@@ -762,21 +1083,19 @@ func (wsc *WSConnection) finishInternalRequest(id int16, req *http.Request) {
 	dump, _ := httputil.DumpRequest(req, false)
 	log.Debug().Str("req", strings.ReplaceAll(string(dump), "\r\n", " || ")).Msg("dump")
 
-	// Make sure we don't die if a panic occurs in the handler
-	defer func() {
-		if err := recover(); err != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			log.Error().Interface("err", err).Str("stack", string(buf)).Msg("HTTP panic in handler")
-		}
-	}()
+	if wsc.version >= protocolV2 {
+		// the request is released once the handler is done
+		wsc.streamInternalRequest(log, id, req, stream)
+		return
+	}
 
 	// Concoct Response
 	rw := newResponseWriter(req)
 
 	// Issue the request to the HTTP server
-	wsc.tun.InternalServer.ServeHTTP(rw, req)
+	if !wsc.serveInternal(log, rw, req) {
+		return
+	}
 
 	err := rw.finishResponse()
 	if err != nil {
@@ -789,9 +1108,74 @@ func (wsc *WSConnection) finishInternalRequest(id int16, req *http.Request) {
 	wsc.writeResponseMessage(id, rw.resp)
 }
 
-func (wsc *WSConnection) finishRequest(id int16, req *http.Request) {
+// streamInternalRequest runs the internal handler concurrently and ships its response
+// through the tunnel as it gets written. stream is the websocket of an upgrade request, it is
+// relayed if the handler hijacks the connection.
+func (wsc *WSConnection) streamInternalRequest(log zerolog.Logger, id uint32, req *http.Request, stream io.ReadCloser) {
+	if stream != nil {
+		defer func() { _ = stream.Close() }()
+	}
+	rw := newStreamingResponseWriter(req)
+	go func() {
+		defer wsc.releaseRequest(id)
+		if !wsc.serveInternal(log, rw, req) {
+			rw.closeStream(errors.New("panic in internal handler"))
+			return
+		}
+		if rw.hijacked == nil && rw.resp.StatusCode == -1 {
+			// nothing was written, make it an empty 200 like net/http does
+			rw.WriteHeader(200)
+		}
+		rw.closeStream(nil)
+	}()
+	<-rw.started
+	if rw.hijacked != nil {
+		if stream == nil {
+			_ = rw.hijacked.Close()
+			return
+		}
+		// the handler writes the handshake response itself
+		log.Info().Msg("HTTP connection hijacked")
+		relay(rw.hijacked, newFrameWriter(wsc.streamSender(id, req.Context().Done())), stream)
+		return
+	}
+	if rw.resp.StatusCode == -1 {
+		return // the handler panicked before responding
+	}
+	liftDeadline(req.Context(), rw.resp)
+
+	log.Info().Int("status", rw.resp.StatusCode).Msg("HTTP responded")
+	wsc.writeResponseMessage(id, rw.resp)
+}
+
+// serveInternal calls the internal handler, it returns false if the handler panicked
+func (wsc *WSConnection) serveInternal(log zerolog.Logger, rw *responseWriter, req *http.Request) (ok bool) {
+	// like net/http, the request body is done with once the handler returns
+	defer func() {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+	}()
+	// Make sure we don't die if a panic occurs in the handler
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Error().Interface("err", err).Str("stack", string(buf)).Msg("HTTP panic in handler")
+			ok = false
+		}
+	}()
+
+	wsc.tun.InternalServer.ServeHTTP(rw, req)
+	return true
+}
+
+func (wsc *WSConnection) finishRequest(id uint32, req *http.Request) {
+	// the request's context gets cancelled if the server cancels it while we're at it
+	defer wsc.releaseRequest(id)
 
-	log := wsc.Log.With().Int16("id", id).Str("verb", req.Method).Str("uri", req.RequestURI).Logger()
+	log := wsc.Log.With().Uint32("id", id).Str("verb", req.Method).Str("uri", req.RequestURI).Logger()
 
 	// Honor X-Host header
 	host := wsc.tun.Server
@@ -833,80 +1217,154 @@ func (wsc *WSConnection) finishRequest(id int16, req *http.Request) {
 	log.Info().Str("url", req.URL.String()).Msg("HTTP issuing request")
 
 	// Remove hop-by-hop headers
+	upgrade := wsc.version >= protocolV2 && isUpgrade(req)
+	te := req.Header["Te"]
 	for _, h := range hopHeaders {
 		req.Header.Del(h)
 	}
+	keepTE(req.Header, te)
+	var stream io.ReadCloser
+	if upgrade {
+		// the handshake goes to the local server, the body carries the websocket once it's
+		// accepted
+		keepUpgradeHeaders(req.Header)
+		stream, req.Body = req.Body, http.NoBody
+		defer func() { _ = stream.Close() }()
+	}
 	// Issue the request to the HTTP server
 	dump, err := httputil.DumpRequest(req, false)
 	log.Debug().Str("req", strings.ReplaceAll(string(dump), "\r\n", " || ")).Msg("dump")
 	if err != nil {
 		log.Warn().Err(err).Msg("error dumping request")
 	}
-	resp, err := httpClient.Do(req)
+	resp, err := wsc.tun.backendClient(req, upgrade).Do(req)
+	if err != nil && req.Context().Err() != nil {
+		log.Info().Msg("HTTP request cancelled")
+		return
+	}
 	if err != nil {
 		log.Info().Err(err).Msg("HTTP request error")
 		wsc.writeResponseMessage(id, concoctResponse(req, err.Error(), 502))
 		return
 	}
 	log.Info().Str("status", resp.Status).Msg("HTTP responded")
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && upgrade && resp.StatusCode == http.StatusSwitchingProtocols {
+		// the transport hands us the upgraded connection, it needs closing if the server
+		// cancels the request
+		stop := context.AfterFunc(req.Context(), func() { _ = conn.Close() })
+		defer stop()
+		wsc.relayUpgradeResponse(id, resp, conn, stream)
+		log.Info().Msg("HTTP websocket closed")
+		return
+	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
 			log.Error().Err(err).Msg("Failed to close response body")
 		}
 	}()
+	asHTTP11(resp)
+	liftDeadline(req.Context(), resp)
+	if resp.Trailer == nil && resp.ContentLength < 0 {
+		// trailers the local server didn't announce get merged into this map by the body
+		resp.Trailer = make(http.Header)
+	}
 
 	wsc.writeResponseMessage(id, resp)
 }
 
 // Write the response message to the websocket
-func (wsc *WSConnection) writeResponseMessage(id int16, resp *http.Response) {
-	// Get writer's lock
-	wsWriterMutex.Lock()
-	defer wsWriterMutex.Unlock()
-	// Write response into the tunnel
-	if err := wsc.ws.SetWriteDeadline(time.Time{}); err != nil {
-		wsc.Log.Error().Err(err).Msg("Failed to set write deadline")
+func (wsc *WSConnection) writeResponseMessage(id uint32, resp *http.Response) {
+	if wsc.version >= protocolV2 {
+		wsc.writeResponseFrames(id, resp)
 		return
 	}
-	w, err := wsc.ws.NextWriter(websocket.BinaryMessage)
-	// got an error, reply with a "hey, retry" to the request handler
-	if err != nil {
-		wsc.Log.Warn().Err(err).Msg("WS   NextWriter")
-		if err := wsc.ws.Close(); err != nil {
-			wsc.Log.Error().Err(err).Msg("Failed to close websocket")
+	// Write response into the tunnel, as a single message it can't be interleaved with others
+	err := wsc.queue.submit(&writeItem{priority: priorityData, id: id, last: true, write: func(ws *websocket.Conn) error {
+		if err := ws.SetWriteDeadline(time.Time{}); err != nil {
+			wsc.Log.Error().Err(err).Msg("Failed to set write deadline")
+			return err
 		}
-		return
-	}
+		// the size of the response is only known in advance if it has a Content-Length
+		size := wsc.tun.CompressionThreshold
+		if resp.ContentLength >= 0 {
+			size = int(resp.ContentLength)
+		}
+		setWriteCompression(ws, wsc.tun.CompressionThreshold, size)
+		mw, err := ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			wsc.Log.Warn().Err(err).Msg("WS   NextWriter")
+			return err
+		}
+		w := wsc.traffic.writer(mw)
 
-	// write the request Id
-	_, err = fmt.Fprintf(w, "%04x", id)
-	if err != nil {
-		wsc.Log.Warn().Err(err).Msg("WS   cannot write request Id")
-		if err := wsc.ws.Close(); err != nil {
-			wsc.Log.Error().Err(err).Msg("Failed to close websocket")
+		// write the request Id
+		if _, err = fmt.Fprintf(w, "%04x", id); err != nil {
+			wsc.Log.Warn().Err(err).Msg("WS   cannot write request Id")
+			return err
 		}
-		return
-	}
 
-	// write the response itself
-	err = resp.Write(w)
-	if err != nil {
-		wsc.Log.Warn().Err(err).Msg("WS   cannot write response")
-		if err := wsc.ws.Close(); err != nil {
-			wsc.Log.Error().Err(err).Msg("Failed to close websocket")
+		// write the response itself
+		if err = resp.Write(w); err != nil {
+			wsc.Log.Warn().Err(err).Msg("WS   cannot write response")
+			return err
 		}
-		return
+
+		// done
+		if err = w.Close(); err != nil {
+			wsc.Log.Warn().Err(err).Msg("WS   write-close failed")
+		}
+		return err
+	}})
+	if err == errWriteQueueClosed {
+		wsc.Log.Warn().Uint32("id", id).Msg("WS   closed before the response could be sent")
 	}
+}
 
-	// done
-	err = w.Close()
+// Write the response to the websocket as a sequence of frames, each piece of the body is
+// sent as soon as the local server produces it
+func (wsc *WSConnection) writeResponseFrames(id uint32, resp *http.Response) {
+	var abort <-chan struct{}
+	if resp.Request != nil {
+		abort = resp.Request.Context().Done()
+	}
+	fw := newFrameWriter(wsc.responseSender(id, abort))
+	if resp.Body != nil {
+		resp.Body = &flushingBody{ReadCloser: resp.Body, fw: fw}
+	}
+	var err error
+	if err = resp.Write(fw); err != nil && fw.err == nil {
+		// the local server failed us half way, let the server know the response is incomplete
+		wsc.Log.Warn().Uint32("id", id).Err(err).Msg("WS   cannot write response")
+		err = fw.Abort(err)
+	} else {
+		err = fw.Close()
+	}
 	if err != nil {
-		wsc.Log.Warn().Err(err).Msg("WS   write-close failed")
-		if err := wsc.ws.Close(); err != nil {
-			wsc.Log.Error().Err(err).Msg("Failed to close websocket")
-		}
+		wsc.Log.Warn().Uint32("id", id).Err(err).Msg("WS   cannot finish response")
+	}
+}
+
+// streamSender returns the frame sender of the response to request id, it waits for flow
+// control credit until abort is closed
+func (wsc *WSConnection) streamSender(id uint32, abort <-chan struct{}) func(typ byte, payload []byte) error {
+	return wsc.sendWin.sendStream(id, abort, func(typ byte, payload []byte) error {
+		return wsc.writeFrame(typ, 0, id, payload)
+	})
+}
+
+// sendWindowUpdate hands credit for n bytes of request id back to the server
+func (wsc *WSConnection) sendWindowUpdate(id uint32, n int) error {
+	return wsc.writeFrame(frameControl, 0, id, []byte(controlWindow+" "+strconv.Itoa(n)))
+}
+
+// setupFlowControl holds both ends of a version 2 websocket to the flow control windows,
+// given the server's handshake response
+func (wsc *WSConnection) setupFlowControl(h http.Header) {
+	if wsc.version < protocolV2 {
 		return
 	}
+	wsc.sendWin = newSendWindows(parseWindowHeader(h))
+	wsc.recvWin = newRecvWindows(wsc.tun.StreamWindow, wsc.tun.ConnWindow, wsc.sendWindowUpdate)
 }
 
 // Create an http Response from scratch, there must be a better way that this but I
@@ -10,6 +10,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 
@@ -21,6 +22,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -30,6 +32,10 @@ import (
 // ErrRetry Error when sending request
 var ErrRetry = errors.New("error sending request, please retry")
 
+// errMaybeSent is returned for a request the tunnel broke off after sending it, the client may
+// or may not have got it
+var errMaybeSent = errors.New("tunnel broke after sending the request, please retry")
+
 // pkgLog is used by functions that don't have access to an instance logger.
 var pkgLog = zerolog.New(os.Stderr).With().Timestamp().Str("pkg", "tunnel").Logger()
 
@@ -55,32 +61,98 @@ type responseBuffer struct {
 
 // A request for a remote server
 type remoteRequest struct {
-	id         int16         // unique (scope=server) request id
-	info       string        // http method + uri for debug/logging
-	remoteAddr string        // remote address for debug/logging
-	buffer     *bytes.Buffer // request buffer to send
-	replyChan  chan responseBuffer
-	deadline   time.Time // timeout
-	startTime  time.Time // when the request started
-	log        zerolog.Logger
+	id           uint32        // unique (scope=server) request id, 0 until assigned
+	info         string        // http method + uri for debug/logging
+	remoteAddr   string        // remote address for debug/logging
+	httpReq      *http.Request // request to forward
+	buffer       *bytes.Buffer // serialized request, for clients that can't take chunked requests
+	replyChan    chan responseBuffer
+	deadline     time.Time     // timeout
+	startTime    time.Time     // when the request started
+	continued    chan struct{} // closed once the client asks for the body (Expect: 100-continue)
+	continueOnce sync.Once
+	upgrade      bool        // websocket request, the connection gets relayed once upgraded
+	idleStreams  bool        // streaming responses are held to an idle timeout, not the deadline
+	affinity     string      // sticky session the request belongs to, see sticky.go
+	conn         *remoteConn // connection the request was sent on, protected by requestSetMutex
+	sent         atomic.Bool // whether the request reached the client, at least its head
+	bodyRead     atomic.Bool // whether some of the body was consumed, it can't be replayed then
+	log          zerolog.Logger
+}
+
+// allowBody lets a streamed request send its body
+func (req *remoteRequest) allowBody() {
+	req.continueOnce.Do(func() { close(req.continued) })
+}
+
+// serialized returns the whole request in wire format. The request is only serialized once
+// so it can be resent when a request gets retried.
+func (req *remoteRequest) serialized() []byte {
+	if req.buffer == nil {
+		req.buffer = &bytes.Buffer{}
+		if req.httpReq != nil {
+			out := *req.httpReq
+			out.Header = req.tunnelHeader()
+			_ = out.Write(req.buffer)
+		}
+	}
+	return req.buffer.Bytes()
 }
 
 // A remote server
 type remoteServer struct {
-	token           token                    // rendez-vous token for debug/logging
-	lastID          int16                    // id of last request
-	lastActivity    time.Time                // last activity on tunnel
-	remoteAddr      string                   // last remote addr of tunnel (debug)
-	remoteName      string                   // reverse DNS resolution of remoteAddr
-	remoteWhois     string                   // whois lookup of remoteAddr
-	clientVersion   string                   // version of the connected client
-	infoMutex       sync.RWMutex             // mutex to protect remoteName, remoteWhois, clientVersion
-	requestQueue    chan *remoteRequest      // queue of requests to be sent
-	requestSet      map[int16]*remoteRequest // all requests in queue/flight indexed by ID
+	token           token                     // rendez-vous token for debug/logging
+	lastID          uint32                    // id of last request
+	lastActivity    time.Time                 // last activity on tunnel
+	remoteAddr      string                    // last remote addr of tunnel (debug)
+	remoteName      string                    // reverse DNS resolution of remoteAddr
+	remoteWhois     string                    // whois lookup of remoteAddr
+	clientVersion   string                    // version of the connected client
+	infoMutex       sync.RWMutex              // mutex to protect lastActivity, remoteAddr, remoteName, remoteWhois, clientVersion
+	requestQueue    chan *remoteRequest       // queue of requests to be sent
+	requestSet      map[uint32]*remoteRequest // all requests in queue/flight indexed by ID
 	requestSetMutex sync.Mutex
 	log             zerolog.Logger
-	readMutex       sync.Mutex // ensure that no more than one goroutine calls the websocket read methods concurrently
-	readCond        *sync.Cond // (NextReader, SetReadDeadline, SetPingHandler, ...)
+	responseBuffer  int                   // bytes of a response buffered for a slow caller
+	traffic         tunnelTraffic         // bytes carried by the tunnel's websockets
+	compressed      atomic.Bool           // whether the last tunnel websocket is compressed
+	wsMutex         sync.Mutex            // mutex to protect conns, downSince, reconnected
+	conns           map[*remoteConn]bool  // websockets of the tunnel currently connected
+	balance         string                // balancing policy of the tunnel, see balance.go
+	balanceState    balanceState          // protected by wsMutex
+	sticky          map[string]*stickyPin // clients sticky sessions are pinned to, protected by wsMutex
+	stickySwept     time.Time             // when expired pins were last forgotten
+	stickyTTL       time.Duration         // how long a pin lasts without requests
+	downSince       time.Time             // when the tunnel lost its last websocket
+	reconnected     chan struct{}         // closed when a websocket connects again, nil while one is
+}
+
+// touch records activity on the tunnel
+func (rs *remoteServer) touch() {
+	rs.infoMutex.Lock()
+	defer rs.infoMutex.Unlock()
+	rs.lastActivity = time.Now()
+}
+
+// getLastActivity safely gets the time of the last activity on the tunnel
+func (rs *remoteServer) getLastActivity() time.Time {
+	rs.infoMutex.RLock()
+	defer rs.infoMutex.RUnlock()
+	return rs.lastActivity
+}
+
+// setRemoteAddr safely sets the address of the latest tunnel websocket
+func (rs *remoteServer) setRemoteAddr(addr string) {
+	rs.infoMutex.Lock()
+	defer rs.infoMutex.Unlock()
+	rs.remoteAddr = addr
+}
+
+// getRemoteAddr safely gets the address of the latest tunnel websocket
+func (rs *remoteServer) getRemoteAddr() string {
+	rs.infoMutex.RLock()
+	defer rs.infoMutex.RUnlock()
+	return rs.remoteAddr
 }
 
 // setClientVersion safely sets the client version
@@ -97,6 +169,13 @@ func (rs *remoteServer) getClientVersion() string {
 	return rs.clientVersion
 }
 
+// getPendingRequests safely gets the number of requests in flight on the tunnel
+func (rs *remoteServer) getPendingRequests() int {
+	rs.requestSetMutex.Lock()
+	defer rs.requestSetMutex.Unlock()
+	return len(rs.requestSet)
+}
+
 // setRemoteInfo safely sets the remote name and whois information
 func (rs *remoteServer) setRemoteInfo(name, whois string) {
 	rs.infoMutex.Lock()
@@ -114,23 +193,55 @@ func (rs *remoteServer) getRemoteInfo() (name, whois string) {
 
 // WSTunnelServer a wstunnel server construct
 type WSTunnelServer struct {
-	Port                 int                     // port to listen on
-	Host                 string                  // host to listen on
-	BasePath             string                  // base path for routing (e.g., "/wstunnel")
-	WSTimeout            time.Duration           // timeout on websockets
-	HTTPTimeout          time.Duration           // timeout for HTTP requests
-	MaxRequestsPerTunnel int                     // max queued requests per tunnel
-	MaxClientsPerToken   int                     // max clients allowed per token
-	Log                  zerolog.Logger          // logger with "pkg=WStunsrv"
-	exitChan             chan struct{}           // channel to tell the tunnel goroutines to end
-	serverRegistry       map[token]*remoteServer // active remote servers indexed by token
-	serverRegistryMutex  sync.Mutex              // mutex to protect map
-	tokenPasswords       map[token]string        // optional passwords for tokens
-	tokenPasswordsMutex  sync.RWMutex            // mutex to protect password map
-	tokenClients         map[token]int           // track number of clients per token
-	tokenClientsMutex    sync.RWMutex            // mutex to protect client count map
-	adminService         *AdminService           // admin service for monitoring and auditing
-	adminServiceMutex    sync.RWMutex            // mutex to protect admin service access
+	Port                 int                      // port to listen on
+	Host                 string                   // host to listen on
+	BasePath             string                   // base path for routing (e.g., "/wstunnel")
+	WSTimeout            time.Duration            // timeout on websockets
+	HTTPTimeout          time.Duration            // timeout for HTTP requests
+	StreamIdleTimeout    time.Duration            // idle timeout for streaming responses, 0 to use HTTPTimeout
+	ResumeTimeout        time.Duration            // how long requests of a dead websocket wait to be resumed, 0 to fail them
+	MaxRequestsPerTunnel int                      // max queued requests per tunnel
+	MaxClientsPerToken   int                      // max clients allowed per token
+	MaxResponseBuffer    int                      // max bytes of a response buffered for a slow caller
+	StreamWindow         int                      // flow control window per stream, 0 to turn flow control off
+	ConnWindow           int                      // flow control window per tunnel websocket
+	Compression          bool                     // compress tunnel websockets of clients that agree to it
+	H2C                  bool                     // accept HTTP/2 without TLS, for gRPC callers
+	RetryMethods         map[string]bool          // methods of requests that are sent again when the tunnel breaks, idempotent ones if nil
+	RetryAttempts        int                      // attempts per request, the first one included, 3 if 0
+	RetryBackoff         time.Duration            // wait before the second attempt, doubled for each further one
+	ReconnectGrace       time.Duration            // how long requests wait for a disconnected client, 0 to wait until their deadline
+	HostMapFile          string                   // file routing aliases and custom domains to tokens
+	TunnelDomain         string                   // domain whose subdomains are tunnel aliases
+	RouteCookie          bool                     // route requests without a token by a cookie set on /_token/ requests
+	RouteCookieKey       string                   // key routing cookies are signed with, random if empty
+	TrustForwardedPrefix bool                     // keep the X-Forwarded-Prefix set by a proxy in front of the server
+	ClaimTimeout         time.Duration            // how long a token stays claimed once its client is gone, 0 for no claims
+	TokenPolicy          string                   // connection policy of tokens: shared, exclusive-reject or exclusive-takeover
+	TokenPolicies        map[token]string         // connection policies of given tokens
+	BalancePolicy        string                   // how requests are spread across the clients of a token
+	BalancePolicies      map[token]string         // balancing policies of given tokens
+	StickyCookie         bool                     // pin callers to a client with a session cookie
+	StickyHeader         string                   // pin callers to a client by the value of this header
+	StickyTTL            time.Duration            // how long a caller stays pinned without requests
+	CompressionThreshold int                      // size below which messages aren't compressed
+	Log                  zerolog.Logger           // logger with "pkg=WStunsrv"
+	exitChan             chan struct{}            // channel to tell the tunnel goroutines to end
+	serverRegistry       map[token]*remoteServer  // active remote servers indexed by token
+	serverRegistryMutex  sync.Mutex               // mutex to protect map
+	tokenPasswords       map[token]string         // optional passwords for tokens
+	tokenPasswordsMutex  sync.RWMutex             // mutex to protect password map
+	tokenClients         map[token]int            // track number of clients per token
+	poolSockets          map[token]map[string]int // websockets of the client pools of each token
+	exclusiveHolders     map[token]map[string]int // websockets of the client holding each exclusive-reject token
+	tokenClientsMutex    sync.RWMutex             // mutex to protect client count map
+	adminService         *AdminService            // admin service for monitoring and auditing
+	adminServiceMutex    sync.RWMutex             // mutex to protect admin service access
+	lastConnID           atomic.Uint64            // id of the last resumable tunnel websocket
+	hostRoutes           atomic.Pointer[hostMap]  // routes from the host map file
+	hostMapStop          chan struct{}            // closed to stop watching the host map file
+	routeCookieKey       []byte                   // key routing cookies are signed with
+	tokenClaims          tokenClaims              // clients the tokens are claimed by
 }
 
 func (t *WSTunnelServer) getAdminService() *AdminService {
@@ -194,10 +305,35 @@ func NewWSTunnelServer(args []string) *WSTunnelServer {
 	var logf = srvFlag.String("logfile", "", "path for log file")
 	var tout = srvFlag.Int("wstimeout", 30, "timeout on websocket in seconds")
 	var httpTout = srvFlag.Int("httptimeout", 20*60, "timeout for http requests in seconds")
+	var streamTout = srvFlag.Int("stream-idle-timeout", 5*60, "timeout in seconds between two pieces of a streaming response (SSE, chunked), 0 to apply httptimeout to the whole response")
+	var resumeTout = srvFlag.Int("resume-timeout", defaultResumeTimeout, "timeout in seconds for a client to send the response to a request on another websocket when the one it came in on dies, 0 to fail such requests right away")
 	var slog = srvFlag.String("syslog", "", "syslog facility to log to")
 	var whoTok = srvFlag.String("robowhois", "", "robowhois.com API token")
 	var tokenPass = srvFlag.String("passwords", "", "comma-separated list of token:password pairs")
 	srvFlag.IntVar(&wstunSrv.MaxRequestsPerTunnel, "max-requests-per-tunnel", defaultMaxReq, "maximum number of queued requests per tunnel (recommended: 10-100, max: 10000)")
+	srvFlag.IntVar(&wstunSrv.MaxResponseBuffer, "max-response-buffer", defaultStreamBuffer, "maximum number of bytes of a response buffered for a slow HTTP client before the response is aborted")
+	srvFlag.IntVar(&wstunSrv.StreamWindow, "stream-window", defaultStreamWindow, "bytes a tunnel client may send on a response before the HTTP client consumes them, 0 to turn flow control off")
+	srvFlag.IntVar(&wstunSrv.ConnWindow, "conn-window", defaultConnWindow, "bytes a tunnel client may send across all responses before HTTP clients consume them, bounds the memory used per tunnel")
+	srvFlag.BoolVar(&wstunSrv.Compression, "compression", false, "compress tunnel websockets (permessage-deflate) of clients that also ask for it")
+	srvFlag.IntVar(&wstunSrv.CompressionThreshold, "compression-threshold", defaultCompressionThreshold, "size in bytes below which tunnel messages aren't compressed")
+	srvFlag.BoolVar(&wstunSrv.H2C, "h2c", false, "accept HTTP/2 without TLS (h2c) next to HTTP/1.1, for gRPC calls")
+	var retryMethods = srvFlag.String("retry-methods", defaultRetryMethods, "comma-separated methods of requests that are sent again when the tunnel breaks while sending them, requests with an Idempotency-Key header always are")
+	srvFlag.IntVar(&wstunSrv.RetryAttempts, "retry-attempts", defaultRetryAttempts, "maximum number of attempts at sending a request through the tunnel, 1 to never retry")
+	var retryBackoff = srvFlag.Int("retry-backoff", defaultRetryBackoff, "milliseconds to wait before retrying a request, doubled for each further attempt")
+	srvFlag.StringVar(&wstunSrv.HostMapFile, "host-map", "", "file routing tunnel aliases and custom domains to tokens, reloaded when it changes")
+	srvFlag.StringVar(&wstunSrv.TunnelDomain, "tunnel-domain", "", "domain whose subdomains route to the tunnel aliases of the host map, e.g. tunnels.example.com")
+	srvFlag.BoolVar(&wstunSrv.RouteCookie, "route-cookie", false, "set a routing cookie on /_token/ requests and route requests without a token by it")
+	srvFlag.StringVar(&wstunSrv.RouteCookieKey, "route-cookie-key", "", "secret routing cookies are signed with, random on each start if empty")
+	srvFlag.BoolVar(&wstunSrv.TrustForwardedPrefix, "trust-forwarded-prefix", false, "keep the X-Forwarded-Prefix header of a proxy in front of the server in the one passed to the local server")
+	srvFlag.StringVar(&wstunSrv.TokenPolicy, "token-policy", policyShared, "what happens when a second client connects with a token: shared (both get requests), exclusive-reject (it's refused) or exclusive-takeover (the first one is closed)")
+	var tokenPolicies = srvFlag.String("token-policies", "", "comma-separated list of token:policy pairs overriding -token-policy")
+	srvFlag.StringVar(&wstunSrv.BalancePolicy, "balance", balanceFirstFree, "how requests are spread across the clients of a token: first-free, round-robin, least-pending, weighted or failover")
+	var balancePolicies = srvFlag.String("balance-policies", "", "comma-separated list of token:policy pairs overriding -balance")
+	srvFlag.BoolVar(&wstunSrv.StickyCookie, "sticky-cookie", false, "pin each caller to one client of a token with a session cookie")
+	srvFlag.StringVar(&wstunSrv.StickyHeader, "sticky-header", "", "pin callers to one client of a token by the value of this request header")
+	var stickyTTL = srvFlag.Int("sticky-ttl", int(defaultStickyTTL.Seconds()), "seconds a caller stays pinned to a client without sending requests")
+	var tokenClaim = srvFlag.Int("token-claim", 0, "bind each token to the first client that connects with it, for this many seconds after the client goes away (0 to let any client with the token connect)")
+	var reconnectGrace = srvFlag.Int("reconnect-grace", 0, "seconds requests wait for a client that lost its tunnel to reconnect before failing with a 503, 0 to wait until they time out")
 	srvFlag.IntVar(&wstunSrv.MaxClientsPerToken, "max-clients-per-token", 0, "maximum number of clients per token (0 for unlimited, recommended: 10-100, max: 10000)")
 	var logLevel = srvFlag.String("log-level", "info", "log level (debug, info, warn, error)")
 	var logPrettyFlag = srvFlag.Bool("log-pretty", false, "use human-readable console log output")
@@ -246,6 +382,40 @@ func NewWSTunnelServer(args []string) *WSTunnelServer {
 	} else if wstunSrv.MaxClientsPerToken > 1000 {
 		wstunSrv.Log.Warn().Int("value", wstunSrv.MaxClientsPerToken).Msg("max-clients-per-token is very high, may cause resource issues")
 	}
+	wstunSrv.RetryMethods = parseMethods(*retryMethods)
+	if wstunSrv.RetryAttempts < 1 {
+		wstunSrv.Log.Warn().Int("value", wstunSrv.RetryAttempts).Msg("retry-attempts must be at least 1, not retrying")
+		wstunSrv.RetryAttempts = 1
+	}
+	wstunSrv.RetryBackoff = time.Duration(max(*retryBackoff, 0)) * time.Millisecond
+	if !validPolicy(wstunSrv.TokenPolicy) {
+		wstunSrv.Log.Error().Str("policy", wstunSrv.TokenPolicy).Msg("Unknown token policy, tokens are shared")
+		wstunSrv.TokenPolicy = policyShared
+	}
+	if policies, err := parsePolicies(*tokenPolicies, validPolicy); err != nil {
+		wstunSrv.Log.Error().Err(err).Msg("Invalid token policies, ignoring them")
+	} else {
+		wstunSrv.TokenPolicies = policies
+	}
+	wstunSrv.StickyTTL = time.Duration(max(*stickyTTL, 1)) * time.Second
+	if !validBalance(wstunSrv.BalancePolicy) {
+		wstunSrv.Log.Error().Str("policy", wstunSrv.BalancePolicy).Msg("Unknown balancing policy, using first-free")
+		wstunSrv.BalancePolicy = balanceFirstFree
+	}
+	if policies, err := parsePolicies(*balancePolicies, validBalance); err != nil {
+		wstunSrv.Log.Error().Err(err).Msg("Invalid balancing policies, ignoring them")
+	} else {
+		wstunSrv.BalancePolicies = policies
+	}
+	if *tokenClaim > 0 {
+		wstunSrv.ClaimTimeout = time.Duration(*tokenClaim) * time.Second
+		wstunSrv.Log.Info().Dur("timeout", wstunSrv.ClaimTimeout).Msg("Binding tokens to the client that claims them")
+	}
+	if *reconnectGrace > 0 {
+		wstunSrv.ReconnectGrace = time.Duration(*reconnectGrace) * time.Second
+		wstunSrv.Log.Info().Dur("grace", wstunSrv.ReconnectGrace).Msg("Holding requests while clients reconnect")
+	}
+	wstunSrv.StreamWindow, wstunSrv.ConnWindow = validateWindows(wstunSrv.StreamWindow, wstunSrv.ConnWindow)
 	wstunSrv.WSTimeout = calcWsTimeout(wstunSrv.Log, *tout)
 	cacheMutex.Lock()
 	whoToken = *whoTok
@@ -253,6 +423,13 @@ func NewWSTunnelServer(args []string) *WSTunnelServer {
 
 	wstunSrv.HTTPTimeout = time.Duration(*httpTout) * time.Second
 	wstunSrv.Log.Info().Dur("timeout", wstunSrv.HTTPTimeout).Msg("Setting remote request timeout")
+	if *streamTout > 0 {
+		wstunSrv.StreamIdleTimeout = time.Duration(*streamTout) * time.Second
+		wstunSrv.Log.Info().Dur("timeout", wstunSrv.StreamIdleTimeout).Msg("Setting streaming response idle timeout")
+	}
+	if *resumeTout > 0 {
+		wstunSrv.ResumeTimeout = time.Duration(*resumeTout) * time.Second
+	}
 
 	wstunSrv.exitChan = make(chan struct{}, 1)
 
@@ -325,6 +502,18 @@ func (t *WSTunnelServer) Start(listener net.Listener) {
 
 	go t.idleTunnelReaper()
 
+	if t.RouteCookie {
+		t.setupRouteCookie()
+	}
+
+	if t.HostMapFile != "" {
+		if err := t.loadHostMap(); err != nil {
+			t.Log.Error().Err(err).Str("file", t.HostMapFile).Msg("Cannot load host routes")
+		}
+		t.hostMapStop = make(chan struct{})
+		go t.watchHostMap(t.hostMapStop)
+	}
+
 	//===== HTTP Server =====
 
 	var httpServer http.Server
@@ -366,12 +555,18 @@ func (t *WSTunnelServer) Start(listener net.Listener) {
 	if t.adminService != nil {
 		httpMux.HandleFunc(buildPath(t.BasePath, "/admin/auditing"), t.adminService.HandleAuditing)
 		httpMux.HandleFunc(buildPath(t.BasePath, "/admin/monitoring"), t.adminService.HandleMonitoring)
+		httpMux.HandleFunc(buildPath(t.BasePath, "/admin/connections/"), t.adminService.HandleConnections)
 		httpMux.HandleFunc(buildPath(t.BasePath, "/admin/api-docs"), t.adminService.HandleAPIDocs)
 		httpMux.HandleFunc(buildPath(t.BasePath, "/admin/ui"), t.adminService.HandleAdminUI)
 		httpMux.HandleFunc(buildPath(t.BasePath, "/admin"), t.adminService.HandleAdminUIRedirect)
 	}
 	t.adminServiceMutex.RUnlock()
-	httpServer.Handler = httpMux
+	// requests for hosts of the host map go to their tunnel whatever their path
+	httpServer.Handler = t.hostRouter(http.HandlerFunc(wrap(payloadHostHandler)), httpMux)
+	if t.H2C {
+		t.Log.Info().Msg("Accepting HTTP/2 without TLS (h2c)")
+		setH2C(&httpServer)
+	}
 
 	// Read/Write timeouts disabled for now due to bug:
 	// https://code.google.com/p/go/issues/detail?id=6410
@@ -416,6 +611,9 @@ func (t *WSTunnelServer) Stop() {
 		}
 	}
 	t.adminServiceMutex.RUnlock()
+	if t.hostMapStop != nil {
+		close(t.hostMapStop)
+	}
 	t.exitChan <- struct{}{}
 }
 
@@ -458,6 +656,9 @@ func statsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 	if _, err := fmt.Fprintf(safeW, "max_clients_per_token=%d\n", t.MaxClientsPerToken); err != nil {
 		t.Log.Error().Err(err).Msg("Failed to write response")
 	}
+	if _, err := fmt.Fprintf(safeW, "compression=%t\n", t.Compression); err != nil {
+		t.Log.Error().Err(err).Msg("Failed to write response")
+	}
 
 	// print current token client counts
 	if t.MaxClientsPerToken > 0 {
@@ -489,15 +690,17 @@ func statsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 
 	reqPending := 0
 	badTunnels := 0
+	var total tunnelTraffic
 	for i, rs := range rss {
 		if _, err := fmt.Fprintf(safeW, "\ntunnel%02d_token=%s\n", i, cutToken(rs.token)); err != nil {
 			rs.log.Error().Err(err).Msg("Failed to write response")
 		}
-		if _, err := fmt.Fprintf(safeW, "tunnel%02d_req_pending=%d\n", i, len(rs.requestSet)); err != nil {
+		pending := rs.getPendingRequests()
+		if _, err := fmt.Fprintf(safeW, "tunnel%02d_req_pending=%d\n", i, pending); err != nil {
 			rs.log.Error().Err(err).Msg("Failed to write response")
 		}
-		reqPending += len(rs.requestSet)
-		if _, err := fmt.Fprintf(safeW, "tunnel%02d_tun_addr=%s\n", i, rs.remoteAddr); err != nil {
+		reqPending += pending
+		if _, err := fmt.Fprintf(safeW, "tunnel%02d_tun_addr=%s\n", i, rs.getRemoteAddr()); err != nil {
 			rs.log.Error().Err(err).Msg("Failed to write response")
 		}
 		remoteName, remoteWhois := rs.getRemoteInfo()
@@ -517,28 +720,34 @@ func statsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 				rs.log.Error().Err(err).Msg("Failed to write response")
 			}
 		}
-		if rs.lastActivity.IsZero() {
+		lastActivity := rs.getLastActivity()
+		if lastActivity.IsZero() {
 			if _, err := fmt.Fprintf(safeW, "tunnel%02d_idle_secs=NaN\n", i); err != nil {
 				rs.log.Error().Err(err).Msg("Failed to write response")
 			}
 			badTunnels++
 		} else {
-			if _, err := fmt.Fprintf(safeW, "tunnel%02d_idle_secs=%.1f\n", i, time.Since(rs.lastActivity).Seconds()); err != nil {
+			if _, err := fmt.Fprintf(safeW, "tunnel%02d_idle_secs=%.1f\n", i, time.Since(lastActivity).Seconds()); err != nil {
 				rs.log.Error().Err(err).Msg("Failed to write response")
 			}
-			if time.Since(rs.lastActivity).Seconds() > 60 {
+			if time.Since(lastActivity).Seconds() > 60 {
 				badTunnels++
 			}
 		}
-		if len(rs.requestSet) > 0 {
-			rs.requestSetMutex.Lock()
-			if r, ok := rs.requestSet[rs.lastID]; ok {
-				if _, err := fmt.Fprintf(safeW, "tunnel%02d_cli_addr=%s\n", i, r.remoteAddr); err != nil {
-					rs.log.Error().Err(err).Msg("Failed to write response")
-				}
+		if _, err := fmt.Fprintf(safeW, "tunnel%02d_compression=%t\n", i, rs.compressed.Load()); err != nil {
+			rs.log.Error().Err(err).Msg("Failed to write response")
+		}
+		if _, err := writeTraffic(safeW, fmt.Sprintf("tunnel%02d_", i), &rs.traffic); err != nil {
+			rs.log.Error().Err(err).Msg("Failed to write response")
+		}
+		total.add(&rs.traffic)
+		rs.requestSetMutex.Lock()
+		if r, ok := rs.requestSet[rs.lastID]; ok {
+			if _, err := fmt.Fprintf(safeW, "tunnel%02d_cli_addr=%s\n", i, r.remoteAddr); err != nil {
+				rs.log.Error().Err(err).Msg("Failed to write response")
 			}
-			rs.requestSetMutex.Unlock()
 		}
+		rs.requestSetMutex.Unlock()
 	}
 	if _, err := fmt.Fprintln(safeW, ""); err != nil {
 		t.Log.Error().Err(err).Msg("Failed to write response")
@@ -549,6 +758,9 @@ func statsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 	if _, err := fmt.Fprintf(safeW, "dead_tunnels=%d\n", badTunnels); err != nil {
 		t.Log.Error().Err(err).Msg("Failed to write response")
 	}
+	if _, err := writeTraffic(safeW, "", &total); err != nil {
+		t.Log.Error().Err(err).Msg("Failed to write response")
+	}
 }
 
 // payloadHeaderHandler handles payload requests with the tunnel token in the Host header.
@@ -558,6 +770,12 @@ func payloadHeaderHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Requ
 	safeW := &safeResponseWriter{ResponseWriter: w}
 
 	tok := r.Header.Get("X-Token")
+	if tok == "" && t.RouteCookie {
+		tok = string(t.cookieToken(r))
+	}
+	if t.RouteCookie {
+		dropCookie(r, routeCookieName)
+	}
 	if tok == "" {
 		t.Log.Info().Str("path", r.URL.Path).Msg("HTTP Missing X-Token header")
 		safeError(safeW, "Missing X-Token header", 400)
@@ -591,6 +809,11 @@ func payloadPrefixHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Requ
 		return
 	}
 	r.URL = parsedURL
+	t.setForwardedPrefix(r)
+	if t.RouteCookie {
+		t.setRouteCookie(safeW, r, token(m[1]))
+		dropCookie(r, routeCookieName)
+	}
 	payloadHandler(t, safeW, r, token(m[1]))
 }
 
@@ -602,7 +825,10 @@ func payloadHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, t
 	}
 
 	// create the request object
+	affinity := t.affinity(safeW, r)
 	req := makeRequest(r, t.HTTPTimeout)
+	req.affinity = affinity
+	req.idleStreams = t.StreamIdleTimeout > 0
 	req.log = t.Log.With().Str("token", cutToken(tok)).Logger()
 
 	req.remoteAddr = r.Header.Get("X-Forwarded-For")
@@ -622,14 +848,26 @@ func payloadHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, t
 		}
 	}
 
-	// repeatedly try to get a response
-	for tries := 1; tries <= 3; tries++ {
-		retry := getResponse(t, req, safeW, r, tok, tries)
+	// repeatedly try to get a response, as far as the retry policy allows
+	for tries := 1; ; tries++ {
+		retry, maybeSent := getResponse(t, req, safeW, r, tok, tries)
+		if requestID > 0 && as != nil {
+			outcome := attemptOutcome(retry, safeW.statusCode)
+			if err := as.RecordRequestAttempt(context.Background(), requestID, tries, outcome); err != nil {
+				t.Log.Warn().Err(err).Msg("Failed to record request attempt")
+			}
+		}
 		if !retry {
 			break
 		}
-		if tries == 3 {
+		if !t.canRetry(r, maybeSent) {
+			req.log.Info().Str("verb", r.Method).Str("status", "502").Msg("HTTP RET request may have reached the client, not retrying")
+			safeError(safeW, "Tunnel broke while sending the request, not retrying "+r.Method, http.StatusBadGateway)
+			break
+		}
+		if tries >= t.retryAttempts() || !t.waitRetry(r.Context(), req, tries+1) {
 			safeError(safeW, "Tunnel retry exhausted", http.StatusGatewayTimeout)
+			break
 		}
 	}
 
@@ -637,7 +875,8 @@ func payloadHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, t
 		var success bool
 		var errMsg string
 		switch {
-		case safeW.statusCode >= 200 && safeW.statusCode < 400:
+		case safeW.statusCode == http.StatusSwitchingProtocols,
+			safeW.statusCode >= 200 && safeW.statusCode < 400:
 			success = true
 		case safeW.statusCode > 0:
 			errMsg = fmt.Sprintf("HTTP %d", safeW.statusCode)
@@ -652,9 +891,9 @@ func payloadHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, t
 
 // getResponse adds the request to a remote server and then waits to get a response back, and it
 // writes it. It returns true if the whole thing needs to be retried and false if we're done
-// sucessfully or not)
+// sucessfully or not), and whether the request may have reached the client before it broke off
 func getResponse(t *WSTunnelServer, req *remoteRequest, w http.ResponseWriter, r *http.Request,
-	tok token, tries int) (retry bool) {
+	tok token, tries int) (retry, maybeSent bool) {
 	retry = false
 
 	// get a hold of the remote server
@@ -668,26 +907,27 @@ func getResponse(t *WSTunnelServer, req *remoteRequest, w http.ResponseWriter, r
 		_, _ = w.Write([]byte("Tunnel not found (or not seen in a long time)"))
 		return
 	}
+	if !t.awaitReconnect(r.Context(), rs, req) {
+		if r.Context().Err() != nil {
+			// client disconnected while waiting for the tunnel client
+			req.log.Info().Str("status", "499").Str("err", "Client disconnected").Msg("HTTP RET")
+			return
+		}
+		req.log.Info().Str("addr", req.remoteAddr).Str("status", "503").Str("err", "Tunnel client not connected").Msg("HTTP RCV")
+		t.tunnelUnavailable(w)
+		return
+	}
 
 	// Ensure we retire the request when we pop out of this function
-	// and signal the tunnel reader to continue.
-	// The signal is sent in a goroutine because wsReader holds readCond.L
-	// while reading from the WebSocket. Blocking here would prevent the
-	// HTTP response from being flushed to the client.
-	defer func() {
-		rs.RetireRequest(req)
-		if !retry {
-			go func() {
-				rs.readCond.L.Lock()
-				rs.readCond.Signal()
-				rs.readCond.L.Unlock()
-			}()
-		}
-	}()
+	defer rs.RetireRequest(req)
 
 	// enqueue request
 	err := rs.AddRequest(req)
-	if err != nil {
+	if err == errClientBusy {
+		req.log.Info().Str("addr", req.remoteAddr).Str("status", "503").Str("err", err.Error()).Msg("HTTP RCV")
+		safeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		req.log.Info().Str("addr", req.remoteAddr).Str("status", "504").Str("err", err.Error()).Msg("HTTP RCV")
 		safeError(w, err.Error(), http.StatusGatewayTimeout)
 		return
@@ -716,26 +956,60 @@ func getResponse(t *WSTunnelServer, req *remoteRequest, w http.ResponseWriter, r
 		timer.Stop()
 		// if there's no error just respond
 		if resp.err == nil {
-			code := writeResponse(w, resp.response)
+			if pr, ok := resp.response.(*streamReader); ok && req.upgrade {
+				// websockets live as long as both ends want, they aren't subject to the deadline
+				code, err := relayUpgrade(rs, req, w, r, pr)
+				req.log.Info().Int("status", code).Msg("HTTP RET")
+				if err != nil {
+					rs.cancelRequest(req)
+				}
+				return
+			}
+			if pr, ok := resp.response.(*streamReader); ok {
+				// the response is streamed, make sure it can't outlive the deadline and
+				// tell the tunnel reader when we're no longer interested in the rest
+				expire := time.AfterFunc(time.Until(req.deadline), func() {
+					_ = pr.CloseWithError(errors.New("tunnel timeout while streaming response"))
+				})
+				defer expire.Stop()
+				defer func() { _ = pr.Close() }()
+				code, err := writeStreamedResponse(w, pr, expire, t.StreamIdleTimeout)
+				req.log.Info().Int("status", code).Msg("HTTP RET")
+				if err != nil {
+					rs.cancelRequest(req)
+				}
+				return
+			}
+			code, err := writeResponse(w, resp.response)
 			req.log.Info().Int("status", code).Msg("HTTP RET")
+			if err != nil {
+				// the caller went away or the stream broke, the client can stop
+				rs.cancelRequest(req)
+			}
 			return
 		}
 		// if it's a non-retryable error then write the error
-		if resp.err != ErrRetry {
+		if resp.err == errUpgradeUnsupported || resp.err == errTunnelClosed {
+			req.log.Info().Str("status", "502").Str("err", resp.err.Error()).Msg("HTTP RET")
+			safeError(w, resp.err.Error(), http.StatusBadGateway)
+		} else if resp.err != ErrRetry && resp.err != errMaybeSent {
 			req.log.Info().Str("status", "504").Str("err", resp.err.Error()).Msg("HTTP RET")
 			safeError(w, resp.err.Error(), http.StatusGatewayTimeout)
 		} else {
 			// else we're gonna retry
 			req.log.Info().Str("verb", r.Method).Str("url", r.URL.String()).Msg("WS   retrying")
 			retry = true
+			maybeSent = resp.err == errMaybeSent
 		}
 	case <-timer.C:
 		// it timed out...
 		req.log.Info().Str("status", "504").Str("err", "Tunnel timeout").Msg("HTTP RET")
 		safeError(w, "Tunnel timeout", http.StatusGatewayTimeout)
+		rs.cancelRequest(req)
 	case <-r.Context().Done():
 		// client disconnected before we got a response
 		req.log.Info().Str("status", "499").Str("err", "Client disconnected").Msg("HTTP RET")
+		rs.cancelRequest(req)
 	}
 	return
 }
@@ -875,13 +1149,15 @@ func (t *WSTunnelServer) getRemoteServer(tok token, create bool) *remoteServer {
 		maxRequests = 1000
 	}
 	rs = &remoteServer{
-		token:        tok,
-		lastActivity: time.Now(),
-		requestQueue: make(chan *remoteRequest, maxRequests),
-		requestSet:   make(map[int16]*remoteRequest),
-		log:          t.Log.With().Str("token", cutToken(tok)).Logger(),
+		token:          tok,
+		lastActivity:   time.Now(),
+		requestQueue:   make(chan *remoteRequest, maxRequests),
+		requestSet:     make(map[uint32]*remoteRequest),
+		log:            t.Log.With().Str("token", cutToken(tok)).Logger(),
+		responseBuffer: t.MaxResponseBuffer,
+		balance:        t.balancePolicy(tok),
+		stickyTTL:      t.StickyTTL,
 	}
-	rs.readCond = sync.NewCond(&rs.readMutex)
 	t.serverRegistry[tok] = rs
 	t.Log.Info().Str("token", cutToken(tok)).Msg("WS new tunnel created")
 	return rs
@@ -902,19 +1178,32 @@ l:
 			break l
 		}
 	}
-	idle := time.Since(rs.lastActivity).Minutes()
+	idle := time.Since(rs.getLastActivity()).Minutes()
 	rs.log.Info().Float64("inactive[min]", idle).Msg("WS tunnel closed")
 }
 
 func (rs *remoteServer) AddRequest(req *remoteRequest) error {
 	rs.requestSetMutex.Lock()
 	defer rs.requestSetMutex.Unlock()
-	if req.id < 0 {
-		rs.lastID = (rs.lastID + 1) % 32000
+	if req.id == 0 {
+		// skip 0, which identifies the connection itself in version 2 frames
+		rs.lastID++
+		if rs.lastID == 0 {
+			rs.lastID++
+		}
 		req.id = rs.lastID
-		req.log = req.log.With().Int16("id", req.id).Logger()
+		req.log = req.log.With().Uint32("id", req.id).Logger()
 	}
 	rs.requestSet[req.id] = req
+	// a retried request starts over
+	req.conn = nil
+	req.sent.Store(false)
+	for len(req.replyChan) > 0 {
+		<-req.replyChan
+	}
+	if dispatched, err := rs.dispatch(req); dispatched {
+		return err
+	}
 	select {
 	case rs.requestQueue <- req:
 		// enqueued!
@@ -924,6 +1213,21 @@ func (rs *remoteServer) AddRequest(req *remoteRequest) error {
 	}
 }
 
+// cancelRequest tells the client working on a request that the caller is gone so it can stop
+func (rs *remoteServer) cancelRequest(req *remoteRequest) {
+	rs.requestSetMutex.Lock()
+	rc := req.conn
+	rs.requestSetMutex.Unlock()
+	if rc == nil || rc.version < protocolV2 {
+		return // not sent yet, or the client can't be told
+	}
+	if err := rc.writeFrame(frameCancel, 0, req.id, nil, time.Time{}); err != nil {
+		req.log.Info().Err(err).Msg("WS   cannot send cancel")
+		return
+	}
+	req.log.Info().Msg("WS   SND cancel")
+}
+
 func (rs *remoteServer) RetireRequest(req *remoteRequest) {
 	rs.requestSetMutex.Lock()
 	defer rs.requestSetMutex.Unlock()
@@ -932,16 +1236,15 @@ func (rs *remoteServer) RetireRequest(req *remoteRequest) {
 }
 
 func makeRequest(r *http.Request, httpTimeout time.Duration) *remoteRequest {
-	buf := &bytes.Buffer{}
-	_ = r.Write(buf)
 	now := time.Now()
 	return &remoteRequest{
-		id:        -1,
 		info:      r.Method + " " + r.URL.String(),
-		buffer:    buf,
+		httpReq:   r,
+		upgrade:   isUpgrade(r),
 		replyChan: make(chan responseBuffer, 10),
-		deadline:  now.Add(httpTimeout),
+		deadline:  now.Add(requestTimeout(r, httpTimeout)),
 		startTime: now,
+		continued: make(chan struct{}),
 	}
 
 }
@@ -950,13 +1253,14 @@ func makeRequest(r *http.Request, httpTimeout time.Duration) *remoteRequest {
 var censoredHeaders = []string{
 	"Connection",
 	"Keep-Alive",
-	"Te", // canonicalized version of "TE"
-	"Trailers",
+	"Te",      // canonicalized version of "TE"
+	"Trailer", // declared again from resp.Trailer, see copyResponse
 	"Transfer-Encoding",
 }
 
-// Write an HTTP response from a byte buffer into a ResponseWriter
-func writeResponse(w http.ResponseWriter, r io.Reader) int {
+// Write an HTTP response from a byte buffer into a ResponseWriter, it returns the status code
+// and an error if the response could not be delivered completely
+func writeResponse(w http.ResponseWriter, r io.Reader) (int, error) {
 	// Ensure we're using our safe response writer
 	safeW, ok := w.(*safeResponseWriter)
 	if !ok {
@@ -965,26 +1269,111 @@ func writeResponse(w http.ResponseWriter, r io.Reader) int {
 
 	resp, err := http.ReadResponse(bufio.NewReader(r), nil)
 	if err != nil {
-		pkgLog.Info().Err(err).Msg("WriteResponse: can't parse incoming response")
-		// Set headers before calling WriteHeader to avoid superfluous warning
-		safeW.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		safeW.Header().Set("X-Content-Type-Options", "nosniff")
-		safeW.WriteHeader(httpStatusParseError)
-		return httpStatusParseError
+		return writeParseError(safeW, err), nil
 	}
+	return copyResponse(safeW, resp, r)
+}
+
+// writeStreamedResponse writes a response coming through the tunnel in pieces. Responses that
+// never really end, such as server-sent events or other chunked streams, are not held to the
+// request deadline once their head arrived: expire is pushed back by idle every time a piece
+// comes in so they're only cut off when they stall.
+func writeStreamedResponse(w http.ResponseWriter, pr *streamReader, expire *time.Timer,
+	idle time.Duration) (int, error) {
+	safeW, ok := w.(*safeResponseWriter)
+	if !ok {
+		safeW = &safeResponseWriter{ResponseWriter: w}
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(pr), nil)
+	if err != nil {
+		return writeParseError(safeW, err), nil
+	}
+	if idle > 0 && isStreamingResponse(resp) {
+		expire.Reset(idle)
+		resp.Body = &idleBody{ReadCloser: resp.Body, expire: expire, idle: idle}
+	}
+	return copyResponse(safeW, resp, pr)
+}
+
+// isStreamingResponse returns whether a response is open-ended: server-sent events or a body
+// sent in chunks with no announced length
+func isStreamingResponse(resp *http.Response) bool {
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mt == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+}
+
+// idleBody pushes back a timer every time a piece of the body is read
+type idleBody struct {
+	io.ReadCloser
+	expire *time.Timer
+	idle   time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.expire.Reset(b.idle)
+	}
+	return n, err
+}
+
+// writeParseError reports a tunneled response that cannot be parsed
+func writeParseError(safeW *safeResponseWriter, err error) int {
+	pkgLog.Info().Err(err).Msg("WriteResponse: can't parse incoming response")
+	// Set headers before calling WriteHeader to avoid superfluous warning
+	safeW.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	safeW.Header().Set("X-Content-Type-Options", "nosniff")
+	safeW.WriteHeader(httpStatusParseError)
+	return httpStatusParseError
+}
+
+// copyResponse writes a parsed response, r is the stream it is read from
+func copyResponse(safeW *safeResponseWriter, resp *http.Response, r io.Reader) (int, error) {
 	for _, h := range censoredHeaders {
 		resp.Header.Del(h)
 	}
-	// write the response
+	// write the response, flushing each piece so streamed responses reach the caller as
+	// they come through the tunnel
 	copyHeader(safeW.Header(), resp.Header)
+	// trailers are announced up front, their values only come in after the body
+	for k := range resp.Trailer {
+		safeW.Header().Add("Trailer", k)
+	}
 	safeW.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(safeW, resp.Body); err != nil {
+	_, err := io.Copy(flushWriter{safeW}, resp.Body)
+	if err != nil {
 		pkgLog.Error().Err(err).Msg("Error copying response body")
+		// closing the body would otherwise drain the rest of a stream nobody is going to read
+		if c, ok := r.(io.Closer); ok {
+			_ = c.Close()
+		}
 	}
 	if err := resp.Body.Close(); err != nil {
 		pkgLog.Error().Err(err).Msg("Failed to close response body")
 	}
-	return resp.StatusCode
+	// the body filled in resp.Trailer, including trailers that were not announced
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			safeW.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+	return resp.StatusCode, err
+}
+
+// flushWriter flushes the underlying ResponseWriter after every write
+type flushWriter struct {
+	w *safeResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		fw.w.Flush()
+	}
+	return n, err
 }
 
 // idleTunnelReaper should be run in a goroutine to kill tunnels that are idle for a long time
@@ -1001,12 +1390,12 @@ func (t *WSTunnelServer) idleTunnelReaper() {
 
 		t.serverRegistryMutex.Lock()
 		for _, rs := range t.serverRegistry {
-			if time.Since(rs.lastActivity) > tunnelInactiveKillTimeout {
-				rs.log.Warn().Dur("ago", time.Since(rs.lastActivity)).Msg("Tunnel not seen for a long time, deleting")
+			if inactive := time.Since(rs.getLastActivity()); inactive > tunnelInactiveKillTimeout {
+				rs.log.Warn().Dur("ago", inactive).Msg("Tunnel not seen for a long time, deleting")
 				reaped = append(reaped, reapedTunnel{
 					token:      string(rs.token),
-					remoteAddr: rs.remoteAddr,
-					inactiveBy: time.Since(rs.lastActivity),
+					remoteAddr: rs.getRemoteAddr(),
+					inactiveBy: inactive,
 				})
 				// unlink so new tunnels/tokens use a new RemoteServer object
 				delete(t.serverRegistry, rs.token)
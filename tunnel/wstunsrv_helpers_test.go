@@ -2,7 +2,6 @@ package tunnel
 
 import (
 	"bytes"
-	"sync"
 	"testing"
 	"time"
 
@@ -10,15 +9,13 @@ import (
 )
 
 func newTestRemoteServer(log zerolog.Logger, queueSize int) *remoteServer {
-	rs := &remoteServer{
+	return &remoteServer{
 		token:        token("test-token-12345678"),
 		log:          log,
 		requestQueue: make(chan *remoteRequest, queueSize),
-		requestSet:   make(map[int16]*remoteRequest),
+		requestSet:   make(map[uint32]*remoteRequest),
 		lastActivity: time.Now(),
 	}
-	rs.readCond = sync.NewCond(&rs.readMutex)
-	return rs
 }
 
 func TestCutToken(t *testing.T) {
@@ -64,7 +61,7 @@ func TestRemoteServerAbortRequests(t *testing.T) {
 			requests := make([]*remoteRequest, tt.requestsToQueue)
 			for i := range tt.requestsToQueue {
 				requests[i] = &remoteRequest{
-					id:        int16(i),
+					id:        uint32(i),
 					replyChan: make(chan responseBuffer, 1),
 					log:       zerolog.Nop(),
 				}
@@ -96,7 +93,7 @@ func TestRemoteServerAbortRequestsWithFullReplyChan(t *testing.T) {
 	rs := newTestRemoteServer(zerolog.Nop(), 10)
 
 	req := &remoteRequest{
-		id:        int16(1),
+		id:        uint32(1),
 		replyChan: make(chan responseBuffer, 1),
 		log:       zerolog.Nop(),
 	}
@@ -117,7 +114,7 @@ func TestRemoteServerAbortRequestsMultipleCalls(t *testing.T) {
 
 	for i := range 3 {
 		rs.requestQueue <- &remoteRequest{
-			id:        int16(i),
+			id:        uint32(i),
 			replyChan: make(chan responseBuffer, 1),
 			log:       zerolog.Nop(),
 		}
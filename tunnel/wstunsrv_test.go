@@ -33,7 +33,7 @@ func TestStatusHandlerWithClientVersion(t *testing.T) {
 		token:         testToken,
 		log:           ts.Log.With().Str("token", "test-token").Logger(),
 		requestQueue:  make(chan *remoteRequest, 100),
-		requestSet:    make(map[int16]*remoteRequest),
+		requestSet:    make(map[uint32]*remoteRequest),
 		lastActivity:  time.Now(),
 		clientVersion: "test-client-v1.2.3",
 	}
@@ -91,7 +91,7 @@ func TestStatusHandlerWithoutClientVersion(t *testing.T) {
 		token:         testToken,
 		log:           ts.Log.With().Str("token", "test-token").Logger(),
 		requestQueue:  make(chan *remoteRequest, 100),
-		requestSet:    make(map[int16]*remoteRequest),
+		requestSet:    make(map[uint32]*remoteRequest),
 		lastActivity:  time.Now(),
 		clientVersion: "", // No client version
 	}
@@ -204,7 +204,7 @@ func TestMaxRequestsPerTunnel(t *testing.T) {
 	// Add requests up to the limit
 	for i := 0; i < 5; i++ {
 		req := &remoteRequest{
-			id:        int16(i),
+			id:        uint32(i),
 			replyChan: make(chan responseBuffer, 1),
 			deadline:  time.Now().Add(30 * time.Second),
 			log:       rs.log.With().Int("id", i).Logger(),
@@ -218,7 +218,7 @@ func TestMaxRequestsPerTunnel(t *testing.T) {
 
 	// Try to add one more request, should fail
 	extraReq := &remoteRequest{
-		id:        int16(99),
+		id:        uint32(99),
 		replyChan: make(chan responseBuffer, 1),
 		deadline:  time.Now().Add(30 * time.Second),
 		log:       rs.log.With().Int("id", 99).Logger(),